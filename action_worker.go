@@ -0,0 +1,155 @@
+// Copyright (c) 2021 Damien Stuart. All rights reserved.
+//
+// Use of this source code is governed by the MIT License that can be found
+// in the LICENSE file.
+//
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// Overflow policies for full action queues
+//
+const (
+	overflowDropNewest = iota
+	overflowDropOldest
+	overflowBlock
+)
+
+const defaultActionQueueSize = 1000
+
+// actionWorker sends traps to one action destination (a forward
+// destination, log file, etc.) from its own goroutine, so a slow
+// destination doesn't hold up the listener or the other destinations.
+// Traps wait in a bounded queue, and the overflow policy says what to do
+// when it is full.
+//
+type actionWorker struct {
+	name     string
+	action   interface{}
+	overflow int
+	mu       sync.RWMutex
+	closed   bool
+	queue    chan *sgTrap
+	done     chan struct{}
+}
+
+// validateActionQueue checks the general:action_queue_* settings.
+//
+func validateActionQueue(newConfig *trapexConfig) error {
+	switch strings.ToLower(newConfig.General.ActionQueueOverflow) {
+	case "drop_newest":
+		newConfig.General.actionQueueOverflow = overflowDropNewest
+	case "drop_oldest":
+		newConfig.General.actionQueueOverflow = overflowDropOldest
+	case "block":
+		newConfig.General.actionQueueOverflow = overflowBlock
+	default:
+		return fmt.Errorf("unsupported or invalid value (%s) for general:action_queue_overflow", newConfig.General.ActionQueueOverflow)
+	}
+	if newConfig.General.ActionQueueSize <= 0 {
+		return fmt.Errorf("invalid value (%d) for general:action_queue_size", newConfig.General.ActionQueueSize)
+	}
+	return nil
+}
+
+// newActionWorker starts a worker for the given action. The name is the
+// destination used in the drop counter.
+//
+func newActionWorker(name string, action interface{}, teConf *trapexConfig) *actionWorker {
+	size := teConf.General.ActionQueueSize
+	if size <= 0 {
+		size = defaultActionQueueSize
+	}
+	w := &actionWorker{
+		name:     name,
+		action:   action,
+		overflow: teConf.General.actionQueueOverflow,
+		queue:    make(chan *sgTrap, size),
+		done:     make(chan struct{}),
+	}
+	go w.run()
+	return w
+}
+
+// queueTrap queues a copy of the trap (later filters can change it) for the
+// worker.
+//
+func (w *actionWorker) queueTrap(sgt *sgTrap) {
+	trap := *sgt
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	if w.closed {
+		return
+	}
+	switch w.overflow {
+	case overflowBlock:
+		w.queue <- &trap
+		return
+	case overflowDropOldest:
+		for {
+			select {
+			case w.queue <- &trap:
+				return
+			default:
+			}
+			// Make room by dropping the oldest trap (unless the worker
+			// just took it).
+			select {
+			case <-w.queue:
+				w.dropped()
+			default:
+			}
+		}
+	default:
+		select {
+		case w.queue <- &trap:
+		default:
+			w.dropped()
+		}
+	}
+}
+
+func (w *actionWorker) dropped() {
+	actionDropped.WithLabelValues(w.name).Inc()
+	logger.Debug().Str("destination", w.name).Msg("Action queue is full, dropping trap")
+}
+
+// run sends the queued traps to the action.
+//
+func (w *actionWorker) run() {
+	defer close(w.done)
+	for sgt := range w.queue {
+		switch a := w.action.(type) {
+		case *trapForwarder:
+			if err := a.processTrap(sgt); err != nil {
+				a.forwardError(err)
+			}
+		case *trapLogger:
+			a.processTrap(sgt)
+		case *trapCsvLogger:
+			a.processTrap(sgt)
+		case *trapJsonLogger:
+			a.processTrap(sgt)
+		case *trapSyslog:
+			a.processTrap(sgt)
+		}
+	}
+}
+
+// close stops the worker once the queued traps have been sent.
+//
+func (w *actionWorker) close() {
+	w.mu.Lock()
+	if w.closed {
+		w.mu.Unlock()
+		return
+	}
+	w.closed = true
+	close(w.queue)
+	w.mu.Unlock()
+	<-w.done
+}
@@ -0,0 +1,132 @@
+// Copyright (c) 2021 Damien Stuart. All rights reserved.
+//
+// Use of this source code is governed by the MIT License that can be found
+// in the LICENSE file.
+//
+package main
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	g "github.com/gosnmp/gosnmp"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// blockingConn is the connection of a forward destination that waits for
+// each send to be released, and records the traps by their sysName
+// varbind.
+//
+type blockingConn struct {
+	net.Conn
+	mu      sync.Mutex
+	sent    []string
+	started chan struct{}
+	release chan struct{}
+}
+
+func (c *blockingConn) Write(b []byte) (int, error) {
+	c.started <- struct{}{}
+	<-c.release
+	p, err := (&g.GoSNMP{}).SnmpDecodePacket(b)
+	if err != nil {
+		return 0, err
+	}
+	c.mu.Lock()
+	c.sent = append(c.sent, string(p.Variables[len(p.Variables)-1].Value.([]byte)))
+	c.mu.Unlock()
+	return len(b), nil
+}
+
+func (c *blockingConn) SetDeadline(t time.Time) error { return nil }
+
+func TestActionQueueConfig(t *testing.T) {
+	var testConfig trapexConfig
+	if err := loadConfig("tests/config/general.yml", &testConfig); err != nil {
+		t.Fatalf("%s", err)
+	}
+	if testConfig.General.ActionQueueSize != 1000 || testConfig.General.ActionQueueOverflow != "drop_newest" {
+		t.Errorf("action queue defaults not set correctly: %d %s", testConfig.General.ActionQueueSize, testConfig.General.ActionQueueOverflow)
+	}
+	for overflow, policy := range map[string]int{"drop_newest": overflowDropNewest, "Drop_Oldest": overflowDropOldest, "block": overflowBlock} {
+		testConfig.General.ActionQueueOverflow = overflow
+		if err := validateActionQueue(&testConfig); err != nil || testConfig.General.actionQueueOverflow != policy {
+			t.Errorf("action_queue_overflow %s not set correctly: %v", overflow, err)
+		}
+	}
+	testConfig.General.ActionQueueOverflow = "drop_all"
+	if err := validateActionQueue(&testConfig); err == nil {
+		t.Errorf("Should have detected an invalid action_queue_overflow")
+	}
+	testConfig.General.ActionQueueOverflow = "block"
+	testConfig.General.ActionQueueSize = 0
+	if err := validateActionQueue(&testConfig); err == nil {
+		t.Errorf("Should have detected an invalid action_queue_size")
+	}
+}
+
+func TestActionWorkerOverflow(t *testing.T) {
+	tests := []struct {
+		overflow int
+		size     int
+		sent     []string
+		dropped  float64
+	}{
+		{overflowDropNewest, 2, []string{"1", "2", "3"}, 2},
+		{overflowDropOldest, 2, []string{"1", "4", "5"}, 2},
+		{overflowBlock, 2, []string{"1", "2", "3", "4", "5"}, 0},
+	}
+	for _, test := range tests {
+		sender := &blockingConn{started: make(chan struct{}, 10), release: make(chan struct{})}
+		fwd := &trapForwarder{destination: &g.GoSNMP{Version: g.Version2c, Community: "public", Conn: sender, Context: context.Background()}}
+
+		var testConfig trapexConfig
+		testConfig.General.ActionQueueSize = test.size
+		testConfig.General.actionQueueOverflow = test.overflow
+		name := "overflow_test_" + string(rune('0'+test.overflow))
+		before := testutil.ToFloat64(actionDropped.WithLabelValues(name))
+		w := newActionWorker(name, fwd, &testConfig)
+
+		// The first trap keeps the worker busy, two fill the queue, and
+		// then the queue overflows.
+		w.queueTrap(testTrap(g.Version2c, 0, sysNameVar("1")))
+		<-sender.started
+		w.queueTrap(testTrap(g.Version2c, 0, sysNameVar("2")))
+		w.queueTrap(testTrap(g.Version2c, 0, sysNameVar("3")))
+		queued := make(chan struct{})
+		go func() {
+			w.queueTrap(testTrap(g.Version2c, 0, sysNameVar("4")))
+			w.queueTrap(testTrap(g.Version2c, 0, sysNameVar("5")))
+			close(queued)
+		}()
+		if test.overflow != overflowBlock {
+			<-queued
+		} else {
+			select {
+			case <-queued:
+				t.Errorf("queueing should block when the queue is full")
+			case <-time.After(50 * time.Millisecond):
+			}
+		}
+		close(sender.release)
+		<-queued
+		w.close()
+
+		if len(sender.sent) != len(test.sent) {
+			t.Errorf("overflow %d: sent %v, expected %v", test.overflow, sender.sent, test.sent)
+		} else {
+			for i := range test.sent {
+				if sender.sent[i] != test.sent[i] {
+					t.Errorf("overflow %d: sent %v, expected %v", test.overflow, sender.sent, test.sent)
+					break
+				}
+			}
+		}
+		if n := testutil.ToFloat64(actionDropped.WithLabelValues(name)) - before; n != test.dropped {
+			t.Errorf("overflow %d: dropped counter should be %v: %v", test.overflow, test.dropped, n)
+		}
+	}
+}
@@ -0,0 +1,388 @@
+// Copyright (c) 2021 Damien Stuart. All rights reserved.
+//
+// Use of this source code is governed by the MIT License that can be found
+// in the LICENSE file.
+//
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// Admin API connection timeouts, so a stalled client can't hold a
+// connection open. A reload can take a while, so the write timeout is
+// generous.
+//
+const (
+	adminReadHeaderTimeout = 5 * time.Second
+	adminReadTimeout       = 10 * time.Second
+	adminWriteTimeout      = time.Minute
+	adminIdleTimeout       = 2 * time.Minute
+)
+
+// filterInfo is the admin API view of a filter. Filters in the line form
+// have the filter line, and those in the structured form have the action
+// (and name, if set). Filters added as rules have the rule ID and expiry.
+//
+type filterInfo struct {
+	Chain   string     `json:"chain,omitempty"`
+	Index   int        `json:"index"`
+	Name    string     `json:"name,omitempty"`
+	Filter  string     `json:"filter,omitempty"`
+	Action  string     `json:"action"`
+	Hits    uint64     `json:"hits"`
+	Rule    int        `json:"rule,omitempty"`
+	Expires *time.Time `json:"expires,omitempty"`
+}
+
+// ruleRequest adds or moves a rule. A new rule goes at the top of the
+// filters list unless a position is given, and it can expire at a set time
+// or after a duration (such as "2h").
+//
+type ruleRequest struct {
+	Filter    string     `json:"filter"`
+	Position  *int       `json:"position"`
+	Expires   *time.Time `json:"expires"`
+	ExpiresIn string     `json:"expires_in"`
+	Comment   string     `json:"comment"`
+}
+
+// validateAdmin checks the admin section. Anyone who can reach the TCP
+// listener could change trapex, so it needs a token.
+//
+func validateAdmin(newConfig *trapexConfig) error {
+	if newConfig.Admin.ListenAddr == "" {
+		return nil
+	}
+	if _, _, err := net.SplitHostPort(newConfig.Admin.ListenAddr); err != nil {
+		return fmt.Errorf("invalid admin:listen_address (expected address:port): %s", newConfig.Admin.ListenAddr)
+	}
+	if newConfig.Admin.Token == "" {
+		return fmt.Errorf("admin:token is required with admin:listen_address")
+	}
+	return nil
+}
+
+// startAdmin starts the admin API listeners set in the admin section (a
+// change to these takes a restart). The unix socket is only accessible by
+// the trapex user.
+//
+func startAdmin(teConf *trapexConfig) error {
+	if teConf.Admin.ListenAddr != "" {
+		ln, err := net.Listen("tcp", teConf.Admin.ListenAddr)
+		if err != nil {
+			return err
+		}
+		go serveAdmin(ln, newAdminHandler(true))
+		logger.Info().Str("listen_address", teConf.Admin.ListenAddr).Msg("Admin API listening")
+	}
+	if teConf.Admin.Socket != "" {
+		// Clear out the socket from a previous run.
+		if fi, err := os.Lstat(teConf.Admin.Socket); err == nil && fi.Mode()&os.ModeSocket != 0 {
+			os.Remove(teConf.Admin.Socket)
+		}
+		ln, err := net.Listen("unix", teConf.Admin.Socket)
+		if err != nil {
+			return err
+		}
+		if err = os.Chmod(teConf.Admin.Socket, 0600); err != nil {
+			ln.Close()
+			return err
+		}
+		go serveAdmin(ln, newAdminHandler(false))
+		logger.Info().Str("socket", teConf.Admin.Socket).Msg("Admin API listening")
+	}
+	return nil
+}
+
+// serveAdmin serves the admin API on a listener until it is closed.
+//
+func serveAdmin(ln net.Listener, handler http.Handler) error {
+	server := &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: adminReadHeaderTimeout,
+		ReadTimeout:       adminReadTimeout,
+		WriteTimeout:      adminWriteTimeout,
+		IdleTimeout:       adminIdleTimeout,
+	}
+	return server.Serve(ln)
+}
+
+// newAdminHandler sets up the admin API endpoints. Requests need the
+// admin:token as a bearer token when one is set, and always over TCP
+// (requireToken).
+//
+//	GET       /api/stats      the trapex stats and trap rates
+//	GET       /api/filters    the filters and chains, with hit counts
+//	POST      /api/reload     reload the configuration
+//	POST      /api/rotate     rotate the CSV log files
+//	GET, PUT  /api/log_level  get or set ({"level": "debug"}) the log level
+//	GET       /api/rules      the rules added to the filters
+//	POST      /api/rules      add a rule (ruleRequest)
+//	PUT       /api/rules/<id> move a rule ({"position": 2})
+//	DELETE    /api/rules/<id> remove a rule
+func newAdminHandler(requireToken bool) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/stats", adminMethod("GET", func(w http.ResponseWriter, r *http.Request) {
+		writeAdminJSON(w, http.StatusOK, makeStatsReport())
+	}))
+	mux.HandleFunc("/api/filters", adminMethod("GET", func(w http.ResponseWriter, r *http.Request) {
+		writeAdminJSON(w, http.StatusOK, listFilters(currentConfig()))
+	}))
+	mux.HandleFunc("/api/reload", adminMethod("POST", func(w http.ResponseWriter, r *http.Request) {
+		logger.Info().Msg("Reloading configuration from the admin API")
+		if err := getConfig(); err != nil {
+			logger.Info().Err(err).Msg("Error parsing configuration\nConfiguration was not changed")
+			writeAdminError(w, http.StatusUnprocessableEntity, err)
+			return
+		}
+		writeAdminJSON(w, http.StatusOK, map[string]string{"status": "reloaded"})
+	}))
+	mux.HandleFunc("/api/rotate", adminMethod("POST", func(w http.ResponseWriter, r *http.Request) {
+		writeAdminJSON(w, http.StatusOK, map[string][]string{"rotated": rotateCsvLogs()})
+	}))
+	mux.HandleFunc("/api/log_level", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+		case "PUT", "POST":
+			var req struct {
+				Level string `json:"level"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				writeAdminError(w, http.StatusBadRequest, err)
+				return
+			}
+			if err := setLogLevel(req.Level); err != nil {
+				writeAdminError(w, http.StatusBadRequest, err)
+				return
+			}
+		default:
+			writeAdminError(w, http.StatusMethodNotAllowed, fmt.Errorf("method not allowed"))
+			return
+		}
+		writeAdminJSON(w, http.StatusOK, map[string]string{"level": zerolog.GlobalLevel().String()})
+	})
+	mux.HandleFunc("/api/rules", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+			rules := currentConfig().rules
+			if rules == nil {
+				rules = []*overlayRule{}
+			}
+			writeAdminJSON(w, http.StatusOK, rules)
+		case "POST":
+			addRule(w, r)
+		default:
+			writeAdminError(w, http.StatusMethodNotAllowed, fmt.Errorf("method not allowed"))
+		}
+	})
+	mux.HandleFunc("/api/rules/", func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/api/rules/"))
+		if err != nil {
+			writeAdminError(w, http.StatusNotFound, errRuleNotFound)
+			return
+		}
+		switch r.Method {
+		case "PUT", "POST":
+			moveRule(w, r, id)
+		case "DELETE":
+			deleteRule(w, id)
+		default:
+			writeAdminError(w, http.StatusMethodNotAllowed, fmt.Errorf("method not allowed"))
+		}
+	})
+	return adminAuth(mux, requireToken)
+}
+
+// adminAuth checks the bearer token for each request.
+//
+func adminAuth(next http.Handler, requireToken bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := currentConfig().Admin.Token
+		if token != "" || requireToken {
+			auth := r.Header.Get("Authorization")
+			if token == "" || subtle.ConstantTimeCompare([]byte(auth), []byte("Bearer "+token)) != 1 {
+				logger.Warn().Str("remote", r.RemoteAddr).Str("path", r.URL.Path).Msg("Unauthorized admin API request")
+				writeAdminError(w, http.StatusUnauthorized, fmt.Errorf("unauthorized"))
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// adminMethod only lets requests with the given method through to the
+// handler.
+//
+func adminMethod(method string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != method {
+			writeAdminError(w, http.StatusMethodNotAllowed, fmt.Errorf("method not allowed"))
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// addRule adds a rule from a ruleRequest.
+//
+func addRule(w http.ResponseWriter, r *http.Request) {
+	var req ruleRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeAdminError(w, http.StatusBadRequest, err)
+		return
+	}
+	now := time.Now()
+	rule := &overlayRule{
+		Filter:  strings.Join(strings.Fields(req.Filter), " "),
+		Expires: req.Expires,
+		Created: now.UTC().Truncate(time.Second),
+		Comment: req.Comment,
+	}
+	if rule.Filter == "" {
+		writeAdminError(w, http.StatusBadRequest, fmt.Errorf("missing filter"))
+		return
+	}
+	if req.Position != nil {
+		rule.Position = *req.Position
+	}
+	if req.ExpiresIn != "" {
+		d, err := time.ParseDuration(req.ExpiresIn)
+		if err != nil || d <= 0 {
+			writeAdminError(w, http.StatusBadRequest, fmt.Errorf("invalid expires_in: '%s'", req.ExpiresIn))
+			return
+		}
+		expires := now.Add(d).UTC().Truncate(time.Second)
+		rule.Expires = &expires
+	}
+	if rule.expired(now) {
+		writeAdminError(w, http.StatusBadRequest, fmt.Errorf("rule has already expired"))
+		return
+	}
+	err := updateRules(func(rules []*overlayRule, size int) ([]*overlayRule, error) {
+		rule.ID = nextRuleID(rules)
+		return insertRule(rules, rule, size), nil
+	})
+	if err != nil {
+		writeAdminError(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+	logger.Info().Int("rule", rule.ID).Int("position", rule.Position).Str("filter", rule.Filter).Msg("Added rule from the admin API")
+	writeAdminJSON(w, http.StatusCreated, rule)
+}
+
+// moveRule moves a rule to the position in the ruleRequest.
+//
+func moveRule(w http.ResponseWriter, r *http.Request, id int) {
+	var req ruleRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeAdminError(w, http.StatusBadRequest, err)
+		return
+	}
+	if req.Position == nil {
+		writeAdminError(w, http.StatusBadRequest, fmt.Errorf("missing position"))
+		return
+	}
+	var moved *overlayRule
+	err := updateRules(func(rules []*overlayRule, size int) ([]*overlayRule, error) {
+		if rules, moved = removeRule(rules, id); moved == nil {
+			return nil, errRuleNotFound
+		}
+		moved.Position = *req.Position
+		return insertRule(rules, moved, size-1), nil
+	})
+	if err != nil {
+		writeRuleError(w, err)
+		return
+	}
+	logger.Info().Int("rule", id).Int("position", moved.Position).Msg("Moved rule from the admin API")
+	writeAdminJSON(w, http.StatusOK, moved)
+}
+
+// deleteRule removes a rule.
+//
+func deleteRule(w http.ResponseWriter, id int) {
+	var removed *overlayRule
+	err := updateRules(func(rules []*overlayRule, size int) ([]*overlayRule, error) {
+		if rules, removed = removeRule(rules, id); removed == nil {
+			return nil, errRuleNotFound
+		}
+		return rules, nil
+	})
+	if err != nil {
+		writeRuleError(w, err)
+		return
+	}
+	logger.Info().Int("rule", id).Str("filter", removed.Filter).Msg("Removed rule from the admin API")
+	writeAdminJSON(w, http.StatusOK, removed)
+}
+
+func writeRuleError(w http.ResponseWriter, err error) {
+	if err == errRuleNotFound {
+		writeAdminError(w, http.StatusNotFound, err)
+	} else {
+		writeAdminError(w, http.StatusUnprocessableEntity, err)
+	}
+}
+
+func writeAdminJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeAdminError(w http.ResponseWriter, status int, err error) {
+	writeAdminJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+// listFilters returns the filters of the main filters list, followed by
+// those of each chain.
+//
+func listFilters(c *trapexConfig) []filterInfo {
+	list := []filterInfo{}
+	add := func(chain string, filters []trapexFilter) {
+		for i, f := range filters {
+			info := filterInfo{
+				Chain:  chain,
+				Index:  i,
+				Name:   f.name,
+				Filter: f.line,
+				Action: f.actionText,
+				Hits:   atomic.LoadUint64(f.hits),
+			}
+			if f.rule != nil {
+				info.Rule = f.rule.ID
+				info.Expires = f.rule.Expires
+			}
+			list = append(list, info)
+		}
+	}
+	add("", c.filters)
+	for _, name := range c.chainNames() {
+		add(name, c.chains[name].filters)
+	}
+	return list
+}
+
+// setLogLevel changes the trapex log level (until the next restart).
+//
+func setLogLevel(level string) error {
+	l, err := zerolog.ParseLevel(strings.ToLower(level))
+	if err != nil || level == "" {
+		return fmt.Errorf("invalid log level: '%s'", level)
+	}
+	zerolog.SetGlobalLevel(l)
+	logger.Info().Str("level", l.String()).Msg("Log level changed")
+	return nil
+}
@@ -0,0 +1,213 @@
+// Copyright (c) 2021 Damien Stuart. All rights reserved.
+//
+// Use of this source code is governed by the MIT License that can be found
+// in the LICENSE file.
+//
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	g "github.com/gosnmp/gosnmp"
+	"github.com/rs/zerolog"
+)
+
+// adminRequest makes an admin API request with the given token, and decodes
+// the JSON response into v.
+//
+func adminRequest(t *testing.T, client *http.Client, method string, url string, token string, body string, v interface{}) int {
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	defer resp.Body.Close()
+	if v != nil {
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			t.Fatalf("invalid JSON response from %s %s: %s", method, url, err)
+		}
+	}
+	return resp.StatusCode
+}
+
+func loadAdminTestConfig(t *testing.T) *trapexConfig {
+	var testConfig trapexConfig
+	if err := loadConfig("tests/config/admin.yml", &testConfig); err != nil {
+		t.Fatalf("%s", err)
+	}
+	if err := validateAdmin(&testConfig); err != nil {
+		t.Fatalf("%s", err)
+	}
+	if err := validateActionQueue(&testConfig); err != nil {
+		t.Fatalf("%s", err)
+	}
+	if err := processFilters(&testConfig); err != nil {
+		t.Fatalf("%s", err)
+	}
+	return &testConfig
+}
+
+func TestValidateAdmin(t *testing.T) {
+	var testConfig trapexConfig
+	if err := validateAdmin(&testConfig); err != nil {
+		t.Errorf("admin API should be optional: %s", err)
+	}
+	testConfig.Admin.ListenAddr = "127.0.0.1:9162"
+	if err := validateAdmin(&testConfig); err == nil {
+		t.Errorf("Should have required a token for the TCP listener")
+	}
+	testConfig.Admin.Token = "s3cret"
+	if err := validateAdmin(&testConfig); err != nil {
+		t.Errorf("%s", err)
+	}
+	testConfig.Admin.ListenAddr = "127.0.0.1"
+	if err := validateAdmin(&testConfig); err == nil {
+		t.Errorf("Should have detected a listen_address without a port")
+	}
+}
+
+func TestAdminAPI(t *testing.T) {
+	teConfig = loadAdminTestConfig(t)
+	defer closeTrapexHandles()
+	s := httptest.NewServer(newAdminHandler(true))
+	defer s.Close()
+	client := s.Client()
+
+	var errResp map[string]string
+	if status := adminRequest(t, client, "GET", s.URL+"/api/stats", "", "", &errResp); status != http.StatusUnauthorized {
+		t.Errorf("request without a token got %d", status)
+	}
+	if status := adminRequest(t, client, "GET", s.URL+"/api/stats", "wrong", "", &errResp); status != http.StatusUnauthorized {
+		t.Errorf("request with the wrong token got %d", status)
+	}
+	if status := adminRequest(t, client, "POST", s.URL+"/api/stats", "s3cret", "", &errResp); status != http.StatusMethodNotAllowed {
+		t.Errorf("POST to stats got %d", status)
+	}
+
+	var report map[string]interface{}
+	if status := adminRequest(t, client, "GET", s.URL+"/api/stats", "s3cret", "", &report); status != http.StatusOK {
+		t.Fatalf("stats request got %d", status)
+	}
+	for _, field := range []string{"uptime", "traps_received", "traps_dropped", "traps_translated_from_v3", "trap_rate_1min", "trap_rate_all"} {
+		if _, ok := report[field]; !ok {
+			t.Errorf("stats are missing %s: %v", field, report)
+		}
+	}
+
+	sgt := sgTrap{
+		trapVer: g.Version1,
+		srcIP:   net.ParseIP("192.168.1.1"),
+		data:    g.SnmpTrap{AgentAddress: "10.0.0.1", Enterprise: ".1.3.6.1.4.1.9"},
+	}
+	processTrap(&sgt)
+	var filters []filterInfo
+	if status := adminRequest(t, client, "GET", s.URL+"/api/filters", "s3cret", "", &filters); status != http.StatusOK {
+		t.Fatalf("filters request got %d", status)
+	}
+	expected := []filterInfo{
+		{Index: 0, Filter: "* * 10.0.0.1 * * * jump lab", Action: "jump lab", Hits: 1},
+		{Index: 1, Filter: "* * * * * * csv tests/tmp/admin.csv", Action: "csv tests/tmp/admin.csv", Hits: 1},
+		{Chain: "lab", Index: 0, Name: "lab-agents", Action: "nat 10.0.0.2", Hits: 1},
+	}
+	if len(filters) != len(expected) {
+		t.Fatalf("expected %d filters: %+v", len(expected), filters)
+	}
+	for i := range expected {
+		if filters[i] != expected[i] {
+			t.Errorf("filter %d is not correct: %+v", i, filters[i])
+		}
+	}
+
+	var rotated map[string][]string
+	if status := adminRequest(t, client, "POST", s.URL+"/api/rotate", "s3cret", "", &rotated); status != http.StatusOK {
+		t.Errorf("rotate request got %d", status)
+	}
+	if files := rotated["rotated"]; len(files) != 1 || files[0] != "tests/tmp/admin.csv" {
+		t.Errorf("CSV log not rotated: %v", rotated)
+	}
+
+	defer zerolog.SetGlobalLevel(zerolog.GlobalLevel())
+	var level map[string]string
+	if status := adminRequest(t, client, "PUT", s.URL+"/api/log_level", "s3cret", `{"level": "warn"}`, &level); status != http.StatusOK || level["level"] != "warn" {
+		t.Errorf("log level not changed: %d %v", status, level)
+	}
+	if zerolog.GlobalLevel() != zerolog.WarnLevel {
+		t.Errorf("log level not set: %s", zerolog.GlobalLevel())
+	}
+	if status := adminRequest(t, client, "PUT", s.URL+"/api/log_level", "s3cret", `{"level": "loud"}`, &errResp); status != http.StatusBadRequest {
+		t.Errorf("invalid log level got %d", status)
+	}
+}
+
+func TestAdminReload(t *testing.T) {
+	teConfig = loadAdminTestConfig(t)
+	s := httptest.NewServer(newAdminHandler(true))
+	defer s.Close()
+
+	teCmdLine.configFile = "tests/config/ipsets_bad_ips.yml"
+	old := teConfig
+	var resp map[string]string
+	if status := adminRequest(t, s.Client(), "POST", s.URL+"/api/reload", "s3cret", "", &resp); status != http.StatusUnprocessableEntity || resp["error"] == "" {
+		t.Errorf("bad configuration reload got %d: %v", status, resp)
+	}
+	if currentConfig() != old {
+		t.Errorf("configuration changed by a failed reload")
+	}
+
+	teCmdLine.configFile = "tests/config/admin.yml"
+	if status := adminRequest(t, s.Client(), "POST", s.URL+"/api/reload", "s3cret", "", &resp); status != http.StatusOK {
+		t.Errorf("reload got %d: %v", status, resp)
+	}
+	if currentConfig() == old {
+		t.Errorf("configuration not reloaded")
+	}
+	closeTrapexHandles()
+	closeActions(old, nil)
+}
+
+func TestAdminSocket(t *testing.T) {
+	var testConfig trapexConfig
+	testConfig.Admin.Socket = "tests/tmp/admin.sock"
+	teConfig = &testConfig
+	if err := startAdmin(&testConfig); err != nil {
+		t.Fatalf("%s", err)
+	}
+	defer os.Remove(testConfig.Admin.Socket)
+	fi, err := os.Stat(testConfig.Admin.Socket)
+	if err != nil || fi.Mode().Perm() != 0600 {
+		t.Errorf("admin socket not created with mode 0600: %v", err)
+	}
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return net.Dial("unix", testConfig.Admin.Socket)
+		},
+	}}
+	var level map[string]string
+	if status := adminRequest(t, client, "GET", "http://trapex/api/log_level", "", "", &level); status != http.StatusOK || level["level"] == "" {
+		t.Errorf("log level request over the socket got %d: %v", status, level)
+	}
+	resp, err := client.Get("http://trapex/api/nothing")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("unknown endpoint got %d", resp.StatusCode)
+	}
+}
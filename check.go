@@ -0,0 +1,143 @@
+// Copyright (c) 2021 Damien Stuart. All rights reserved.
+//
+// Use of this source code is governed by the MIT License that can be found
+// in the LICENSE file.
+//
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+
+	"github.com/rs/zerolog"
+)
+
+// checkConfigFile checks a configuration file (for the -t option), prints a
+// report of the problems found, and returns the exit code for trapex.
+//
+func checkConfigFile(configFile string) int {
+	// Only warnings from the checks belong in the report.
+	zerolog.SetGlobalLevel(zerolog.WarnLevel)
+	fmt.Printf("Checking trapex configuration file %s\n", configFile)
+	problems := checkConfig(configFile)
+	if len(problems) == 0 {
+		fmt.Printf("Configuration is OK\n")
+		return 0
+	}
+	for i, err := range problems {
+		fmt.Printf("  %d. %s\n", i+1, err)
+	}
+	fmt.Printf("Found %d problem(s) in the configuration\n", len(problems))
+	return 1
+}
+
+// checkConfig loads and checks a configuration file the way getConfig does,
+// except that the filter actions are only checked: no files are opened or
+// created, and no sockets are opened. Every problem found is returned,
+// rather than just the first.
+//
+func checkConfig(configFile string) []error {
+	var newConfig trapexConfig
+	newConfig.checkOnly = true
+	if err := loadConfig(configFile, &newConfig); err != nil {
+		return []error{err}
+	}
+	applyCliOverrides(&newConfig)
+
+	for _, step := range configSteps {
+		if err := step(&newConfig); err != nil {
+			newConfig.problems = append(newConfig.problems, err)
+		}
+	}
+	if err := processFilters(&newConfig); err != nil {
+		newConfig.problems = append(newConfig.problems, err)
+	}
+	return newConfig.problems
+}
+
+// checkAction checks the argument and options of a filter action the way
+// processFilterAction would set up the action. Forward destinations must
+// resolve, and the directories for log files, forward queues, and spools
+// must be writable.
+//
+func checkAction(action string, arg string, opts []string, c *trapexConfig) error {
+	switch action {
+	case "forward":
+		forwarder := trapForwarder{}
+		queueParams, err := forwarder.setup(arg, opts, c)
+		if err != nil {
+			return err
+		}
+		if _, err = net.LookupHost(forwarder.destination.Target); err != nil {
+			return fmt.Errorf("unable to resolve forward destination %s: %s", arg, err)
+		}
+		if queueParams != nil {
+			return checkWritableDir(queueParams.Dir)
+		}
+	case "log", "csv", "json":
+		return checkLogFile(arg)
+	case "syslog":
+		_, err := syslogDestination(arg, c)
+		return err
+	case "webhook":
+		_, err := webhookDestination(arg, c)
+		return err
+	case "clickhouse":
+		params, ok := c.clickhouseDestinations[arg]
+		if !ok {
+			return fmt.Errorf("unknown clickhouse destination: %s", arg)
+		}
+		return checkWritableDir(params.SpoolDir)
+	}
+	return nil
+}
+
+// checkLogFile makes sure a log file can be opened for append: either it is
+// a writable file, or it can be created in its directory.
+//
+func checkLogFile(logfile string) error {
+	if logfile == "" {
+		return fmt.Errorf("missing log file name")
+	}
+	if fi, err := os.Stat(logfile); err == nil {
+		if !fi.Mode().IsRegular() {
+			return fmt.Errorf("log file is not a regular file: %s", logfile)
+		}
+		if !isWritable(logfile) {
+			return fmt.Errorf("log file is not writable: %s", logfile)
+		}
+		return nil
+	}
+	dir := filepath.Dir(logfile)
+	fi, err := os.Stat(dir)
+	if err != nil || !fi.IsDir() {
+		return fmt.Errorf("log directory does not exist: %s", dir)
+	}
+	if !isWritable(dir) {
+		return fmt.Errorf("log directory is not writable: %s", dir)
+	}
+	return nil
+}
+
+// checkWritableDir makes sure a directory is writable, or can be created
+// (the closest existing parent directory is writable).
+//
+func checkWritableDir(dir string) error {
+	for d := filepath.Clean(dir); ; d = filepath.Dir(d) {
+		fi, err := os.Stat(d)
+		if err == nil {
+			if !fi.IsDir() {
+				return fmt.Errorf("not a directory: %s", d)
+			}
+			if !isWritable(d) {
+				return fmt.Errorf("directory is not writable: %s", d)
+			}
+			return nil
+		}
+		if parent := filepath.Dir(d); parent == d {
+			return fmt.Errorf("unable to create directory: %s", dir)
+		}
+	}
+}
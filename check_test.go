@@ -0,0 +1,59 @@
+// Copyright (c) 2021 Damien Stuart. All rights reserved.
+//
+// Use of this source code is governed by the MIT License that can be found
+// in the LICENSE file.
+//
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestCheckConfig(t *testing.T) {
+	files := []string{"tests/tmp/check_queue", "tests/tmp/check.csv", "tests/tmp/check.json", "tests/tmp/check.log"}
+	for _, f := range files {
+		os.RemoveAll(f)
+	}
+
+	if problems := checkConfig("tests/config/check_good.yml"); len(problems) != 0 {
+		t.Errorf("good configuration has problems: %v", problems)
+	}
+
+	problems := checkConfig("tests/config/check_bad.yml")
+	expected := []string{
+		"inform_response",
+		"log directory does not exist: tests/tmp/no_such_dir",
+		"invalid destination port: abc",
+		"unknown webhook destination: unknown_hook",
+		"unknown action: bogus",
+	}
+	if len(problems) != len(expected) {
+		t.Fatalf("expected %d problems, got %d: %v", len(expected), len(problems), problems)
+	}
+	for i, err := range problems {
+		if !strings.Contains(err.Error(), expected[i]) {
+			t.Errorf("problem %d should mention %q: %s", i+1, expected[i], err)
+		}
+	}
+
+	// Nothing is created by a check.
+	for _, f := range files {
+		if _, err := os.Stat(f); err == nil {
+			t.Errorf("configuration check created %s", f)
+		}
+	}
+}
+
+func TestCheckWritableDir(t *testing.T) {
+	if err := checkWritableDir("tests/tmp/check_queue/a/b"); err != nil {
+		t.Errorf("%s", err)
+	}
+	if err := checkWritableDir("tests/config/general.yml/queue"); err == nil {
+		t.Errorf("Should have detected a file in the directory path")
+	}
+	if err := checkLogFile("tests/config"); err == nil {
+		t.Errorf("Should have detected a directory as a log file")
+	}
+}
@@ -0,0 +1,385 @@
+// Copyright (c) 2021 Damien Stuart. All rights reserved.
+//
+// Use of this source code is governed by the MIT License that can be found
+// in the LICENSE file.
+//
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/creasty/defaults"
+)
+
+// clickhouseParams are the settings for a named ClickHouse destination
+// (clickhouse_destinations) used by the clickhouse action.
+//
+type clickhouseParams struct {
+	URL      string        `default:"http://localhost:8123/" yaml:"url"`
+	Database string        `default:"default" yaml:"database"`
+	Table    string        `default:"snmp_traps" yaml:"table"`
+	Username string        `yaml:"username"`
+	Password string        `yaml:"password"`
+	Timeout  time.Duration `default:"30s" yaml:"timeout"`
+
+	// Rows are inserted in batches of up to batch_size, waiting at most
+	// batch_timeout for a batch to fill.
+	BatchSize    int           `default:"1000" yaml:"batch_size"`
+	BatchTimeout time.Duration `default:"10s" yaml:"batch_timeout"`
+	QueueSize    int           `default:"10000" yaml:"queue_size"`
+
+	// Batches that can't be inserted are written to the spool directory,
+	// and replayed every retry_interval once the server is back.
+	SpoolDir      string        `yaml:"spool_dir"`
+	SpoolMaxSize  int           `default:"1024" yaml:"spool_max_size"`
+	RetryInterval time.Duration `default:"30s" yaml:"retry_interval"`
+}
+
+// trapClickhouse is an instance of a ClickHouse destination. Rows are queued
+// by processTrap and inserted by a worker goroutine.
+//
+type trapClickhouse struct {
+	name     string
+	params   *clickhouseParams
+	client   *http.Client
+	query    string
+	mu       sync.RWMutex
+	closed   bool
+	queue    chan string
+	done     chan struct{}
+	spoolSeq int
+	spoolMu  *sync.Mutex
+}
+
+// The part of a spool file name after the destination name and a dash (see
+// writeSpool)
+//
+var spoolFileSuffix = regexp.MustCompile(`^[0-9]{20}-[0-9]{6}\.csv$`)
+
+// Spool locks by spool file prefix, so an instance from a reloaded config
+// doesn't replay the same files as the one it replaces.
+//
+var (
+	clickhouseSpoolMu    sync.Mutex
+	clickhouseSpoolLocks = make(map[string]*sync.Mutex)
+)
+
+// processClickhouseDestinations validates each of the named ClickHouse
+// destinations.
+//
+func processClickhouseDestinations(newConfig *trapexConfig) error {
+	for _, stanza := range newConfig.ClickhouseDestinations {
+		for destName, params := range stanza {
+			if _, ok := newConfig.clickhouseDestinations[destName]; ok {
+				return fmt.Errorf("duplicate clickhouse_destinations entry: %s", destName)
+			}
+			dest := params
+			if err := defaults.Set(&dest); err != nil {
+				return err
+			}
+			if err := validateClickhouseParams(&dest); err != nil {
+				return fmt.Errorf("clickhouse_destinations:%s: %s", destName, err)
+			}
+			logger.Info().Str("clickhouse_destination", destName).Str("url", dest.URL).Str("table", dest.Database+"."+dest.Table).Msg("Loading ClickHouse destination")
+			newConfig.clickhouseDestinations[destName] = &dest
+		}
+	}
+	return nil
+}
+
+func validateClickhouseParams(p *clickhouseParams) error {
+	u, err := url.Parse(p.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid url: '%s'", p.URL)
+	}
+	for _, name := range []string{p.Database, p.Table} {
+		if name == "" || strings.Trim(name, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789_") != "" {
+			return fmt.Errorf("invalid database or table name: '%s'", name)
+		}
+	}
+	if p.Timeout <= 0 || p.BatchTimeout <= 0 || p.RetryInterval <= 0 {
+		return fmt.Errorf("invalid timeout, batch_timeout, or retry_interval")
+	}
+	if p.BatchSize <= 0 || p.QueueSize <= 0 || p.SpoolMaxSize <= 0 {
+		return fmt.Errorf("invalid batch_size, queue_size, or spool_max_size")
+	}
+	if p.SpoolDir == "" {
+		return fmt.Errorf("missing spool_dir")
+	}
+	return nil
+}
+
+// Initialize a trapClickhouse instance for a named ClickHouse destination,
+// create its spool directory, and start its worker.
+//
+func (a *trapClickhouse) initAction(name string, teConf *trapexConfig) error {
+	params, ok := teConf.clickhouseDestinations[name]
+	if !ok {
+		return fmt.Errorf("unknown clickhouse destination: %s", name)
+	}
+	if err := os.MkdirAll(filepath.Join(params.SpoolDir, "error"), 0755); err != nil {
+		return err
+	}
+	a.name = name
+	a.params = params
+	a.client = &http.Client{Timeout: params.Timeout}
+	prefix, _ := filepath.Abs(filepath.Join(params.SpoolDir, name))
+	clickhouseSpoolMu.Lock()
+	if clickhouseSpoolLocks[prefix] == nil {
+		clickhouseSpoolLocks[prefix] = &sync.Mutex{}
+	}
+	a.spoolMu = clickhouseSpoolLocks[prefix]
+	clickhouseSpoolMu.Unlock()
+	a.query = fmt.Sprintf("INSERT INTO %s.%s FORMAT CSV", params.Database, params.Table)
+	a.queue = make(chan string, params.QueueSize)
+	a.done = make(chan struct{})
+	go a.run()
+	logger.Info().Str("clickhouse_destination", name).Str("url", params.URL).Str("spool_dir", params.SpoolDir).Msg("Added ClickHouse destination")
+	return nil
+}
+
+// Hook for queueing a trap for this ClickHouse destination (as a row in
+// the same CSV format as the csv action). The trap is dropped if the queue
+// is full.
+//
+func (a *trapClickhouse) processTrap(trap *sgTrap) {
+	row := makeTrapLogCsvEntry(trap)
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	if a.closed {
+		return
+	}
+	select {
+	case a.queue <- row:
+	default:
+		clickhouseDropped.WithLabelValues(a.name).Inc()
+		logger.Warn().Str("clickhouse_destination", a.name).Msg("ClickHouse queue is full, dropping trap")
+	}
+}
+
+// Close the ClickHouse destination. Queued rows are inserted (or spooled)
+// first.
+//
+func (a *trapClickhouse) close() {
+	a.mu.Lock()
+	if a.closed {
+		a.mu.Unlock()
+		return
+	}
+	a.closed = true
+	close(a.queue)
+	a.mu.Unlock()
+	<-a.done
+}
+
+// run collects queued rows into batches and inserts them, and replays the
+// spooled batches.
+//
+func (a *trapClickhouse) run() {
+	defer close(a.done)
+	var batch []string
+	timer := time.NewTimer(a.params.BatchTimeout)
+	timer.Stop()
+	replay := time.NewTicker(a.params.RetryInterval)
+	defer replay.Stop()
+	// Pick up anything spooled before a restart.
+	a.replaySpool()
+	for {
+		select {
+		case row, ok := <-a.queue:
+			if !ok {
+				if len(batch) > 0 {
+					a.flush(batch)
+				}
+				return
+			}
+			batch = append(batch, row)
+			if len(batch) >= a.params.BatchSize {
+				if !timer.Stop() {
+					select {
+					case <-timer.C:
+					default:
+					}
+				}
+				a.flush(batch)
+				batch = nil
+			} else if len(batch) == 1 {
+				timer.Reset(a.params.BatchTimeout)
+			}
+		case <-timer.C:
+			if len(batch) > 0 {
+				a.flush(batch)
+				batch = nil
+			}
+		case <-replay.C:
+			a.replaySpool()
+		}
+	}
+}
+
+// flush inserts a batch of rows. While there are spooled batches, new
+// batches are spooled behind them to keep the rows in order.
+//
+func (a *trapClickhouse) flush(batch []string) {
+	a.spoolMu.Lock()
+	defer a.spoolMu.Unlock()
+	data := []byte(strings.Join(batch, "\n") + "\n")
+	if len(a.spoolFiles()) == 0 {
+		retry, err := a.insert(data)
+		if err == nil {
+			clickhouseInserted.WithLabelValues(a.name).Add(float64(len(batch)))
+			return
+		}
+		logger.Warn().Err(err).Str("clickhouse_destination", a.name).Int("rows", len(batch)).Msg("Error inserting rows into ClickHouse")
+		if !retry {
+			a.writeSpool(filepath.Join(a.params.SpoolDir, "error"), data)
+			clickhouseFailed.WithLabelValues(a.name).Add(float64(len(batch)))
+			return
+		}
+	}
+	if a.writeSpool(a.params.SpoolDir, data) {
+		clickhouseSpooled.WithLabelValues(a.name).Add(float64(len(batch)))
+	} else {
+		clickhouseFailed.WithLabelValues(a.name).Add(float64(len(batch)))
+	}
+}
+
+// insert posts CSV rows to the ClickHouse HTTP interface, and returns
+// whether a failure is worth retrying (the server is down or overloaded,
+// rather than rejecting the data).
+//
+func (a *trapClickhouse) insert(data []byte) (bool, error) {
+	u, _ := url.Parse(a.params.URL)
+	q := u.Query()
+	q.Set("query", a.query)
+	u.RawQuery = q.Encode()
+	req, err := http.NewRequest("POST", u.String(), bytes.NewReader(data))
+	if err != nil {
+		return false, err
+	}
+	if a.params.Username != "" {
+		req.Header.Set("X-ClickHouse-User", a.params.Username)
+		req.Header.Set("X-ClickHouse-Key", a.params.Password)
+	}
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		io.Copy(ioutil.Discard, resp.Body)
+		return false, nil
+	}
+	msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+	retry := resp.StatusCode == http.StatusRequestTimeout || resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+	return retry, fmt.Errorf("clickhouse returned %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+}
+
+// spoolFiles returns the spooled batch files, oldest first.
+//
+func (a *trapClickhouse) spoolFiles() []string {
+	files, _ := filepath.Glob(filepath.Join(a.params.SpoolDir, a.name+"-*.csv"))
+	// The pattern also matches the files of a destination named with this
+	// name and a dash, so the rest of the name has to be the numbers.
+	spooled := files[:0]
+	for _, f := range files {
+		if spoolFileSuffix.MatchString(strings.TrimPrefix(filepath.Base(f), a.name+"-")) {
+			spooled = append(spooled, f)
+		}
+	}
+	sort.Strings(spooled)
+	return spooled
+}
+
+// writeSpool writes a batch to a new file in the given directory. The
+// oldest spooled batches are removed to keep the spool under
+// spool_max_size MB.
+//
+func (a *trapClickhouse) writeSpool(dir string, data []byte) bool {
+	if dir == a.params.SpoolDir {
+		a.trimSpool(int64(len(data)))
+	}
+	// The names sort in the order the files were written.
+	a.spoolSeq++
+	name := filepath.Join(dir, fmt.Sprintf("%s-%020d-%06d.csv", a.name, time.Now().UnixNano(), a.spoolSeq%1000000))
+	if err := ioutil.WriteFile(name+".tmp", data, 0644); err != nil {
+		logger.Warn().Err(err).Str("clickhouse_destination", a.name).Msg("Error writing ClickHouse spool file")
+		return false
+	}
+	if err := os.Rename(name+".tmp", name); err != nil {
+		logger.Warn().Err(err).Str("clickhouse_destination", a.name).Msg("Error writing ClickHouse spool file")
+		return false
+	}
+	return true
+}
+
+func (a *trapClickhouse) trimSpool(adding int64) {
+	files := a.spoolFiles()
+	sizes := make([]int64, len(files))
+	total := adding
+	for i, f := range files {
+		if fi, err := os.Stat(f); err == nil {
+			sizes[i] = fi.Size()
+			total += sizes[i]
+		}
+	}
+	for i := 0; i < len(files) && total > int64(a.params.SpoolMaxSize)*1024*1024; i++ {
+		rows := countRows(files[i])
+		if os.Remove(files[i]) == nil {
+			total -= sizes[i]
+			clickhouseDropped.WithLabelValues(a.name).Add(float64(rows))
+			logger.Warn().Str("clickhouse_destination", a.name).Str("file", files[i]).Msg("ClickHouse spool is full, removed the oldest batch")
+		}
+	}
+}
+
+// replaySpool inserts the spooled batches, oldest first, until one fails.
+//
+func (a *trapClickhouse) replaySpool() {
+	a.spoolMu.Lock()
+	defer a.spoolMu.Unlock()
+	for _, f := range a.spoolFiles() {
+		data, err := ioutil.ReadFile(f)
+		if err != nil {
+			logger.Warn().Err(err).Str("file", f).Msg("Error reading ClickHouse spool file")
+			return
+		}
+		rows := bytes.Count(data, []byte("\n"))
+		retry, err := a.insert(data)
+		if err != nil && retry {
+			logger.Debug().Err(err).Str("clickhouse_destination", a.name).Msg("ClickHouse is still unavailable")
+			return
+		}
+		if err != nil {
+			logger.Warn().Err(err).Str("clickhouse_destination", a.name).Str("file", f).Msg("ClickHouse rejected spooled rows")
+			os.Rename(f, filepath.Join(a.params.SpoolDir, "error", filepath.Base(f)))
+			clickhouseFailed.WithLabelValues(a.name).Add(float64(rows))
+			continue
+		}
+		os.Remove(f)
+		clickhouseInserted.WithLabelValues(a.name).Add(float64(rows))
+		logger.Info().Str("clickhouse_destination", a.name).Str("file", f).Int("rows", rows).Msg("Replayed spooled ClickHouse rows")
+	}
+}
+
+// countRows returns the number of rows in a spool file.
+//
+func countRows(file string) int {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return 0
+	}
+	return bytes.Count(data, []byte("\n"))
+}
@@ -0,0 +1,172 @@
+// Copyright (c) 2021 Damien Stuart. All rights reserved.
+//
+// Use of this source code is governed by the MIT License that can be found
+// in the LICENSE file.
+//
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	g "github.com/gosnmp/gosnmp"
+)
+
+func testClickhouse(t *testing.T, url string, spoolDir string, batchSize int) *trapClickhouse {
+	var testConfig trapexConfig
+	testConfig.General.Hostname = "trapex_test"
+	useTestConfig(t, &testConfig)
+	p := clickhouseParams{
+		URL: url, Database: "snmp", Table: "snmp_traps", Username: "trapex", Password: "secret", Timeout: time.Second,
+		BatchSize: batchSize, BatchTimeout: 50 * time.Millisecond, QueueSize: 100,
+		SpoolDir: spoolDir, SpoolMaxSize: 1, RetryInterval: time.Hour,
+	}
+	testConfig.clickhouseDestinations = map[string]*clickhouseParams{"traps": &p}
+	a := trapClickhouse{}
+	if err := a.initAction("traps", &testConfig); err != nil {
+		t.Fatalf("%s", err)
+	}
+	return &a
+}
+
+// clickhouseRows returns the rows of the inserts the server accepted.
+//
+func clickhouseRows(s *captureServer) []string {
+	var rows []string
+	for _, r := range s.accepted() {
+		rows = append(rows, strings.Split(strings.TrimSuffix(string(r.body), "\n"), "\n")...)
+	}
+	return rows
+}
+
+func TestClickhouseConfig(t *testing.T) {
+	var testConfig trapexConfig
+	testConfig.clickhouseDestinations = make(map[string]*clickhouseParams)
+	if err := loadConfig("tests/config/clickhouse.yml", &testConfig); err != nil {
+		t.Fatalf("%s", err)
+	}
+	if err := processClickhouseDestinations(&testConfig); err == nil {
+		t.Errorf("Should have detected an invalid table name")
+	}
+	testConfig.clickhouseDestinations = make(map[string]*clickhouseParams)
+	testConfig.ClickhouseDestinations = testConfig.ClickhouseDestinations[:1]
+	if err := processClickhouseDestinations(&testConfig); err != nil {
+		t.Fatalf("%s", err)
+	}
+	p := testConfig.clickhouseDestinations["traps"]
+	if p.Database != "snmp" || p.Table != "snmp_traps" || p.BatchSize != 500 || p.BatchTimeout != 10*time.Second || p.RetryInterval != 30*time.Second {
+		t.Errorf("clickhouse destination not set correctly: %+v", p)
+	}
+
+	if err := processFilters(&testConfig); err != nil {
+		t.Fatalf("%s", err)
+	}
+	if testConfig.filters[0].actionType != actionClickhouse {
+		t.Errorf("clickhouse action type not set correctly")
+	}
+	// Filters for the same destination share the instance.
+	f, err := processFilterLine(strings.Fields("* * * 6 * * clickhouse traps break"), &testConfig, 1)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if f.action != testConfig.filters[0].action {
+		t.Errorf("clickhouse destination instance not shared between filters")
+	}
+	testConfig.filters[0].action.(*trapClickhouse).close()
+}
+
+func TestClickhouseInsert(t *testing.T) {
+	s := newCaptureServer(t)
+	spoolDir := "tests/tmp/clickhouse_insert"
+	os.RemoveAll(spoolDir)
+	a := testClickhouse(t, s.URL, spoolDir, 2)
+	for i := 1; i <= 3; i++ {
+		a.processTrap(testTrap(g.Version1, i, sysNameVar("50% full")))
+	}
+	s.waitPosts(t, 2)
+	a.close()
+
+	rows, r := clickhouseRows(s), s.all()[0]
+	if len(rows) != 3 || r.query.Get("query") != "INSERT INTO snmp.snmp_traps FORMAT CSV" || r.header.Get("X-ClickHouse-User") != "trapex" || r.header.Get("X-ClickHouse-Key") != "secret" {
+		t.Fatalf("rows not inserted correctly: %v %v", r, rows)
+	}
+	if f := strings.Split(rows[2], ","); len(f) != 11 || f[2] != `"trapex_test"` || f[7] != "3" || f[10] != `"['50% full']"` {
+		t.Errorf("row does not match the CSV format: %s", rows[2])
+	}
+}
+
+func TestClickhouseSpool(t *testing.T) {
+	s := newCaptureServer(t)
+	spoolDir := "tests/tmp/clickhouse_spool"
+	os.RemoveAll(spoolDir)
+	a := testClickhouse(t, s.URL, spoolDir, 1)
+
+	// While the server is down, batches are spooled. Once there is a
+	// spooled batch, new ones go behind it without trying the server.
+	s.setStatus(http.StatusServiceUnavailable)
+	a.processTrap(testTrap(g.Version1, 1, sysNameVar("50% full")))
+	s.waitPosts(t, 1)
+	a.processTrap(testTrap(g.Version1, 2, sysNameVar("50% full")))
+	time.Sleep(100 * time.Millisecond)
+	if files := a.spoolFiles(); len(files) != 2 {
+		t.Fatalf("expected 2 spooled batches: %v", files)
+	}
+
+	// Data that is rejected goes to the error directory.
+	s.setStatus(http.StatusBadRequest)
+	a.replaySpool()
+	s.waitPosts(t, 2)
+	if files, _ := filepath.Glob(filepath.Join(spoolDir, "error", "*.csv")); len(files) != 2 {
+		t.Errorf("expected 2 rejected batches: %v", files)
+	}
+
+	s.setStatus(http.StatusServiceUnavailable)
+	a.processTrap(testTrap(g.Version1, 3, sysNameVar("50% full")))
+	s.waitPosts(t, 1)
+	a.processTrap(testTrap(g.Version1, 4, sysNameVar("50% full")))
+	time.Sleep(100 * time.Millisecond)
+	a.close()
+
+	// A new instance replays the spool when it starts, in order.
+	s.setStatus(http.StatusOK)
+	a = testClickhouse(t, s.URL, spoolDir, 1)
+	s.waitPosts(t, 2)
+	a.close()
+	if len(a.spoolFiles()) != 0 {
+		t.Errorf("spooled batches not removed after replay: %v", a.spoolFiles())
+	}
+	if rows := clickhouseRows(s); len(rows) != 2 || strings.Split(rows[0], ",")[7] != "3" || strings.Split(rows[1], ",")[7] != "4" {
+		t.Errorf("spooled rows not replayed in order: %v", rows)
+	}
+}
+
+func TestClickhouseSpoolLimit(t *testing.T) {
+	spoolDir := "tests/tmp/clickhouse_limit"
+	os.RemoveAll(spoolDir)
+	// Nothing listens on this port, so the batches are spooled.
+	a := testClickhouse(t, "http://127.0.0.1:1/", spoolDir, 1)
+	defer a.close()
+	a.spoolMu.Lock()
+	defer a.spoolMu.Unlock()
+	// A spooled batch of another destination whose name starts with "traps-"
+	other := filepath.Join(spoolDir, "traps-x-00000000000000000001-000001.csv")
+	if err := ioutil.WriteFile(other, []byte(strings.Repeat("x", 400*1024)+"\n"), 0644); err != nil {
+		t.Fatalf("%s", err)
+	}
+	big := []byte(strings.Repeat("x", 400*1024) + "\n")
+	for i := 0; i < 4; i++ {
+		a.writeSpool(spoolDir, big)
+	}
+	// With spool_max_size of 1 MB, only 2 of the 400 KB batches fit.
+	if files := a.spoolFiles(); len(files) != 2 {
+		t.Errorf("spool not kept under spool_max_size: %d files", len(files))
+	}
+	if _, err := os.Stat(other); err != nil {
+		t.Errorf("spooled batch of another destination removed: %s", err)
+	}
+}
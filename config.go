@@ -6,14 +6,20 @@
 package main
 
 import (
+	"encoding/hex"
 	"flag"
 	"fmt"
 	"io/ioutil"
+	"log"
+	"net"
 	"os"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/creasty/defaults"
 	g "github.com/gosnmp/gosnmp"
@@ -54,23 +60,53 @@ type v3Params struct {
 	PrivacyProto    string               `default:"NoPriv" yaml:"privacy_protocol"`
 	privacyProto    g.SnmpV3PrivProtocol `default:"g.NoPriv"`
 	PrivacyPassword string               `default:"XXv3Pass" yaml:"privacy_password"`
+	EngineID        string               `yaml:"engine_id"`
+	engineID        string
+	ContextName     string `yaml:"context_name"`
+
+	// Params used by the listener to decode traps sent by this user
+	receiver *g.GoSNMP
 }
 
 type ipSet map[string]bool
 
+type communitySet map[string]bool
+
 type trapexConfig struct {
 	teConfigured bool
 	runLogFile   string
 	configFile   string
 
+	// For a configuration check (-t), the filter actions are only checked
+	// (nothing is opened), and the problems found in the filters are
+	// collected instead of stopping at the first one.
+	checkOnly bool
+	problems  []error
+
 	General struct {
 		Hostname   string `yaml:"hostname"`
-		ListenAddr string `default:"0.0.0.0" yaml:"listen_address"`
+		ListenAddr string `yaml:"listen_address"`
 		ListenPort string `default:"162" yaml:"listen_port"`
 
 		IgnoreVersions []string        `default:"[]" yaml:"ignore_versions"`
 		ignoreVersions []g.SnmpVersion `default:"[]"`
 
+		InformResponse      string `default:"after" yaml:"inform_response"`
+		informResponseFirst bool
+
+		EngineID string `yaml:"engine_id"`
+		engineID string
+
+		ActionQueueSize     int    `default:"1000" yaml:"action_queue_size"`
+		ActionQueueOverflow string `default:"drop_newest" yaml:"action_queue_overflow"`
+		actionQueueOverflow int
+
+		ProcessWorkers   int `yaml:"process_workers"`
+		ProcessQueueSize int `default:"1000" yaml:"process_queue_size"`
+
+		AllowedCommunities []string `default:"[]" yaml:"allowed_communities"`
+		allowedCommunities communitySet
+
 		PrometheusIp       string `default:"0.0.0.0" yaml:"prometheus_ip"`
 		PrometheusPort     string `default:"80" yaml:"prometheus_port"`
 		PrometheusEndpoint string `default:"metrics" yaml:"prometheus_endpoint"`
@@ -84,37 +120,257 @@ type trapexConfig struct {
 		LogCompress   bool   `default:"false" yaml:"compress_rotated_logs"`
 	}
 
+	// The admin API listens on a TCP address (which requires the token)
+	// and/or a unix socket.
+	Admin struct {
+		ListenAddr string `yaml:"listen_address"`
+		Socket     string `yaml:"socket"`
+		Token      string `yaml:"token"`
+
+		// Rules added through the admin API are kept in the overlay file.
+		OverlayFile string `yaml:"overlay_file"`
+	} `yaml:"admin"`
+
 	V3Params v3Params `yaml:"snmpv3"`
 
+	V3Users []v3Params `default:"[]" yaml:"snmpv3_users"`
+	v3Users map[string][]*v3Params
+
+	V3Destinations []map[string]v3Params `default:"[]" yaml:"snmpv3_destinations"`
+	v3Destinations map[string]*v3Params
+
+	SyslogDestinations []map[string]syslogParams `default:"[]" yaml:"syslog_destinations"`
+	syslogDestinations map[string]*syslogParams
+
+	WebhookDestinations []map[string]webhookParams `default:"[]" yaml:"webhook_destinations"`
+	webhookDestinations map[string]*webhookParams
+
+	ClickhouseDestinations []map[string]clickhouseParams `default:"[]" yaml:"clickhouse_destinations"`
+	clickhouseDestinations map[string]*clickhouseParams
+
+	ForwardQueues []map[string]forwardQueueParams `default:"[]" yaml:"forward_queues"`
+	forwardQueues map[string]*forwardQueueParams
+
 	IpSets []map[string][]string `default:"{}" yaml:"ip_sets"`
 	ipSets map[string]ipSet      `default:"{}"`
 
-	RawFilters []string `default:"[]" yaml:"filters"`
+	CommunitySets []map[string][]string `default:"{}" yaml:"community_sets"`
+	communitySets map[string]communitySet
+
+	RawFilters []rawFilter `default:"[]" yaml:"filters"`
 	filters    []trapexFilter
+	rules      []*overlayRule
+
+	RawChains map[string][]rawFilter `default:"{}" yaml:"chains"`
+	chains    map[string]*filterChain
+
+	// The action instances used by the filters (by actionKey), and while
+	// reloading, those of the running configuration that can be kept.
+	actions         map[string]*sharedAction
+	previousActions map[string]*sharedAction
+
+	Mibs struct {
+		Dirs []string `default:"[]" yaml:"dirs"`
+	} `yaml:"mibs"`
+	mibs *mibDB
+}
+
+// rawFilter is an entry in the filters list, which can either be a filter
+// line string or a mapping with the filter fields (filterFields) by name.
+//
+type rawFilter struct {
+	line   string
+	fields *filterFields
+	rule   *overlayRule
+}
+
+// filterFields is the structured form of a filter entry. The six fields
+// of the filter line are named, and unset fields are wildcards.
+//
+type filterFields struct {
+	Name         string          `yaml:"name"`
+	Version      filterValues    `yaml:"version"`
+	SourceIP     filterValues    `yaml:"source_ip"`
+	AgentAddress filterValues    `yaml:"agent_address"`
+	Generic      filterValues    `yaml:"generic"`
+	Specific     filterValues    `yaml:"specific"`
+	Enterprise   filterValues    `yaml:"enterprise"`
+	V3User       filterValues    `yaml:"v3_user"`
+	TrapOID      filterValues    `yaml:"trap_oid"`
+	Community    filterValues    `yaml:"community"`
+	Varbinds     []varbindFields `yaml:"varbinds"`
+	Action       string          `yaml:"action"`
+	Args         stringList      `yaml:"args"`
+}
+
+// varbindFields is a varbind filter in the structured filter form. A value
+// without an op is an equality test, and absent inverts the match.
+//
+type varbindFields struct {
+	OID    string `yaml:"oid"`
+	Op     string `yaml:"op"`
+	Value  string `yaml:"value"`
+	Absent bool   `yaml:"absent"`
+}
+
+// stringList is a list of strings that can also be given in the YAML as a
+// single whitespace-separated string.
+//
+type stringList []string
+
+// filterValues is the value of a filter field: a single value (which can
+// have a "!" negation and "|" alternatives, as in the filter line), a list
+// of alternatives, or a mapping with "not" to negate either of those.
+//
+type filterValues struct {
+	negate bool
+	values []string
+	isList bool
+}
+
+// filterFieldNames are the names of the six positional filter fields, which
+// are also the keys used for them in the structured filter form.
+//
+var filterFieldNames = [...]string{"version", "source_ip", "agent_address", "generic", "specific", "enterprise"}
+
+func (rf *rawFilter) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	if err := unmarshal(&rf.line); err == nil {
+		return nil
+	}
+	rf.fields = &filterFields{}
+	return unmarshal(rf.fields)
+}
+
+func (l *stringList) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err == nil {
+		*l = strings.Fields(s)
+		return nil
+	}
+	var list []string
+	if err := unmarshal(&list); err != nil {
+		return err
+	}
+	*l = list
+	return nil
+}
+
+func (fv *filterValues) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err == nil {
+		fv.values = []string{s}
+		return nil
+	}
+	var list []string
+	if err := unmarshal(&list); err == nil {
+		fv.values = list
+		fv.isList = true
+		return nil
+	}
+	var not struct {
+		Not filterValues `yaml:"not"`
+	}
+	if err := unmarshal(&not); err != nil {
+		return err
+	}
+	*fv = not.Not
+	fv.negate = !fv.negate
+	return nil
+}
+
+// isWildcard returns true if the filterValues matches anything (it is not
+// set, or is a plain "*").
+//
+func (fv filterValues) isWildcard() bool {
+	if fv.negate {
+		return false
+	}
+	return len(fv.values) == 0 || !fv.isList && len(fv.values) == 1 && (fv.values[0] == "" || fv.values[0] == "*")
+}
+
+// expand returns whether the filterValues is negated and the values of
+// its alternatives. A single value is split on "|" unless it is a regex
+// (where "|" is part of the regex).
+//
+func (fv filterValues) expand(isRegex bool) (bool, []string) {
+	if fv.isList || len(fv.values) != 1 {
+		return fv.negate, fv.values
+	}
+	negate, v := fv.negate, fv.values[0]
+	if strings.HasPrefix(v, "!") {
+		negate, v = !negate, v[1:]
+	}
+	if isRegex || strings.HasPrefix(v, "/") {
+		return negate, []string{v}
+	}
+	return negate, strings.Split(v, "|")
+}
+
+// positional returns the values of the six positional filter fields in
+// filter line order.
+//
+func (ff *filterFields) positional() [6]filterValues {
+	return [6]filterValues{ff.Version, ff.SourceIP, ff.AgentAddress, ff.Generic, ff.Specific, ff.Enterprise}
+}
+
+// filterCriterion is one of the optional named criteria of a filter.
+//
+type filterCriterion struct {
+	name   string
+	values filterValues
+}
+
+// criteria returns the optional named criteria, always in the same order so
+// the filter items (and any error) do not depend on map order.
+//
+func (ff *filterFields) criteria() []filterCriterion {
+	return []filterCriterion{
+		{"v3_user", ff.V3User},
+		{"trap_oid", ff.TrapOID},
+		{"community", ff.Community},
+	}
 }
 
 type trapexCommandLine struct {
-	configFile string
-	bindAddr   string
-	listenPort string
-	debugMode  bool
+	configFile  string
+	bindAddr    string
+	listenPort  string
+	debugMode   bool
+	checkConfig bool
 }
 
 // Global vars
 //
 var teConfig *trapexConfig
 var teCmdLine trapexCommandLine
-var ipRe = regexp.MustCompile(`^(?:\d{1,3}\.){3}\d{1,3}$`)
+
+// configLock guards the teConfig pointer. The processing workers hold the
+// read lock while handling a trap, so a reload waits for the traps in
+// flight before it swaps in the new configuration. The reloadLock keeps
+// configuration loads from overlapping.
+//
+var configLock sync.RWMutex
+var reloadLock sync.Mutex
+
+// currentConfig returns the running configuration (for use outside of the
+// processing workers).
+//
+func currentConfig() *trapexConfig {
+	configLock.RLock()
+	defer configLock.RUnlock()
+	return teConfig
+}
 
 func showUsage() {
 	usageText := `
 Usage: trapex [-h] [-c <config_file>] [-b <bind_ip>] [-p <listen_port>]
-              [-d] [-v]
+              [-d] [-t] [-v]
   -h  - Show this help message and exit.
   -c  - Override the location of the trapex configuration file.
   -b  - Override the bind IP address on which to listen for incoming traps.
   -p  - Override the UDP port on which to listen for incoming traps.
   -d  - Enable debug mode (note: produces very verbose runtime output).
+  -t  - Check the configuration file, report any problems, and exit.
   -v  - Print the version of trapex and exit.
 `
 	fmt.Println(usageText)
@@ -126,6 +382,7 @@ func processCommandLine() {
 	b := flag.String("b", "", "")
 	p := flag.String("p", "", "")
 	d := flag.Bool("d", false, "")
+	t := flag.Bool("t", false, "")
 	showVersion := flag.Bool("v", false, "")
 
 	flag.Parse()
@@ -139,6 +396,7 @@ func processCommandLine() {
 	teCmdLine.bindAddr = *b
 	teCmdLine.listenPort = *p
 	teCmdLine.debugMode = *d
+	teCmdLine.checkConfig = *t
 }
 
 // loadConfig
@@ -147,6 +405,13 @@ func loadConfig(config_file string, newConfig *trapexConfig) error {
 	defaults.Set(newConfig)
 
 	newConfig.ipSets = make(map[string]ipSet)
+	newConfig.communitySets = make(map[string]communitySet)
+	newConfig.v3Users = make(map[string][]*v3Params)
+	newConfig.v3Destinations = make(map[string]*v3Params)
+	newConfig.syslogDestinations = make(map[string]*syslogParams)
+	newConfig.webhookDestinations = make(map[string]*webhookParams)
+	newConfig.clickhouseDestinations = make(map[string]*clickhouseParams)
+	newConfig.forwardQueues = make(map[string]*forwardQueueParams)
 
 	filename, _ := filepath.Abs(config_file)
 	yamlFile, err := ioutil.ReadFile(filename)
@@ -184,9 +449,39 @@ func applyCliOverrides(newConfig *trapexConfig) {
 	}
 }
 
+// configSteps validate and process the sections of a loaded configuration
+// in order. The filters are processed after these, since that sets up the
+// filter actions.
+//
+var configSteps = []func(*trapexConfig) error{
+	validateIgnoreVersions,
+	validateInformResponse,
+	validateActionQueue,
+	validateProcessWorkers,
+	validateAdmin,
+	processRules,
+	validateSnmpV3Args,
+	processV3Users,
+	processV3Destinations,
+	processIpSets,
+	processCommunitySets,
+	processMibs,
+	processSyslogDestinations,
+	processWebhookDestinations,
+	processClickhouseDestinations,
+	processForwardQueues,
+}
+
+// getConfig loads (or reloads) the configuration. The new configuration is
+// built alongside the running one, keeping the action instances whose
+// settings haven't changed, and then swapped in. The handles that are no
+// longer used are closed after their queued traps have been handled.
+//
 func getConfig() error {
+	reloadLock.Lock()
+	defer reloadLock.Unlock()
+
 	var operation string
-	// If this is a reconfig close any current handles
 	if teConfig != nil && teConfig.teConfigured {
 		operation = "Reloading "
 	} else {
@@ -201,28 +496,42 @@ func getConfig() error {
 	}
 	applyCliOverrides(&newConfig)
 
-	if err = validateIgnoreVersions(&newConfig); err != nil {
-		return err
-	}
-	if err = validateSnmpV3Args(&newConfig); err != nil {
-		return err
+	for _, step := range configSteps {
+		if err = step(&newConfig); err != nil {
+			return err
+		}
 	}
-	if err = processIpSets(&newConfig); err != nil {
-		return err
+	oldConfig := teConfig
+	if oldConfig != nil && oldConfig.teConfigured {
+		newConfig.previousActions = oldConfig.actions
 	}
-	if err = processFilters(&newConfig); err != nil {
+	err = processFilters(&newConfig)
+	newConfig.previousActions = nil
+	if err != nil {
+		closeActions(&newConfig, oldConfig)
 		return err
 	}
 
-	// If this is a reconfigure, close the old handles here
-	if teConfig != nil && teConfig.teConfigured {
-		closeTrapexHandles()
+	swapConfig(&newConfig, oldConfig)
+	if newConfig.Admin.OverlayFile != "" {
+		startRuleExpiry()
 	}
-	// Set our global config pointer to this configuration
+	return nil
+}
+
+// swapConfig sets our global config pointer to the new configuration once
+// the traps in flight are done with the old one.
+//
+func swapConfig(newConfig *trapexConfig, oldConfig *trapexConfig) {
 	newConfig.teConfigured = true
-	teConfig = &newConfig
+	configLock.Lock()
+	teConfig = newConfig
+	configLock.Unlock()
 
-	return nil
+	// If this is a reconfigure, close the old handles that were not kept
+	if oldConfig != nil && oldConfig.teConfigured {
+		closeActions(oldConfig, newConfig)
+	}
 }
 
 func validateIgnoreVersions(newConfig *trapexConfig) error {
@@ -254,48 +563,178 @@ func validateIgnoreVersions(newConfig *trapexConfig) error {
 	return nil
 }
 
+func validateInformResponse(newConfig *trapexConfig) error {
+	switch strings.ToLower(newConfig.General.InformResponse) {
+	case "after":
+		newConfig.General.informResponseFirst = false
+	case "before":
+		newConfig.General.informResponseFirst = true
+	default:
+		return fmt.Errorf("unsupported or invalid value (%s) for general:inform_response", newConfig.General.InformResponse)
+	}
+
+	// Our engine ID for v3 INFORMs is given as a hex string, or made up
+	// from the hostname (in the RFC 3411 text format).
+	if newConfig.General.EngineID != "" {
+		engineID, err := hex.DecodeString(strings.TrimPrefix(strings.ToLower(newConfig.General.EngineID), "0x"))
+		if err != nil || len(engineID) < 5 || len(engineID) > 32 {
+			return fmt.Errorf("invalid value for general:engine_id (expected 5 to 32 hex-encoded octets): %s", newConfig.General.EngineID)
+		}
+		newConfig.General.engineID = string(engineID)
+	} else {
+		text := "trapex-" + newConfig.General.Hostname
+		if len(text) > 27 {
+			text = text[:27]
+		}
+		newConfig.General.engineID = "\x80\x00\x1f\x88\x04" + text
+	}
+	return nil
+}
+
 func validateSnmpV3Args(newConfig *trapexConfig) error {
-	switch strings.ToLower(newConfig.V3Params.MsgFlags) {
+	return validateV3Params(&newConfig.V3Params, "snmpv3")
+}
+
+// validateV3Params checks the text values of a set of SNMP v3 parameters
+// and sets the corresponding usable values. The section name is used for
+// error reporting.
+//
+func validateV3Params(params *v3Params, section string) error {
+	switch strings.ToLower(params.MsgFlags) {
 	case "noauthnopriv":
-		newConfig.V3Params.msgFlags = g.NoAuthNoPriv
+		params.msgFlags = g.NoAuthNoPriv
 	case "authnopriv":
-		newConfig.V3Params.msgFlags = g.AuthNoPriv
+		params.msgFlags = g.AuthNoPriv
 	case "authpriv":
-		newConfig.V3Params.msgFlags = g.AuthPriv
+		params.msgFlags = g.AuthPriv
 	default:
-		return fmt.Errorf("unsupported or invalid value (%s) for snmpv3:msg_flags", newConfig.V3Params.MsgFlags)
+		return fmt.Errorf("unsupported or invalid value (%s) for %s:msg_flags", params.MsgFlags, section)
 	}
 
-	switch strings.ToLower(newConfig.V3Params.AuthProto) {
+	switch strings.ToLower(params.AuthProto) {
 	// AES is *NOT* supported
 	case "noauth":
-		newConfig.V3Params.authProto = g.NoAuth
+		params.authProto = g.NoAuth
 	case "sha":
-		newConfig.V3Params.authProto = g.SHA
+		params.authProto = g.SHA
 	case "md5":
-		newConfig.V3Params.authProto = g.MD5
+		params.authProto = g.MD5
 	default:
-		return fmt.Errorf("invalid value for snmpv3:auth_protocol: %s", newConfig.V3Params.AuthProto)
+		return fmt.Errorf("invalid value for %s:auth_protocol: %s", section, params.AuthProto)
 	}
 
-	switch strings.ToLower(newConfig.V3Params.PrivacyProto) {
+	switch strings.ToLower(params.PrivacyProto) {
 	case "nopriv":
-		newConfig.V3Params.privacyProto = g.NoPriv
+		params.privacyProto = g.NoPriv
 	case "aes":
-		newConfig.V3Params.privacyProto = g.AES
+		params.privacyProto = g.AES
 	case "des":
-		newConfig.V3Params.privacyProto = g.DES
+		params.privacyProto = g.DES
 	default:
-		return fmt.Errorf("invalid value for snmpv3:privacy_protocol: %s", newConfig.V3Params.PrivacyProto)
+		return fmt.Errorf("invalid value for %s:privacy_protocol: %s", section, params.PrivacyProto)
+	}
+
+	if (params.msgFlags&g.AuthPriv) == 1 && params.authProto < 2 {
+		return fmt.Errorf("v3 config error: no auth protocol set when %s:msg_flags specifies an Auth mode", section)
+	}
+	if params.msgFlags == g.AuthPriv && params.privacyProto < 2 {
+		return fmt.Errorf("v3 config error: no privacy protocol mode set when %s:msg_flags specifies an AuthPriv mode", section)
 	}
 
-	if (newConfig.V3Params.msgFlags&g.AuthPriv) == 1 && newConfig.V3Params.authProto < 2 {
-		return fmt.Errorf("v3 config error: no auth protocol set when snmpv3:msg_flags specifies an Auth mode")
+	// The engine ID is given as a hex string in the config file.
+	if params.EngineID != "" {
+		engineID, err := hex.DecodeString(strings.TrimPrefix(strings.ToLower(params.EngineID), "0x"))
+		if err != nil || len(engineID) < 5 || len(engineID) > 32 {
+			return fmt.Errorf("invalid value for %s:engine_id (expected 5 to 32 hex-encoded octets): %s", section, params.EngineID)
+		}
+		params.engineID = string(engineID)
 	}
-	if newConfig.V3Params.msgFlags == g.AuthPriv && newConfig.V3Params.privacyProto < 2 {
-		return fmt.Errorf("v3 config error: no privacy protocol mode set when snmpv3:msg_flags specifies an AuthPriv mode")
+
+	return nil
+}
+
+// usmParams returns the gosnmp USM security parameters for this set of
+// v3 params.
+//
+func (params *v3Params) usmParams() *g.UsmSecurityParameters {
+	return &g.UsmSecurityParameters{
+		UserName:                 params.Username,
+		AuthoritativeEngineID:    params.engineID,
+		AuthenticationProtocol:   params.authProto,
+		AuthenticationPassphrase: params.AuthPassword,
+		PrivacyProtocol:          params.privacyProto,
+		PrivacyPassphrase:        params.PrivacyPassword,
+	}
+}
+
+// newReceiver sets up the gosnmp params the listener uses to decode traps
+// sent with this set of v3 params.
+//
+func (params *v3Params) newReceiver(debug bool) {
+	params.receiver = &g.GoSNMP{
+		Version:            g.Version3,
+		SecurityModel:      g.UserSecurityModel,
+		MsgFlags:           params.msgFlags,
+		SecurityParameters: params.usmParams(),
+	}
+	if debug {
+		params.receiver.Logger = g.NewLogger(log.New(os.Stdout, "", 0))
+	}
+}
+
+// processV3Users validates the snmpv3_users table and sets up the listener
+// params for each user (as well as for the snmpv3 section, which is used for
+// any v3 user not found in the table). Users are keyed by username, and each
+// username can have more than one entry with different engine IDs.
+//
+func processV3Users(newConfig *trapexConfig) error {
+	debug := newConfig.Logging.Level == "debug"
+	newConfig.V3Params.newReceiver(debug)
+	for i := range newConfig.V3Users {
+		user := &newConfig.V3Users[i]
+		if user.Username == "" {
+			return fmt.Errorf("missing username for snmpv3_users entry %v", i)
+		}
+		if err := defaults.Set(user); err != nil {
+			return err
+		}
+		if err := validateV3Params(user, "snmpv3_users:"+user.Username); err != nil {
+			return err
+		}
+		for _, other := range newConfig.v3Users[user.Username] {
+			if other.engineID == user.engineID {
+				return fmt.Errorf("duplicate snmpv3_users entry for username %s and engine_id %s", user.Username, user.EngineID)
+			}
+		}
+		user.newReceiver(debug)
+		logger.Info().Str("username", user.Username).Str("engine_id", user.EngineID).Msg("Loading SNMPv3 user")
+		newConfig.v3Users[user.Username] = append(newConfig.v3Users[user.Username], user)
 	}
+	return nil
+}
 
+// processV3Destinations validates each of the named SNMP v3 forward
+// destination parameter sets.
+//
+func processV3Destinations(newConfig *trapexConfig) error {
+	for _, stanza := range newConfig.V3Destinations {
+		for destName, params := range stanza {
+			if _, ok := newConfig.v3Destinations[destName]; ok {
+				return fmt.Errorf("duplicate snmpv3_destinations entry: %s", destName)
+			}
+			// Fields that were not set get the same defaults as the
+			// snmpv3 section.
+			dest := params
+			if err := defaults.Set(&dest); err != nil {
+				return err
+			}
+			if err := validateV3Params(&dest, "snmpv3_destinations:"+destName); err != nil {
+				return err
+			}
+			logger.Info().Str("v3_destination", destName).Str("username", dest.Username).Msg("Loading SNMPv3 destination")
+			newConfig.v3Destinations[destName] = &dest
+		}
+	}
 	return nil
 }
 
@@ -305,8 +744,10 @@ func processIpSets(newConfig *trapexConfig) error {
 			logger.Info().Str("ipset", ipsName).Msg("Loading IpSet")
 			newConfig.ipSets[ipsName] = make(map[string]bool)
 			for _, ip := range ips {
-				if ipRe.MatchString(ip) {
-					newConfig.ipSets[ipsName][ip] = true
+				// IPs are stored in their canonical form so IPv6
+				// addresses match however they were written.
+				if parsedIP := net.ParseIP(ip); parsedIP != nil {
+					newConfig.ipSets[ipsName][parsedIP.String()] = true
 					logger.Debug().Str("ipset", ipsName).Str("ip", ip).Msg("Adding IP to IpSet")
 				} else {
 					return fmt.Errorf("Invalid IP address (%s) in ipset: %s", ip, ipsName)
@@ -317,11 +758,153 @@ func processIpSets(newConfig *trapexConfig) error {
 	return nil
 }
 
+// processCommunitySets loads the community_sets, and then the
+// general:allowed_communities list (which can include whole sets with
+// "communityset:<name>").
+//
+func processCommunitySets(newConfig *trapexConfig) error {
+	for _, stanza := range newConfig.CommunitySets {
+		for setName, communities := range stanza {
+			logger.Info().Str("community_set", setName).Msg("Loading community set")
+			newConfig.communitySets[setName] = make(communitySet)
+			for _, c := range communities {
+				newConfig.communitySets[setName][c] = true
+			}
+		}
+	}
+
+	if len(newConfig.General.AllowedCommunities) == 0 {
+		return nil
+	}
+	newConfig.General.allowedCommunities = make(communitySet)
+	for _, c := range newConfig.General.AllowedCommunities {
+		if strings.HasPrefix(c, "communityset:") {
+			set, ok := newConfig.communitySets[c[13:]]
+			if !ok {
+				return fmt.Errorf("invalid community set name in allowed_communities: %s", c)
+			}
+			for sc := range set {
+				newConfig.General.allowedCommunities[sc] = true
+			}
+		} else {
+			newConfig.General.allowedCommunities[c] = true
+		}
+	}
+	return nil
+}
+
+// isAllowedCommunity checks the community of a v1/v2c packet against the
+// general:allowed_communities list. Everything is allowed if there is no
+// list, and v3 packets have no community to check.
+//
+func (c *trapexConfig) isAllowedCommunity(p *g.SnmpPacket) bool {
+	if c.General.allowedCommunities == nil || p.Version == g.Version3 {
+		return true
+	}
+	return c.General.allowedCommunities[p.Community]
+}
+
+// processMibs loads the MIB files from the mibs:dirs directories (if any).
+//
+func processMibs(newConfig *trapexConfig) error {
+	if len(newConfig.Mibs.Dirs) == 0 {
+		return nil
+	}
+	mibs, err := loadMibs(newConfig.Mibs.Dirs)
+	if err != nil {
+		return fmt.Errorf("unable to load MIBs: %s", err)
+	}
+	newConfig.mibs = mibs
+	return nil
+}
+
 func processFilters(newConfig *trapexConfig) error {
+	var err error
+
+	// Set up all of the chains first so filters can jump to chains that
+	// are defined after them.
+	newConfig.chains = make(map[string]*filterChain)
+	for name := range newConfig.RawChains {
+		if name == "" || strings.ContainsAny(name, " \t") {
+			return fmt.Errorf("invalid filter chain name: '%s'", name)
+		}
+		newConfig.chains[name] = &filterChain{name: name}
+	}
 
-	for lineNumber, filter_line := range newConfig.RawFilters {
-		logger.Debug().Str("filter", filter_line).Int("line_number", lineNumber).Msg("Examining filter")
-		if err := processFilterLine(strings.Fields(filter_line), newConfig, lineNumber); err != nil {
+	rawFilters := mergeRules(newConfig.RawFilters, newConfig.rules, time.Now())
+	if newConfig.filters, err = processFilterList(rawFilters, "", newConfig); err != nil {
+		return err
+	}
+	for name, rawFilters := range newConfig.RawChains {
+		if newConfig.chains[name].filters, err = processFilterList(rawFilters, name, newConfig); err != nil {
+			return err
+		}
+	}
+	return checkChainLoops(newConfig)
+}
+
+// processFilterList sets up the filters for the main filters list (chain is
+// "") or one of the named chains.
+//
+func processFilterList(rawFilters []rawFilter, chain string, newConfig *trapexConfig) ([]trapexFilter, error) {
+	var filters []trapexFilter
+	for lineNumber, rawFilter := range rawFilters {
+		var filter trapexFilter
+		var err error
+		if rawFilter.fields != nil {
+			logger.Debug().Str("filter", rawFilter.fields.Name).Str("chain", chain).Int("line_number", lineNumber).Msg("Examining filter")
+			filter, err = processFilterFields(rawFilter.fields, newConfig, lineNumber)
+		} else {
+			logger.Debug().Str("filter", rawFilter.line).Str("chain", chain).Int("line_number", lineNumber).Msg("Examining filter")
+			filter, err = processFilterLine(strings.Fields(rawFilter.line), newConfig, lineNumber)
+		}
+		if err != nil {
+			if chain != "" {
+				err = fmt.Errorf("chain %s: %s", chain, err)
+			}
+			if rawFilter.rule != nil {
+				err = fmt.Errorf("rule %d: %s", rawFilter.rule.ID, err)
+			}
+			if newConfig.checkOnly {
+				newConfig.problems = append(newConfig.problems, err)
+				continue
+			}
+			return nil, err
+		}
+		filter.rule = rawFilter.rule
+		filters = append(filters, filter)
+	}
+	return filters, nil
+}
+
+// checkChainLoops makes sure no chain can end up jumping (or going) back
+// to itself, directly or through other chains.
+//
+func checkChainLoops(newConfig *trapexConfig) error {
+	var visit func(c *filterChain, path []string) error
+	done := make(map[*filterChain]bool)
+	visit = func(c *filterChain, path []string) error {
+		for i, name := range path {
+			if name == c.name {
+				return fmt.Errorf("filter chain loop: %s", strings.Join(append(path[i:], c.name), " -> "))
+			}
+		}
+		if done[c] {
+			return nil
+		}
+		path = append(path, c.name)
+		for _, f := range c.filters {
+			if f.actionType == actionJump || f.actionType == actionGoto {
+				if err := visit(f.action.(*filterChain), path); err != nil {
+					return err
+				}
+			}
+		}
+		done[c] = true
+		return nil
+	}
+	for _, c := range newConfig.chains {
+		if err := visit(c, nil); err != nil {
 			return err
 		}
 	}
@@ -331,101 +914,251 @@ func processFilters(newConfig *trapexConfig) error {
 // processFilterLine parses a "filter" line and sets
 // the appropriate values in a corresponding trapexFilter struct.
 //
-func processFilterLine(f []string, newConfig *trapexConfig, lineNumber int) error {
-	var err error
+func processFilterLine(f []string, newConfig *trapexConfig, lineNumber int) (trapexFilter, error) {
+	line := strings.Join(f, " ")
 	if len(f) < 7 {
-		return fmt.Errorf("not enough fields in filter line(%v): %s", lineNumber, "filter "+strings.Join(f, " "))
+		return trapexFilter{}, fmt.Errorf("not enough fields in filter line(%v): %s", lineNumber, "filter "+strings.Join(f, " "))
 	}
 
+	// Any optional "name=value" criteria come between the six positional
+	// fields and the action. Pull them out so the action fields line up.
+	n := 6
+	for n < len(f) && strings.Contains(f[n], "=") {
+		n++
+	}
+	extraCriteria := f[6:n]
+	if n == len(f) {
+		return trapexFilter{}, fmt.Errorf("missing action in filter line(%v): %s", lineNumber, "filter "+strings.Join(f, " "))
+	}
+	f = append(f[:6:6], f[n:]...)
+
 	// Process the filter criteria
 	//
-	filter := trapexFilter{}
-	if strings.HasPrefix(strings.Join(f, " "), "* * * * * *") {
+	filter := trapexFilter{line: line, hits: new(uint64)}
+	if strings.HasPrefix(strings.Join(f, " "), "* * * * * *") && len(extraCriteria) == 0 {
 		filter.matchAll = true
 	} else {
-		fObj := filterObj{}
 		// Construct the filter criteria
 		for i, fi := range f[:6] {
 			if fi == "*" {
 				continue
 			}
-			fObj.filterItem = i
-			if i == 0 {
-				switch strings.ToLower(fi) {
-				case "v1", "1":
-					fObj.filterValue = g.Version1
-				case "v2c", "2c", "2":
-					fObj.filterValue = g.Version2c
-				case "v3", "3":
-					fObj.filterValue = g.Version3
-				default:
-					return fmt.Errorf("unsupported or invalid SNMP version (%s) on line %v for filter: %s", fi, lineNumber, f)
-				}
-				fObj.filterType = parseTypeInt // Just because we should set this to something.
-			} else if i == 1 || i == 2 { // Either of the first 2 is an IP address type
-				if strings.HasPrefix(fi, "ipset:") { // If starts with a "ipset:"" it's an IP set
-					fObj.filterType = parseTypeIPSet
-					if _, ok := newConfig.ipSets[fi[6:]]; ok {
-						fObj.filterValue = fi[6:]
-					} else {
-						return fmt.Errorf("Invalid ipset name specified on line %v: %s: %s", lineNumber, fi, f)
-					}
-				} else if strings.HasPrefix(fi, "/") { // If starts with a "/", it's a regex
-					fObj.filterType = parseTypeRegex
-					fObj.filterValue, err = regexp.Compile(fi[1:])
-					if err != nil {
-						return fmt.Errorf("unable to compile regexp for IP on line %v: %s: %s\n%s", lineNumber, fi, err, f)
-					}
-				} else if strings.Contains(fi, "/") {
-					fObj.filterType = parseTypeCIDR
-					fObj.filterValue, err = newNetwork(fi)
-					if err != nil {
-						return fmt.Errorf("invalid IP/CIDR at line %v: %s, %s", lineNumber, fi, f)
-					}
-				} else {
-					fObj.filterType = parseTypeString
-					fObj.filterValue = fi
-				}
-			} else if i > 2 && i < 5 { // Generic and Specific type
-				val, e := strconv.Atoi(fi)
-				if e != nil {
-					return fmt.Errorf("invalid integer value at line %v: %s: %s", lineNumber, fi, e)
-				}
-				fObj.filterType = parseTypeInt
-				fObj.filterValue = val
-			} else { // The enterprise OID
-				fObj.filterType = parseTypeRegex
-				fObj.filterValue, err = regexp.Compile(fi)
-				if err != nil {
-					return fmt.Errorf("unable to compile regexp at line %v for OID: %s: %s", lineNumber, fi, err)
-				}
+			fObj, err := processFilterValues(i, filterValues{values: []string{fi}}, newConfig)
+			if err != nil {
+				return filter, fmt.Errorf("invalid %s field at line %v: %s: %s", filterFieldNames[i], lineNumber, err, "filter "+strings.Join(f, " "))
+			}
+			filter.filterItems = append(filter.filterItems, fObj)
+		}
+		for _, c := range extraCriteria {
+			kv := strings.SplitN(c, "=", 2)
+			fObj, err := processFilterCriteria(kv[0], filterValues{values: []string{kv[1]}}, newConfig)
+			if err != nil {
+				return filter, fmt.Errorf("invalid filter criteria at line %v: %s: %s", lineNumber, c, err)
 			}
 			filter.filterItems = append(filter.filterItems, fObj)
 		}
 	}
+
 	// Process the filter action
 	//
-	var actionArg string
-	var breakAfter bool
-	if len(f) > 8 && f[8] == "break" {
-		breakAfter = true
-	} else {
-		breakAfter = false
+	if err := processFilterAction(&filter, f[6], f[7:], newConfig); err != nil {
+		return filter, fmt.Errorf("%s at line %v", err, lineNumber)
 	}
 
-	var action = f[6]
+	return filter, nil
+}
+
+// processFilterFields sets up a trapexFilter from the structured form of
+// a filter entry. Errors name the filter and the key they were found in.
+//
+func processFilterFields(ff *filterFields, newConfig *trapexConfig, lineNumber int) (trapexFilter, error) {
+	where := fmt.Sprintf("filter %v", lineNumber)
+	if ff.Name != "" {
+		where = fmt.Sprintf("filter %v (%s)", lineNumber, ff.Name)
+	}
+
+	filter := trapexFilter{name: ff.Name, hits: new(uint64)}
+	for i, fi := range ff.positional() {
+		if fi.isWildcard() {
+			continue
+		}
+		fObj, err := processFilterValues(i, fi, newConfig)
+		if err != nil {
+			return filter, fmt.Errorf("%s: invalid value for %s: %s", where, filterFieldNames[i], err)
+		}
+		filter.filterItems = append(filter.filterItems, fObj)
+	}
+	for _, c := range ff.criteria() {
+		if c.values.isWildcard() {
+			continue
+		}
+		fObj, err := processFilterCriteria(c.name, c.values, newConfig)
+		if err != nil {
+			return filter, fmt.Errorf("%s: invalid value for %s: %s", where, c.name, err)
+		}
+		filter.filterItems = append(filter.filterItems, fObj)
+	}
+	for i, vf := range ff.Varbinds {
+		op := vf.Op
+		if op == "" && vf.Value != "" {
+			op = "=="
+		}
+		vm, err := newVarbindMatch(vf.OID, op, vf.Value, vf.Absent, newConfig.mibs)
+		if err != nil {
+			return filter, fmt.Errorf("%s: invalid value for varbinds[%v]: %s", where, i, err)
+		}
+		filter.filterItems = append(filter.filterItems, filterObj{filterItem: varbind, filterValue: vm})
+	}
+	filter.matchAll = len(filter.filterItems) == 0
+
+	if ff.Action == "" {
+		return filter, fmt.Errorf("%s: missing action", where)
+	}
+	if err := processFilterAction(&filter, ff.Action, ff.Args, newConfig); err != nil {
+		return filter, fmt.Errorf("%s: invalid action or args: %s", where, err)
+	}
+
+	return filter, nil
+}
+
+// processFilterValues sets up the filterObj for one of the six positional
+// filter fields (by position), with any negation and alternatives.
+//
+func processFilterValues(i int, fv filterValues, newConfig *trapexConfig) (filterObj, error) {
+	return makeFilterObj(i, fv, i == enterprise, func(v string) (filterObj, error) {
+		return processFilterField(i, v, newConfig)
+	})
+}
+
+// makeFilterObj sets up a filterObj from filterValues, using parse for each
+// of the alternatives. More than one alternative makes a parseTypeAnyOf
+// filterObj that matches if any of them match.
+//
+func makeFilterObj(item int, fv filterValues, isRegex bool, parse func(string) (filterObj, error)) (filterObj, error) {
+	negate, values := fv.expand(isRegex)
+	var alts []filterObj
+	for _, v := range values {
+		if v == "" || v == "*" {
+			return filterObj{}, fmt.Errorf("a wildcard can't be negated or used as an alternative")
+		}
+		fObj, err := parse(v)
+		if err != nil {
+			return fObj, err
+		}
+		alts = append(alts, fObj)
+	}
+	if len(alts) == 1 {
+		alts[0].negate = negate
+		return alts[0], nil
+	}
+	return filterObj{filterItem: item, filterType: parseTypeAnyOf, filterValue: alts, negate: negate}, nil
+}
+
+// processFilterField parses the value of one of the six positional filter
+// fields (by position) into a filterObj.
+//
+func processFilterField(i int, fi string, newConfig *trapexConfig) (filterObj, error) {
+	var err error
+	fObj := filterObj{filterItem: i}
+	if i == 0 {
+		switch strings.ToLower(fi) {
+		case "v1", "1":
+			fObj.filterValue = g.Version1
+		case "v2c", "2c", "2":
+			fObj.filterValue = g.Version2c
+		case "v3", "3":
+			fObj.filterValue = g.Version3
+		default:
+			return fObj, fmt.Errorf("unsupported or invalid SNMP version (%s)", fi)
+		}
+		fObj.filterType = parseTypeInt // Just because we should set this to something.
+	} else if i == 1 || i == 2 { // Either of the first 2 is an IP address type
+		if strings.HasPrefix(fi, "ipset:") { // If starts with a "ipset:"" it's an IP set
+			fObj.filterType = parseTypeIPSet
+			if _, ok := newConfig.ipSets[fi[6:]]; ok {
+				fObj.filterValue = fi[6:]
+			} else {
+				return fObj, fmt.Errorf("invalid ipset name specified: %s", fi)
+			}
+		} else if strings.HasPrefix(fi, "/") { // If starts with a "/", it's a regex
+			fObj.filterType = parseTypeRegex
+			fObj.filterValue, err = regexp.Compile(fi[1:])
+			if err != nil {
+				return fObj, fmt.Errorf("unable to compile regexp for IP: %s: %s", fi, err)
+			}
+		} else if strings.Contains(fi, "/") {
+			fObj.filterType = parseTypeCIDR
+			fObj.filterValue, err = newNetwork(fi)
+			if err != nil {
+				return fObj, fmt.Errorf("invalid IP/CIDR: %s", fi)
+			}
+		} else {
+			fObj.filterType = parseTypeString
+			if ip := net.ParseIP(fi); ip != nil {
+				fObj.filterValue = ip.String()
+			} else {
+				fObj.filterValue = fi
+			}
+		}
+	} else if i > 2 && i < 5 { // Generic and Specific type
+		// Ranges (x:y), lists (x,y,z), and comparisons (>x) are all
+		// handled as a list of ranges.
+		if strings.ContainsAny(fi, ":,<>") {
+			fObj.filterType = parseTypeIntRange
+			fObj.filterValue, err = newIntRanges(fi)
+			if err != nil {
+				return fObj, err
+			}
+			return fObj, nil
+		}
+		val, e := strconv.Atoi(fi)
+		if e != nil {
+			return fObj, fmt.Errorf("invalid integer value: %s: %s", fi, e)
+		}
+		fObj.filterType = parseTypeInt
+		fObj.filterValue = val
+	} else { // The enterprise OID
+		fObj.filterType = parseTypeRegex
+		fObj.filterValue, err = regexp.Compile(fi)
+		if err != nil {
+			return fObj, fmt.Errorf("unable to compile regexp for OID: %s: %s", fi, err)
+		}
+	}
+	return fObj, nil
+}
 
-	if len(f) > 7 {
-		actionArg = f[7]
+// processFilterAction sets up the action for a filter from the action name
+// and its arguments (the action argument followed by any options).
+//
+func processFilterAction(filter *trapexFilter, action string, args []string, newConfig *trapexConfig) error {
+	var actionArg string
+	var actionOpts []string
+	var breakAfter bool
+	if len(args) > 0 {
+		actionArg = args[0]
+	}
+	if len(args) > 1 {
+		for _, opt := range args[1:] {
+			if opt == "break" {
+				breakAfter = true
+			} else {
+				actionOpts = append(actionOpts, opt)
+			}
+		}
 	}
 
+	filter.actionText = strings.Join(append([]string{action}, args...), " ")
 	switch action {
 	case "break", "drop":
 		filter.actionType = actionBreak
 	case "nat":
 		filter.actionType = actionNat
 		if actionArg == "" {
-			return fmt.Errorf("missing nat argument at line %v", lineNumber)
+			return fmt.Errorf("missing nat argument")
+		}
+		// The agent address is a v1 trap field, so it can only be IPv4.
+		if ip := net.ParseIP(actionArg); actionArg != "$SRC_IP" && (ip == nil || ip.To4() == nil) {
+			return fmt.Errorf("invalid nat argument (expected an IPv4 address or $SRC_IP): %s", actionArg)
 		}
 		filter.actionArg = actionArg
 	case "forward":
@@ -434,52 +1167,293 @@ func processFilterLine(f []string, newConfig *trapexConfig, lineNumber int) erro
 		} else {
 			filter.actionType = actionForward
 		}
-		forwarder := trapForwarder{}
-		if err := forwarder.initAction(actionArg); err != nil {
-			return err
-		}
-		filter.action = &forwarder
+		return newConfig.shareAction(filter, action, actionArg, actionOpts, func() (interface{}, error) {
+			forwarder := trapForwarder{}
+			return &forwarder, forwarder.initAction(actionArg, actionOpts, newConfig)
+		})
 	case "log":
 		if breakAfter {
 			filter.actionType = actionLogBreak
 		} else {
 			filter.actionType = actionLog
 		}
-		logger := trapLogger{}
-		if err := logger.initAction(actionArg, newConfig); err != nil {
-			return err
-		}
-		filter.action = &logger
+		return newConfig.shareAction(filter, action, actionArg, actionOpts, func() (interface{}, error) {
+			logger := trapLogger{}
+			return &logger, logger.initAction(actionArg, newConfig)
+		})
 	case "csv":
 		if breakAfter {
 			filter.actionType = actionCsvBreak
 		} else {
 			filter.actionType = actionCsv
 		}
-		csvLogger := trapCsvLogger{}
-		if err := csvLogger.initAction(actionArg, newConfig); err != nil {
-			return err
+		return newConfig.shareAction(filter, action, actionArg, actionOpts, func() (interface{}, error) {
+			csvLogger := trapCsvLogger{}
+			return &csvLogger, csvLogger.initAction(actionArg, newConfig)
+		})
+	case "json":
+		if breakAfter {
+			filter.actionType = actionJsonBreak
+		} else {
+			filter.actionType = actionJson
+		}
+		return newConfig.shareAction(filter, action, actionArg, actionOpts, func() (interface{}, error) {
+			jsonLogger := trapJsonLogger{}
+			return &jsonLogger, jsonLogger.initAction(actionArg, newConfig)
+		})
+	case "syslog":
+		if breakAfter {
+			filter.actionType = actionSyslogBreak
+		} else {
+			filter.actionType = actionSyslog
 		}
-		filter.action = &csvLogger
+		return newConfig.shareAction(filter, action, actionArg, actionOpts, func() (interface{}, error) {
+			syslogDest := trapSyslog{}
+			return &syslogDest, syslogDest.initAction(actionArg, newConfig)
+		})
+	case "webhook":
+		if breakAfter {
+			filter.actionType = actionWebhookBreak
+		} else {
+			filter.actionType = actionWebhook
+		}
+		return newConfig.shareAction(filter, action, actionArg, actionOpts, func() (interface{}, error) {
+			webhook := trapWebhook{}
+			return &webhook, webhook.initAction(actionArg, newConfig)
+		})
+	case "clickhouse":
+		if breakAfter {
+			filter.actionType = actionClickhouseBreak
+		} else {
+			filter.actionType = actionClickhouse
+		}
+		return newConfig.shareAction(filter, action, actionArg, actionOpts, func() (interface{}, error) {
+			clickhouse := trapClickhouse{}
+			return &clickhouse, clickhouse.initAction(actionArg, newConfig)
+		})
+	case "jump", "goto":
+		if action == "jump" {
+			filter.actionType = actionJump
+		} else {
+			filter.actionType = actionGoto
+		}
+		chain, ok := newConfig.chains[actionArg]
+		if !ok {
+			return fmt.Errorf("unknown filter chain for %s action: '%s'", action, actionArg)
+		}
+		filter.actionArg = actionArg
+		filter.action = chain
+	case "return":
+		filter.actionType = actionReturn
 	default:
-		return fmt.Errorf("unknown action: %s at line %v", action, lineNumber)
+		return fmt.Errorf("unknown action: %s", action)
+	}
+	return nil
+}
+
+// shareAction sets the action instance (and worker) of a filter. Filters
+// with the same action, argument, options, and settings share an instance,
+// and a reload keeps the running configuration's instance when none of
+// these have changed, so its queued traps are neither dropped nor
+// reordered. Otherwise, the instance is created by init.
+//
+func (c *trapexConfig) shareAction(filter *trapexFilter, action string, arg string, opts []string, init func() (interface{}, error)) error {
+	if c.checkOnly {
+		return checkAction(action, arg, opts, c)
 	}
+	key := c.actionKey(action, arg, opts)
+	shared, ok := c.actions[key]
+	if !ok {
+		if shared, ok = c.previousActions[key]; ok {
+			logger.Info().Str("action", action).Str("argument", arg).Msg("Keeping action destination")
+		} else {
+			a, err := init()
+			if err != nil {
+				return err
+			}
+			shared = &sharedAction{action: a}
+			// Actions that write to a destination inline get their own
+			// worker.
+			switch a.(type) {
+			case *trapForwarder, *trapLogger, *trapCsvLogger, *trapJsonLogger, *trapSyslog:
+				shared.worker = newActionWorker(arg, a, c)
+			}
+		}
+		if c.actions == nil {
+			c.actions = make(map[string]*sharedAction)
+		}
+		c.actions[key] = shared
+	}
+	filter.action = shared.action
+	filter.worker = shared.worker
+	return nil
+}
 
-	newConfig.filters = append(newConfig.filters, filter)
+// actionKey identifies an action instance by the action, its argument and
+// options, and the settings it is created with.
+//
+func (c *trapexConfig) actionKey(action string, arg string, opts []string) string {
+	settings := []interface{}{action, arg, opts}
+	switch action {
+	case "forward":
+		// The snmpv3 section is only used by v3 forwards without an
+		// snmpv3_destinations entry (the last version option wins).
+		var v3, namedV3 bool
+		for _, opt := range opts {
+			switch strings.ToLower(opt) {
+			case "v1", "1", "v2c", "2c", "2":
+				v3 = false
+			case "v3", "3":
+				v3 = true
+			}
+			if strings.HasPrefix(opt, "v3:") {
+				v3, namedV3 = true, true
+				settings = append(settings, c.v3Destinations[opt[3:]])
+			} else if strings.HasPrefix(opt, "queue:") {
+				settings = append(settings, c.forwardQueues[opt[6:]])
+			}
+		}
+		if v3 && !namedV3 {
+			settings = append(settings, c.V3Params)
+		}
+	case "log", "csv", "json":
+		settings = append(settings, c.Logging.LogMaxSize, c.Logging.LogMaxBackups, c.Logging.LogMaxAge, c.Logging.LogCompress)
+	case "syslog":
+		settings = append(settings, c.syslogDestinations[arg])
+	case "webhook":
+		settings = append(settings, c.webhookDestinations[arg])
+	case "clickhouse":
+		settings = append(settings, c.clickhouseDestinations[arg])
+	}
+	settings = append(settings, c.General.ActionQueueSize, c.General.ActionQueueOverflow)
+	// Only the settings from the configuration file are marshaled.
+	key, _ := yaml.Marshal(settings)
+	return string(key)
+}
 
+// processFilterCriteria parses one of the optional named filter criteria
+// that can follow the six positional fields of a filter line (as
+// "name=value"), or be set by name in the structured filter form.
+//
+func processFilterCriteria(name string, fv filterValues, newConfig *trapexConfig) (filterObj, error) {
+	switch strings.ToLower(name) {
+	case "v3_user":
+		return makeFilterObj(v3User, fv, false, func(v string) (filterObj, error) {
+			fObj := filterObj{filterItem: v3User}
+			return fObj, setStringCriteria(&fObj, v)
+		})
+	case "community":
+		return makeFilterObj(community, fv, false, func(v string) (filterObj, error) {
+			fObj := filterObj{filterItem: community}
+			if strings.HasPrefix(v, "communityset:") {
+				// The sets are loaded before the filters, so the name can
+				// be checked here.
+				fObj.filterType = parseTypeSet
+				fObj.filterValue = v[13:]
+				if _, ok := newConfig.communitySets[v[13:]]; !ok {
+					return fObj, fmt.Errorf("invalid community set name specified: %s", v)
+				}
+				return fObj, nil
+			}
+			return fObj, setStringCriteria(&fObj, v)
+		})
+	case "trap_oid":
+		return makeFilterObj(trapOID, fv, false, func(v string) (filterObj, error) {
+			om, err := newOIDMatch(v, newConfig.mibs)
+			return filterObj{filterItem: trapOID, filterType: om.oidType, filterValue: &om}, err
+		})
+	case "varbind", "no_varbind":
+		// Varbind values have their own operators and regexes, so there
+		// are no "|" alternatives (but "!" works, same as no_varbind).
+		absent := strings.ToLower(name) == "no_varbind"
+		return makeFilterObj(varbind, fv, true, func(v string) (filterObj, error) {
+			vm, err := parseVarbindCriteria(v, absent, newConfig.mibs)
+			return filterObj{filterItem: varbind, filterValue: vm}, err
+		})
+	default:
+		return filterObj{}, fmt.Errorf("unknown filter criteria: %s", name)
+	}
+}
+
+// setStringCriteria sets a filterObj to match a string value exactly, or
+// as a regular expression if the value starts with a "/".
+//
+func setStringCriteria(fObj *filterObj, value string) error {
+	var err error
+	if strings.HasPrefix(value, "/") {
+		fObj.filterType = parseTypeRegex
+		fObj.filterValue, err = regexp.Compile(value[1:])
+		return err
+	}
+	fObj.filterType = parseTypeString
+	fObj.filterValue = value
 	return nil
 }
 
+// allFilters returns the filters from the main filters list and all of the
+// chains.
+//
+func (c *trapexConfig) allFilters() []trapexFilter {
+	filters := c.filters
+	for _, chain := range c.chains {
+		filters = append(filters[:len(filters):len(filters)], chain.filters...)
+	}
+	return filters
+}
+
+// chainNames returns the names of the filter chains in order.
+//
+func (c *trapexConfig) chainNames() []string {
+	names := make([]string, 0, len(c.chains))
+	for name := range c.chains {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// closeTrapexHandles closes all of the action handles of the running
+// configuration.
+//
 func closeTrapexHandles() {
-	for _, f := range teConfig.filters {
-		if f.actionType == actionForward || f.actionType == actionForwardBreak {
-			f.action.(*trapForwarder).close()
+	closeActions(teConfig, nil)
+}
+
+// closeActions closes the action instances of a configuration that are not
+// used by the keep configuration (if any). The workers finish with their
+// queued traps first.
+//
+func closeActions(c *trapexConfig, keep *trapexConfig) {
+	if c == nil {
+		return
+	}
+	var closing []*sharedAction
+	for key, shared := range c.actions {
+		if keep == nil || keep.actions[key] != shared {
+			closing = append(closing, shared)
 		}
-		if f.actionType == actionLog || f.actionType == actionLogBreak {
-			f.action.(*trapLogger).close()
+	}
+	for _, shared := range closing {
+		if shared.worker != nil {
+			shared.worker.close()
 		}
-		if f.actionType == actionCsv || f.actionType == actionCsvBreak {
-			f.action.(*trapCsvLogger).close()
+	}
+	for _, shared := range closing {
+		switch a := shared.action.(type) {
+		case *trapForwarder:
+			a.close()
+		case *trapLogger:
+			a.close()
+		case *trapCsvLogger:
+			a.close()
+		case *trapJsonLogger:
+			a.close()
+		case *trapSyslog:
+			a.close()
+		case *trapWebhook:
+			a.close()
+		case *trapClickhouse:
+			a.close()
 		}
 	}
 }
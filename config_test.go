@@ -6,7 +6,16 @@
 package main
 
 import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"sync/atomic"
 	"testing"
+
+	g "github.com/gosnmp/gosnmp"
 )
 
 func TestGeneralSection(t *testing.T) {
@@ -137,7 +146,7 @@ func TestFiltersGood(t *testing.T) {
 
 	var numfilters = len(testConfig.RawFilters)
 	if numfilters != 11 {
-		t.Errorf("filters are missing entries (expected 11): %s", testConfig.RawFilters)
+		t.Errorf("filters are missing entries (expected 11): %v", testConfig.RawFilters)
 	}
 
 	var err error
@@ -171,3 +180,697 @@ func TestFiltersMissingIpSet(t *testing.T) {
     }
 }
 */
+
+func TestFiltersForwardVersions(t *testing.T) {
+	var testConfig trapexConfig
+	loadConfig("tests/config/filters_forward_versions.yml", &testConfig)
+
+	var err error
+	if err = validateSnmpV3Args(&testConfig); err != nil {
+		t.Fatalf("%s", err)
+	}
+	if err = processFilters(&testConfig); err != nil {
+		t.Fatalf("%s", err)
+	}
+	expected := []g.SnmpVersion{g.Version1, g.Version1, g.Version2c, g.Version3}
+	for i, f := range testConfig.filters {
+		if v := f.action.(*trapForwarder).destination.Version; v != expected[i] {
+			t.Errorf("forward destination %d has version %s (expected %s)", i, v, expected[i])
+		}
+	}
+	if testConfig.filters[3].actionType != actionForwardBreak {
+		t.Errorf("forward with version and break did not set the break action")
+	}
+
+	loadConfig("tests/config/filters_forward_bad_version.yml", &testConfig)
+	if err = processFilters(&testConfig); err == nil {
+		t.Errorf("Should have detected an invalid forward version")
+	}
+}
+
+func TestSnmpv3Destinations(t *testing.T) {
+	var testConfig trapexConfig
+	loadConfig("tests/config/snmpv3_destinations.yml", &testConfig)
+
+	var err error
+	if err = processV3Destinations(&testConfig); err != nil {
+		t.Fatalf("%s", err)
+	}
+	if len(testConfig.v3Destinations) != 2 {
+		t.Errorf("Have different number of expected v3 destinations (expected 2, got %d)", len(testConfig.v3Destinations))
+	}
+	core := testConfig.v3Destinations["core_nms"]
+	if core == nil || core.msgFlags != g.AuthPriv || core.authProto != g.SHA || core.privacyProto != g.AES {
+		t.Fatalf("core_nms v3 destination is not set correctly: %+v", core)
+	}
+	if len(core.engineID) != 13 {
+		t.Errorf("core_nms engine ID is not set correctly: %x", core.engineID)
+	}
+	if lab := testConfig.v3Destinations["lab_nms"]; lab == nil || lab.msgFlags != g.NoAuthNoPriv {
+		t.Errorf("lab_nms v3 destination defaults are not set correctly: %+v", lab)
+	}
+
+	if err = processFilters(&testConfig); err != nil {
+		t.Fatalf("%s", err)
+	}
+	dest := testConfig.filters[0].action.(*trapForwarder).destination
+	if dest.Version != g.Version3 || dest.SecurityParameters.(*g.UsmSecurityParameters).UserName != "trapex_core" || dest.ContextName != "traps" {
+		t.Errorf("forward destination does not use the core_nms v3 params: %+v", dest)
+	}
+}
+
+func TestSnmpv3DestinationsBad(t *testing.T) {
+	var testConfig trapexConfig
+	loadConfig("tests/config/snmpv3_destinations_bad.yml", &testConfig)
+
+	if err := processV3Destinations(&testConfig); err == nil {
+		t.Errorf("Should have detected a missing privacy protocol for AuthPriv")
+	}
+	if err := processFilters(&testConfig); err == nil {
+		t.Errorf("Should have detected an unknown v3 destination")
+	}
+}
+
+func TestSnmpv3Users(t *testing.T) {
+	var testConfig trapexConfig
+	loadConfig("tests/config/snmpv3_users.yml", &testConfig)
+
+	var err error
+	if err = validateSnmpV3Args(&testConfig); err != nil {
+		t.Fatalf("%s", err)
+	}
+	if err = processV3Users(&testConfig); err != nil {
+		t.Fatalf("%s", err)
+	}
+	if len(testConfig.v3Users["router_user"]) != 2 || len(testConfig.v3Users["lab_user"]) != 1 {
+		t.Errorf("v3 users table is not set correctly: %v", testConfig.v3Users)
+	}
+	if testConfig.V3Params.receiver == nil {
+		t.Errorf("snmpv3 section receiver params were not set")
+	}
+	for _, user := range testConfig.V3Users {
+		if user.receiver == nil || user.receiver.MsgFlags != user.msgFlags {
+			t.Errorf("receiver params for %s are not set correctly", user.Username)
+		}
+	}
+
+	if err = processFilters(&testConfig); err != nil {
+		t.Fatalf("%s", err)
+	}
+	if testConfig.filters[0].matchAll || len(testConfig.filters[0].filterItems) != 2 {
+		t.Errorf("v3_user criteria was not added to the filter: %+v", testConfig.filters[0])
+	}
+}
+
+func TestFiltersBadCriteria(t *testing.T) {
+	var testConfig trapexConfig
+	if _, err := processFilterLine([]string{"*", "*", "*", "*", "*", "*", "bogus=1", "break"}, &testConfig, 0); err == nil {
+		t.Errorf("Should have detected an unknown filter criteria")
+	}
+	if _, err := processFilterLine([]string{"*", "*", "*", "*", "*", "*", "v3_user=/[", "break"}, &testConfig, 0); err == nil {
+		t.Errorf("Should have detected an invalid v3_user regex")
+	}
+	if _, err := processFilterLine([]string{"*", "*", "*", "*", "*", "*", "v3_user=bob"}, &testConfig, 0); err == nil {
+		t.Errorf("Should have detected a missing action")
+	}
+}
+
+func TestInforms(t *testing.T) {
+	var testConfig trapexConfig
+	loadConfig("tests/config/informs.yml", &testConfig)
+
+	if err := validateInformResponse(&testConfig); err != nil || !testConfig.General.informResponseFirst {
+		t.Errorf("general:inform_response is not set correctly: %s", testConfig.General.InformResponse)
+	}
+	if f, err := processFilterLine(strings.Fields(testConfig.RawFilters[0].line), &testConfig, 0); err != nil {
+		t.Errorf("%s", err)
+	} else if !f.action.(*trapForwarder).inform {
+		t.Errorf("inform option was not set for the forward destination")
+	}
+	if _, err := processFilterLine(strings.Fields(testConfig.RawFilters[1].line), &testConfig, 1); err == nil {
+		t.Errorf("Should have detected the inform option on a v1 destination")
+	}
+
+	testConfig.General.InformResponse = "sometime"
+	if err := validateInformResponse(&testConfig); err == nil {
+		t.Errorf("general:inform_response did not detect an invalid value")
+	}
+}
+
+func TestIpv6(t *testing.T) {
+	var testConfig trapexConfig
+	loadConfig("tests/config/ipv6.yml", &testConfig)
+
+	var err error
+	if err = processIpSets(&testConfig); err != nil {
+		t.Fatalf("%s", err)
+	}
+	if !testConfig.ipSets["v6hosts"]["2001:db8::20"] {
+		t.Errorf("IPv6 addresses in ipsets are not stored in canonical form: %v", testConfig.ipSets["v6hosts"])
+	}
+	if err = processFilters(&testConfig); err != nil {
+		t.Fatalf("%s", err)
+	}
+	if dest := testConfig.filters[1].action.(*trapForwarder).destination; dest.Target != "2001:db8::99" || dest.Port != 162 {
+		t.Errorf("IPv6 forward destination is not set correctly: %s port %d", dest.Target, dest.Port)
+	}
+
+	teConfig = &testConfig
+	matches := []struct {
+		srcIP  string
+		filter int
+		match  bool
+	}{
+		{"2001:db8::20", 0, true},
+		{"2001:db8::21", 0, false},
+		{"10.1.3.4", 0, true},
+		{"2001:db8:1:2::5", 1, true},
+		{"2001:db8:2::5", 1, false},
+		{"2001:db8::30", 2, true},
+	}
+	for _, m := range matches {
+		sgt := sgTrap{srcIP: net.ParseIP(m.srcIP)}
+		if testConfig.filters[m.filter].isFilterMatch(&sgt) != m.match {
+			t.Errorf("filter %d match for %s should be %t", m.filter, m.srcIP, m.match)
+		}
+	}
+
+	// An IPv6 source can't be set as the v1 agent address
+	sgt := sgTrap{srcIP: net.ParseIP("2001:db8::40"), data: g.SnmpTrap{AgentAddress: "10.2.2.2"}}
+	testConfig.filters[3].processAction(&sgt)
+	if sgt.data.AgentAddress != "10.2.2.2" || sgt.natAddress != "" {
+		t.Errorf("nat $SRC_IP set an IPv6 agent address: %s %s", sgt.data.AgentAddress, sgt.natAddress)
+	}
+
+	if _, err = processFilterLine(strings.Fields("* * * * * * nat 2001:db8::1"), &testConfig, 0); err == nil {
+		t.Errorf("Should have detected an IPv6 nat address")
+	}
+	if csvIPAddress(net.ParseIP("10.1.2.3")) != "::ffff:10.1.2.3" || csvIPAddress(net.ParseIP("2001:db8::1")) != "2001:db8::1" {
+		t.Errorf("CSV IP addresses are not in IPv6 form")
+	}
+}
+
+func TestFiltersStructured(t *testing.T) {
+	var testConfig trapexConfig
+	if err := loadConfig("tests/config/filters_structured.yml", &testConfig); err != nil {
+		t.Fatalf("%s", err)
+	}
+	if err := processFilters(&testConfig); err != nil {
+		t.Fatalf("%s", err)
+	}
+	if len(testConfig.filters) != 5 {
+		t.Fatalf("processed filters are missing entries (expected 5): %d", len(testConfig.filters))
+	}
+	if f := testConfig.filters[1]; f.name != "drop-sysedge" || f.matchAll || f.actionType != actionBreak || len(f.filterItems) != 1 {
+		t.Errorf("drop-sysedge filter was not set up correctly")
+	}
+	if f := testConfig.filters[2]; f.actionType != actionForwardBreak || f.action.(*trapForwarder).destination.Version != g.Version2c {
+		t.Errorf("forward-v2c filter was not set up correctly")
+	}
+	if f := testConfig.filters[3]; len(f.filterItems) != 2 || f.action.(*trapForwarder).destination.Version != g.Version3 {
+		t.Errorf("routers filter was not set up correctly")
+	}
+	if !testConfig.filters[4].matchAll {
+		t.Errorf("filter line after structured filters was not set up correctly")
+	}
+}
+
+func TestFiltersStructuredBad(t *testing.T) {
+	var testConfig trapexConfig
+	err := loadConfig("tests/config/filters_structured_bad_key.yml", &testConfig)
+	if err == nil || !strings.Contains(err.Error(), "sourceip") {
+		t.Errorf("Should have reported the unknown filter key: %v", err)
+	}
+
+	testConfig = trapexConfig{}
+	if err := loadConfig("tests/config/filters_structured_bad_value.yml", &testConfig); err != nil {
+		t.Fatalf("%s", err)
+	}
+	err = processFilters(&testConfig)
+	if err == nil || !strings.Contains(err.Error(), "filter 1 (bad-generic): invalid value for generic") {
+		t.Errorf("Should have reported the invalid generic value: %v", err)
+	}
+}
+
+func TestFiltersCriteriaOrder(t *testing.T) {
+	// With several bad criteria, the first one (in a fixed order) is the
+	// one reported.
+	ff := filterFields{
+		TrapOID:   filterValues{values: []string{"IF-MIB::linkDown"}},
+		Community: filterValues{values: []string{"communityset:missing"}},
+		Action:    "break",
+	}
+	for i := 0; i < 20; i++ {
+		_, err := processFilterFields(&ff, &trapexConfig{}, 1)
+		if err == nil || !strings.Contains(err.Error(), "invalid value for trap_oid") {
+			t.Fatalf("Should have reported the trap_oid value: %v", err)
+		}
+	}
+}
+
+func TestFiltersVarbinds(t *testing.T) {
+	var testConfig trapexConfig
+	if err := loadConfig("tests/config/filters_varbinds.yml", &testConfig); err != nil {
+		t.Fatalf("%s", err)
+	}
+	if err := processFilters(&testConfig); err != nil {
+		t.Fatalf("%s", err)
+	}
+	trap := sgTrap{origVars: varbindTestVars}
+	for i, want := range []bool{true, false, true} {
+		f := testConfig.filters[i]
+		if f.matchAll {
+			t.Errorf("varbind filter %v should not match everything", i)
+		}
+		if got := f.isFilterMatch(&trap); got != want {
+			t.Errorf("varbind filter %v: got %v, want %v", i, got, want)
+		}
+	}
+
+	if _, err := processFilterLine(strings.Fields("* * * * * * varbind=1.3.6.1.2.1.2.2.1.1.*>x break"), &testConfig, 0); err == nil {
+		t.Errorf("Should have detected an invalid varbind comparison")
+	}
+}
+
+func TestFilterChains(t *testing.T) {
+	var testConfig trapexConfig
+	if err := loadConfig("tests/config/filters_chains.yml", &testConfig); err != nil {
+		t.Fatalf("%s", err)
+	}
+	if err := processFilters(&testConfig); err != nil {
+		t.Fatalf("%s", err)
+	}
+	if len(testConfig.allFilters()) != 9 {
+		t.Errorf("filters are missing from chains (expected 9): %d", len(testConfig.allFilters()))
+	}
+	tests := []struct {
+		agent   string
+		want    string
+		dropped bool
+	}{
+		{"10.0.0.3", "10.0.0.2", false},  // jump, nat in chain, nat after the jump
+		{"10.0.0.5", "10.0.0.5", false},  // return from the chain
+		{"10.0.0.9", "10.0.0.10", false}, // goto does not come back
+		{"10.0.0.4", "10.0.0.4", true},   // break in a nested chain
+	}
+	for _, tt := range tests {
+		sgt := sgTrap{data: g.SnmpTrap{AgentAddress: tt.agent}}
+		processFilterChain(testConfig.filters, &sgt)
+		if sgt.data.AgentAddress != tt.want || sgt.dropped != tt.dropped {
+			t.Errorf("agent %s: got %s (dropped %v), want %s (dropped %v)", tt.agent, sgt.data.AgentAddress, sgt.dropped, tt.want, tt.dropped)
+		}
+	}
+}
+
+func TestFilterChainsBad(t *testing.T) {
+	var testConfig trapexConfig
+	if err := loadConfig("tests/config/filters_chains_loop.yml", &testConfig); err != nil {
+		t.Fatalf("%s", err)
+	}
+	err := processFilters(&testConfig)
+	if err == nil || !strings.Contains(err.Error(), "filter chain loop") {
+		t.Errorf("Should have detected a filter chain loop: %v", err)
+	}
+
+	if _, err = processFilterLine(strings.Fields("* * * * * * jump nowhere"), &testConfig, 0); err == nil {
+		t.Errorf("Should have detected an unknown filter chain")
+	}
+}
+
+func TestFiltersNegation(t *testing.T) {
+	var testConfig trapexConfig
+	if err := loadConfig("tests/config/filters_negation.yml", &testConfig); err != nil {
+		t.Fatalf("%s", err)
+	}
+	if err := processIpSets(&testConfig); err != nil {
+		t.Fatalf("%s", err)
+	}
+	if err := processFilters(&testConfig); err != nil {
+		t.Fatalf("%s", err)
+	}
+	teConfig = &testConfig
+
+	trap := func(ver g.SnmpVersion, src string, generic int, specific int, ent string, user string) *sgTrap {
+		return &sgTrap{
+			trapVer: ver,
+			srcIP:   net.ParseIP(src),
+			v3User:  user,
+			data:    g.SnmpTrap{GenericTrap: generic, SpecificTrap: specific, Enterprise: ent},
+		}
+	}
+	matches := []struct {
+		filter int
+		trap   *sgTrap
+		match  bool
+	}{
+		{0, trap(g.Version1, "192.168.1.1", 0, 0, "", ""), true},
+		{0, trap(g.Version1, "10.1.2.3", 0, 0, "", ""), false},
+		{1, trap(g.Version2c, "10.1.2.3", 0, 0, "", ""), true},
+		{1, trap(g.Version3, "10.1.2.3", 0, 0, "", ""), true},
+		{1, trap(g.Version1, "10.1.2.3", 0, 0, "", ""), false},
+		{2, trap(g.Version1, "10.1.2.3", 2, 0, "", ""), true},
+		{2, trap(g.Version1, "10.1.2.3", 1, 0, "", ""), false},
+		{3, trap(g.Version1, "10.1.1.1", 0, 0, "", ""), true},
+		{3, trap(g.Version1, "10.2.7.7", 0, 0, "", ""), true},
+		{3, trap(g.Version1, "10.9.9.9", 0, 0, "", ""), true},
+		{3, trap(g.Version1, "10.3.1.1", 0, 0, "", ""), false},
+		{4, trap(g.Version3, "10.2.1.1", 6, 1, ".1.3.6.1.4.1.2636.1", "noc"), true},
+		{4, trap(g.Version3, "10.1.1.1", 6, 1, ".1.3.6.1.4.1.2636.1", "noc"), false},
+		{4, trap(g.Version3, "10.2.1.1", 6, 1, ".1.3.6.1.4.1.546.1", "noc"), false},
+		{4, trap(g.Version3, "10.2.1.1", 6, 1, ".1.3.6.1.4.1.2636.1", "ops"), false},
+		{4, trap(g.Version1, "10.2.1.1", 6, 1, ".1.3.6.1.4.1.2636.1", ""), false},
+		{5, trap(g.Version2c, "10.2.1.1", 0, 0, "", ""), true},
+		{5, trap(g.Version2c, "10.9.9.9", 0, 0, "", ""), false},
+		{6, trap(g.Version3, "192.168.1.1", 3, 1, "", "noc-2"), true},
+		{6, trap(g.Version3, "192.168.1.1", 3, 7, "", "noc-2"), false},
+		{6, trap(g.Version3, "192.168.1.1", 4, 1, "", "ops"), false},
+		{6, trap(g.Version3, "10.9.9.9", 2, 1, "", "ops"), false},
+		{6, trap(g.Version3, "192.168.1.1", 2, 1, "", "bob"), false},
+	}
+	for i, m := range matches {
+		if testConfig.filters[m.filter].isFilterMatch(m.trap) != m.match {
+			t.Errorf("match %d: filter %d match should be %t", i, m.filter, m.match)
+		}
+	}
+
+	for _, line := range []string{
+		"* !* * * * * break",
+		"* 10.1.1.1||10.2.2.2 * * * * break",
+		"* * * 1|x * * break",
+		"!v4 * * * * * break",
+	} {
+		if _, err := processFilterLine(strings.Fields(line), &testConfig, 0); err == nil {
+			t.Errorf("Should have detected a bad negated or alternative value: %s", line)
+		}
+	}
+}
+
+func TestFiltersIntRanges(t *testing.T) {
+	var testConfig trapexConfig
+	tests := []struct {
+		line     string
+		specific int
+		match    bool
+	}{
+		{"* * * * 3:10 * break", 3, true},
+		{"* * * * 3:10 * break", 10, true},
+		{"* * * * 3:10 * break", 11, false},
+		{"* * * * 1,4,7 * break", 4, true},
+		{"* * * * 1,4,7 * break", 5, false},
+		{"* * * * >100 * break", 101, true},
+		{"* * * * >100 * break", 100, false},
+		{"* * * * >=100 * break", 100, true},
+		{"* * * * <5 * break", 4, true},
+		{"* * * * <=5 * break", 6, false},
+		{"* * * * 1,20:30,>1000 * break", 25, true},
+		{"* * * * 1,20:30,>1000 * break", 999, false},
+		{"* * * * !3:10 * break", 11, true},
+		{"* * * * 1:2|8:9 * break", 9, true},
+	}
+	for _, tt := range tests {
+		f, err := processFilterLine(strings.Fields(tt.line), &testConfig, 0)
+		if err != nil {
+			t.Errorf("%s: %s", tt.line, err)
+			continue
+		}
+		sgt := sgTrap{data: g.SnmpTrap{SpecificTrap: tt.specific}}
+		if f.isFilterMatch(&sgt) != tt.match {
+			t.Errorf("%s: match for specific type %d should be %t", tt.line, tt.specific, tt.match)
+		}
+	}
+
+	if f, err := processFilterLine(strings.Fields("* * * 2:3 * * break"), &testConfig, 0); err != nil {
+		t.Errorf("%s", err)
+	} else if sgt := (sgTrap{data: g.SnmpTrap{GenericTrap: 3}}); !f.isFilterMatch(&sgt) {
+		t.Errorf("generic type range did not match")
+	}
+
+	for _, line := range []string{
+		"* * * * 10:3 * break",
+		"* * * * 3: * break",
+		"* * * * 1,,2 * break",
+		"* * * * >x * break",
+	} {
+		if _, err := processFilterLine(strings.Fields(line), &testConfig, 0); err == nil {
+			t.Errorf("Should have detected a bad integer range: %s", line)
+		}
+	}
+}
+
+func TestFiltersTrapOID(t *testing.T) {
+	var testConfig trapexConfig
+	tests := []struct {
+		line    string
+		trapOID string
+		match   bool
+	}{
+		{"* * * * * * trap_oid=1.3.6.1.6.3.1.1.5.3 break", ".1.3.6.1.6.3.1.1.5.3", true},
+		{"* * * * * * trap_oid=.1.3.6.1.6.3.1.1.5.3 break", ".1.3.6.1.6.3.1.1.5.4", false},
+		{"* * * * * * trap_oid=1.3.6.1.4.1.9.9.41.* break", ".1.3.6.1.4.1.9.9.41.2.0.1", true},
+		{"* * * * * * trap_oid=1.3.6.1.4.1.9.9.41.* break", ".1.3.6.1.4.1.9.9.43.2.0.1", false},
+		{"* * * * * * trap_oid=/\\.0\\.1$ break", ".1.3.6.1.4.1.9.9.41.2.0.1", true},
+		{"* * * * * * trap_oid=1.3.6.1.6.3.1.1.5.3|1.3.6.1.6.3.1.1.5.4 break", ".1.3.6.1.6.3.1.1.5.4", true},
+		{"* * * * * * trap_oid=!1.3.6.1.6.3.1.1.5.* break", ".1.3.6.1.4.1.9.9.41.2.0.1", true},
+	}
+	for _, tt := range tests {
+		f, err := processFilterLine(strings.Fields(tt.line), &testConfig, 0)
+		if err != nil {
+			t.Errorf("%s: %s", tt.line, err)
+			continue
+		}
+		sgt := sgTrap{trapOID: tt.trapOID}
+		if f.isFilterMatch(&sgt) != tt.match {
+			t.Errorf("%s: match for %s should be %t", tt.line, tt.trapOID, tt.match)
+		}
+	}
+
+	// v1 traps get the RFC 3584 form of the trap OID.
+	f, err := processFilterLine(strings.Fields("* * * * * * trap_oid=1.3.6.1.4.1.8072.3.2.10.0.17 break"), &testConfig, 0)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	sgt := v1TestTrap(6, 17)
+	sgt.trapOID = v1TrapOID(&sgt.data)
+	if !f.isFilterMatch(sgt) {
+		t.Errorf("trap_oid did not match the RFC 3584 trap OID of a v1 trap: %s", sgt.trapOID)
+	}
+
+	if _, err = processFilterLine(strings.Fields("* * * * * * trap_oid=1.3.x break"), &testConfig, 0); err == nil {
+		t.Errorf("Should have detected an invalid trap_oid")
+	}
+}
+
+func TestCommunities(t *testing.T) {
+	var testConfig trapexConfig
+	if err := loadConfig("tests/config/communities.yml", &testConfig); err != nil {
+		t.Fatalf("%s", err)
+	}
+	if err := processCommunitySets(&testConfig); err != nil {
+		t.Fatalf("%s", err)
+	}
+	for community, allowed := range map[string]bool{"public": true, "noc": true, "netops": true, "private": false, "": false} {
+		p := g.SnmpPacket{Version: g.Version2c, Community: community}
+		if testConfig.isAllowedCommunity(&p) != allowed {
+			t.Errorf("community %s should be allowed: %t", community, allowed)
+		}
+	}
+	if !testConfig.isAllowedCommunity(&g.SnmpPacket{Version: g.Version3}) {
+		t.Errorf("v3 traps should not be checked against the allowed communities")
+	}
+
+	if err := processFilters(&testConfig); err != nil {
+		t.Fatalf("%s", err)
+	}
+	if dest := testConfig.filters[0].action.(*trapForwarder).destination; dest.Community != "fwd-public" {
+		t.Errorf("community for forward destination not set: '%s'", dest.Community)
+	}
+	teConfig = &testConfig
+	matches := []struct {
+		filter    int
+		community string
+		match     bool
+	}{
+		{0, "public", true},
+		{0, "private", false},
+		{1, "netops", true},
+		{1, "lab-3", true},
+		{1, "public", false},
+		{2, "public", false},
+		{2, "noc", true},
+	}
+	for _, m := range matches {
+		sgt := sgTrap{community: m.community}
+		if testConfig.filters[m.filter].isFilterMatch(&sgt) != m.match {
+			t.Errorf("filter %d match for community %s should be %t", m.filter, m.community, m.match)
+		}
+	}
+
+	if _, err := processFilterLine(strings.Fields("* * * * * * community=communityset:nope break"), &testConfig, 0); err == nil {
+		t.Errorf("Should have detected an unknown community set")
+	}
+	testConfig.General.AllowedCommunities = []string{"communityset:nope"}
+	if err := processCommunitySets(&testConfig); err == nil {
+		t.Errorf("Should have detected an unknown community set in allowed_communities")
+	}
+}
+
+func TestJsonAction(t *testing.T) {
+	var testConfig trapexConfig
+	os.Remove("tests/tmp/traps.json")
+	if err := loadConfig("tests/config/filters_json.yml", &testConfig); err != nil {
+		t.Fatalf("%s", err)
+	}
+	if err := processFilters(&testConfig); err != nil {
+		t.Fatalf("%s", err)
+	}
+	if testConfig.filters[0].actionType != actionJsonBreak {
+		t.Errorf("json action with break not set: %v", testConfig.filters[0].actionType)
+	}
+	teConfig = &testConfig
+	sgt := sgTrap{
+		trapVer:    g.Version2c,
+		srcIP:      net.ParseIP("192.168.1.10"),
+		trapOID:    ".1.3.6.1.6.3.1.1.5.3",
+		translated: true,
+		data: g.SnmpTrap{
+			AgentAddress: "192.168.1.10",
+			Enterprise:   ".1.3.6.1.6.3.1.1.5",
+			GenericTrap:  2,
+			Variables: []g.SnmpPDU{
+				{Name: ".1.3.6.1.2.1.2.2.1.1.3", Type: g.Integer, Value: 3},
+				{Name: ".1.3.6.1.2.1.2.2.1.2.3", Type: g.OctetString, Value: []byte("eth0")},
+				{Name: ".1.3.6.1.2.1.2.2.1.6.3", Type: g.OctetString, Value: []byte{0, 0x1b, 0x2c, 0xff, 0, 1}},
+			},
+		},
+	}
+	processTrap(&sgt)
+	if !sgt.dropped {
+		t.Errorf("trap should be dropped after json break")
+	}
+	closeTrapexHandles()
+
+	data, err := ioutil.ReadFile("tests/tmp/traps.json")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("expected 1 JSON line, got %d: %s", len(lines), data)
+	}
+	var entry trapJsonEntry
+	if err := json.Unmarshal([]byte(lines[0]), &entry); err != nil {
+		t.Fatalf("invalid JSON entry: %s: %s", err, lines[0])
+	}
+	if entry.SourceIP != "192.168.1.10" || entry.Version != "v2c" || !entry.Translated || entry.GenericTrap != 2 ||
+		entry.Enterprise != "1.3.6.1.6.3.1.1.5" || entry.TrapOID != "1.3.6.1.6.3.1.1.5.3" {
+		t.Errorf("JSON entry fields not set correctly: %s", lines[0])
+	}
+	if len(entry.Varbinds) != 3 {
+		t.Fatalf("expected 3 varbinds: %s", lines[0])
+	}
+	if vb := entry.Varbinds[0]; vb.OID != "1.3.6.1.2.1.2.2.1.1.3" || vb.Type != "Integer" || vb.Value != float64(3) {
+		t.Errorf("integer varbind not set correctly: %+v", vb)
+	}
+	if vb := entry.Varbinds[1]; vb.Type != "OctetString" || vb.Value != "eth0" || vb.Encoding != "" {
+		t.Errorf("string varbind not set correctly: %+v", vb)
+	}
+	if vb := entry.Varbinds[2]; vb.Value != "001b2cff0001" || vb.Encoding != "hex" {
+		t.Errorf("binary varbind not hex encoded: %+v", vb)
+	}
+}
+
+// TestConfigReload reloads the configuration while traps are being handled.
+// The unchanged json action must be kept (so none of its traps are dropped
+// or reordered), while the log action moves between two files without
+// losing any traps.
+//
+func TestForwardActionKey(t *testing.T) {
+	var a, b trapexConfig
+	b.V3Params.Username = "changed"
+	for _, tt := range []struct {
+		opts []string
+		same bool
+	}{
+		{nil, true},
+		{[]string{"v2c"}, true},
+		{[]string{"v3", "v2c"}, true},
+		{[]string{"v3"}, false},
+		{[]string{"V3", "inform"}, false},
+	} {
+		same := a.actionKey("forward", "10.1.1.1:162", tt.opts) == b.actionKey("forward", "10.1.1.1:162", tt.opts)
+		if same != tt.same {
+			t.Errorf("forward %v: snmpv3 section change should change the key: %t", tt.opts, !tt.same)
+		}
+	}
+}
+
+func TestConfigReload(t *testing.T) {
+	const sources = 4
+	const perSource = 300
+	configFile := "tests/tmp/reload.yml"
+	for _, f := range []string{"tests/tmp/reload.json", "tests/tmp/reload1.log", "tests/tmp/reload2.log"} {
+		os.Remove(f)
+	}
+	writeConfig := func(logfile string) {
+		config := `general:
+  hostname: trapex_test1
+  process_workers: 4
+  action_queue_overflow: block
+filters:
+  - "* * * * * * json tests/tmp/reload.json"
+  - "* * * * * * log ` + logfile + `"
+  - "* * * 6 * * log ` + logfile + `"
+`
+		if err := ioutil.WriteFile(configFile, []byte(config), 0644); err != nil {
+			t.Fatalf("%s", err)
+		}
+	}
+	writeConfig("tests/tmp/reload1.log")
+	teCmdLine.configFile = configFile
+	teConfig = nil
+	if err := getConfig(); err != nil {
+		t.Fatalf("%s", err)
+	}
+	first := teConfig
+	if first.filters[1].action != first.filters[2].action || first.filters[1].worker != first.filters[2].worker {
+		t.Errorf("log action instance not shared between filters")
+	}
+	firstNumber := atomic.LoadUint64(&stats.TrapCount) + 1
+
+	pipeline := newTrapPipeline(nil, first)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		sendPipelineTraps(t, pipeline, sources, perSource)
+	}()
+	for i := 0; i < 5; i++ {
+		writeConfig(fmt.Sprintf("tests/tmp/reload%d.log", i%2+1))
+		if err := getConfig(); err != nil {
+			t.Fatalf("%s", err)
+		}
+	}
+	<-done
+	pipeline.close()
+
+	last := currentConfig()
+	if last.filters[0].action != first.filters[0].action || last.filters[0].worker != first.filters[0].worker {
+		t.Errorf("unchanged json action was not kept across reloads")
+	}
+	if last.filters[1].action == first.filters[1].action {
+		t.Errorf("log action for a new file was kept across reloads")
+	}
+	closeTrapexHandles()
+
+	checkPipelineTraps(t, "tests/tmp/reload.json", sources, perSource, firstNumber)
+	var logged int
+	for _, f := range []string{"tests/tmp/reload1.log", "tests/tmp/reload2.log"} {
+		data, err := ioutil.ReadFile(f)
+		if err != nil && !os.IsNotExist(err) {
+			t.Fatalf("%s", err)
+		}
+		logged += strings.Count(string(data), "Trap: ")
+	}
+	if logged != sources*perSource {
+		t.Errorf("expected %d traps in the log files, got %d", sources*perSource, logged)
+	}
+}
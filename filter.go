@@ -6,6 +6,7 @@
 package main
 
 import (
+	"fmt"
 	"log"
 	"net"
 	"os"
@@ -27,6 +28,9 @@ const (
 	parseTypeCIDR                // CIDR IP/Netmask
 	parseTypeIPSet               // A set of IP addresses
 	parseTypeIntRange            // Integer range x:y or x,y,z
+	parseTypePrefix              // OID prefix (anything below the OID)
+	parseTypeAnyOf               // Any of a list of filterObj values
+	parseTypeSet                 // A named set of strings
 )
 
 // Filter object items
@@ -37,6 +41,10 @@ const (
 	genericType
 	specificType
 	enterprise
+	v3User
+	varbind
+	trapOID
+	community
 )
 
 // Supported action types
@@ -49,6 +57,17 @@ const (
 	actionLogBreak
 	actionCsv
 	actionCsvBreak
+	actionJson
+	actionJsonBreak
+	actionSyslog
+	actionSyslogBreak
+	actionWebhook
+	actionWebhookBreak
+	actionClickhouse
+	actionClickhouseBreak
+	actionJump
+	actionGoto
+	actionReturn
 )
 
 // filterObj represents one of the filterable items in a filter line from
@@ -58,23 +77,50 @@ const (
 type filterObj struct {
 	filterItem  int
 	filterType  int
-	filterValue interface{} // string, *regex.Regexp, *network, int
+	filterValue interface{} // string, *regex.Regexp, *network, int, intRanges, *oidMatch, *varbindMatch, []filterObj
+	negate      bool        // Match when the value does not match
 }
 
 // trapexFilter holds the filter data and action for a specfic
-// filter line from the config file.
+// filter line from the config file. The line (for the filter line form) and
+// actionText are kept for the admin API, along with the count of traps that
+// matched the filter and the overlay rule it came from (if any).
 type trapexFilter struct {
+	name        string
+	line        string
 	filterItems []filterObj
 	matchAll    bool
 	action      interface{}
 	actionType  int
 	actionArg   string
+	actionText  string
+	worker      *actionWorker
+	hits        *uint64
+	rule        *overlayRule
+}
+
+// filterChain is a named list of filters that filters can jump or goto.
+//
+type filterChain struct {
+	name    string
+	filters []trapexFilter
+}
+
+// sharedAction is an action instance, along with its worker for the actions
+// that have one. It is shared by the filters with the same action and
+// settings (see shareAction).
+//
+type sharedAction struct {
+	action interface{}
+	worker *actionWorker
 }
 
 // trapForwarder is an instance of a forward destination.
 //
 type trapForwarder struct {
 	destination *g.GoSNMP
+	inform      bool
+	queue       *forwardQueue
 }
 
 // trapLogger is an instace of a trap logfile destination.
@@ -82,6 +128,7 @@ type trapForwarder struct {
 type trapLogger struct {
 	logFile   string
 	fd        *os.File
+	logger    *lumberjack.Logger
 	logHandle *log.Logger
 	isBroken  bool
 }
@@ -96,47 +143,178 @@ type trapCsvLogger struct {
 	isBroken  bool
 }
 
-// Initialize a trapForwarder instance.
+// trapJsonLogger is an instance of a JSON Lines trap logfile destination.
+//
+type trapJsonLogger struct {
+	logFile   string
+	fd        *os.File
+	logger    *lumberjack.Logger
+	logHandle *log.Logger
+}
+
+// Initialize a trapForwarder instance. The optional version option selects
+// the SNMP version used toward this destination (v1 by default), the inform
+// option sends INFORMs (v2c/v3 only) that wait for an acknowledgement, the
+// community:<name> option sets the community sent to v1/v2c destinations,
+// and the queue:<name> option queues traps on disk while the destination is
+// failing.
 //
-func (a *trapForwarder) initAction(dest string) error {
-	s := strings.Split(dest, ":")
-	port, err := strconv.Atoi(s[1])
+func (a *trapForwarder) initAction(dest string, opts []string, teConf *trapexConfig) error {
+	queueParams, err := a.setup(dest, opts, teConf)
 	if err != nil {
-		panic("Invalid destination port: " + s[1])
+		return err
+	}
+	err = a.destination.Connect()
+	if err != nil {
+		return (err)
+	}
+	if queueParams != nil {
+		if a.queue, err = openForwardQueue(dest, a.destination.Version, a.settings(), queueParams, a.destination); err != nil {
+			a.destination.Conn.Close()
+			return fmt.Errorf("unable to open the forward queue for %s: %s", dest, err)
+		}
+	}
+	logger.Info().Str("target", a.destination.Target).Str("port", strconv.Itoa(int(a.destination.Port))).Str("version", a.destination.Version.String()).Bool("inform", a.inform).Bool("queue", a.queue != nil).Msg("Added trap destination")
+	return nil
+}
+
+// setup parses the forward destination and options, and sets up (but
+// doesn't connect) the destination. The forward queue params are returned
+// for the queue option.
+//
+func (a *trapForwarder) setup(dest string, opts []string, teConf *trapexConfig) (*forwardQueueParams, error) {
+	host, portStr, err := net.SplitHostPort(dest)
+	if err != nil {
+		return nil, fmt.Errorf("invalid forward destination (expected ip_address:port or [ipv6_address]:port): %s", dest)
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid destination port: %s", portStr)
+	}
+	version := g.Version1
+	v3 := &teConf.V3Params
+	var community string
+	var queueParams *forwardQueueParams
+	for _, opt := range opts {
+		switch strings.ToLower(opt) {
+		case "v1", "1":
+			version = g.Version1
+		case "v2c", "2c", "2":
+			version = g.Version2c
+		case "v3", "3":
+			version = g.Version3
+		case "inform":
+			a.inform = true
+		default:
+			if strings.HasPrefix(opt, "community:") {
+				community = opt[10:]
+				continue
+			}
+			if strings.HasPrefix(opt, "queue:") {
+				var ok bool
+				if queueParams, ok = teConf.forwardQueues[opt[6:]]; !ok {
+					return nil, fmt.Errorf("unknown forward_queues name for forward action to %s: %s", dest, opt[6:])
+				}
+				continue
+			}
+			// A "v3:" prefix names one of the snmpv3_destinations entries.
+			if !strings.HasPrefix(opt, "v3:") {
+				return nil, fmt.Errorf("unsupported option for forward action to %s: %s", dest, opt)
+			}
+			params, ok := teConf.v3Destinations[opt[3:]]
+			if !ok {
+				return nil, fmt.Errorf("unknown snmpv3_destinations name for forward action to %s: %s", dest, opt[3:])
+			}
+			version = g.Version3
+			v3 = params
+		}
+	}
+	if a.inform && version == g.Version1 {
+		return nil, fmt.Errorf("the inform option requires a v2c or v3 forward destination: %s", dest)
 	}
 	a.destination = &g.GoSNMP{
-		Target:             s[0],
+		Target:             host,
 		Port:               uint16(port),
 		Transport:          "udp",
-		Community:          "",
-		Version:            g.Version1,
+		Community:          community,
+		Version:            version,
 		Timeout:            time.Duration(2) * time.Second,
 		Retries:            3,
 		ExponentialTimeout: true,
 		MaxOids:            g.MaxOids,
 	}
-	err = a.destination.Connect()
-	if err != nil {
-		return (err)
+	// v3 destinations use either the snmpv3 security parameters or those
+	// of the named snmpv3_destinations entry.
+	if version == g.Version3 {
+		a.destination.SecurityModel = g.UserSecurityModel
+		a.destination.MsgFlags = v3.msgFlags
+		a.destination.SecurityParameters = v3.usmParams()
+		a.destination.ContextEngineID = v3.engineID
+		a.destination.ContextName = v3.ContextName
 	}
-	logger.Info().Str("target", s[0]).Str("port", s[1]).Msg("Added trap destination")
-	return nil
+	return queueParams, nil
+}
+
+// settings returns the settings that decide how traps are sent to the
+// destination, which keep forward queues of different forwarders apart.
+//
+func (a *trapForwarder) settings() string {
+	d := a.destination
+	settings := fmt.Sprintf("%s %d %s %q inform=%t", d.Target, d.Port, d.Version, d.Community, a.inform)
+	if usm, ok := d.SecurityParameters.(*g.UsmSecurityParameters); ok {
+		settings += fmt.Sprintf(" %d %q %q %q %q %d %q %d %q", d.MsgFlags, d.ContextEngineID, d.ContextName,
+			usm.UserName, usm.AuthoritativeEngineID, usm.AuthenticationProtocol, usm.AuthenticationPassphrase,
+			usm.PrivacyProtocol, usm.PrivacyPassphrase)
+	}
+	return settings
 }
 
 // Hook for sending a trap to the destination defined for this trapForwarder
-// instance.
+// instance. Traps are only sent as their v1 translation when the destination
+// is v1; v1 traps are translated to v2c for other destinations, and v2c/v3
+// varbinds are sent as they were received (except for the snmpTrapAddress
+// set by a nat action). With a queue, traps that can't be sent are queued
+// instead.
 //
 func (a trapForwarder) processTrap(trap *sgTrap) error {
-	_, err := a.destination.SendTrap(trap.data)
+	t := trap.data
+	if a.destination.Version != g.Version1 {
+		vars := trap.origVars
+		if trap.trapVer == g.Version1 {
+			vars = translateToV2c(trap)
+		}
+		if trap.natAddress != "" {
+			vars = setTrapAddress(vars, trap.natAddress)
+		}
+		// For informs, SendTrap waits for the response and retries on
+		// timeout.
+		t = g.SnmpTrap{Variables: vars, IsInform: a.inform}
+	}
+	if a.queue != nil {
+		return a.queue.forward(a.destination, t)
+	}
+	_, err := a.destination.SendTrap(t)
 	return err
 }
 
 // Close the trapForwarder connection
 //
 func (a trapForwarder) close() {
+	if a.queue != nil {
+		a.queue.release(a.destination)
+	}
 	a.destination.Conn.Close()
 }
 
+// forwardError counts (and logs at the debug level) a trap that could not be
+// forwarded.
+//
+func (a trapForwarder) forwardError(err error) {
+	dest := net.JoinHostPort(a.destination.Target, strconv.Itoa(int(a.destination.Port)))
+	forwardErrors.WithLabelValues(dest).Inc()
+	logger.Debug().Err(err).Str("destination", dest).Msg("Error forwarding trap")
+}
+
 // Initialize a trapLogger instance.
 //
 func (a *trapLogger) initAction(logfile string, teConf *trapexConfig) error {
@@ -147,7 +325,8 @@ func (a *trapLogger) initAction(logfile string, teConf *trapexConfig) error {
 	a.fd = fd
 	a.logFile = logfile
 	a.logHandle = log.New(fd, "", 0)
-	a.logHandle.SetOutput(makeLogger(logfile, teConf))
+	a.logger = makeLogger(logfile, teConf)
+	a.logHandle.SetOutput(a.logger)
 	logger.Info().Str("logfile", logfile).Msg("Added log destination")
 	return nil
 }
@@ -161,6 +340,7 @@ func (a *trapLogger) processTrap(trap *sgTrap) {
 // Close a trap logger handle
 //
 func (a *trapLogger) close() {
+	a.logger.Close()
 	a.fd.Close()
 }
 
@@ -199,6 +379,37 @@ func (a *trapCsvLogger) rotateLog() {
 // Close a trap logger handle
 //
 func (a *trapCsvLogger) close() {
+	a.logger.Close()
+	a.fd.Close()
+}
+
+// Initialize a trapJsonLogger instance. The log file is rotated the same
+// way as the log action files.
+//
+func (a *trapJsonLogger) initAction(logfile string, teConf *trapexConfig) error {
+	fd, err := os.OpenFile(logfile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	a.fd = fd
+	a.logFile = logfile
+	a.logHandle = log.New(fd, "", 0)
+	a.logger = makeLogger(logfile, teConf)
+	a.logHandle.SetOutput(a.logger)
+	logger.Info().Str("logfile", logfile).Msg("Added JSON log destination")
+	return nil
+}
+
+// Hook for logging a trap for this instance of a json action.
+//
+func (a *trapJsonLogger) processTrap(trap *sgTrap) {
+	logJsonTrap(trap, a.logHandle)
+}
+
+// Close a trap JSON logger handle
+//
+func (a *trapJsonLogger) close() {
+	a.logger.Close()
 	a.fd.Close()
 }
 
@@ -207,55 +418,100 @@ func (a *trapCsvLogger) close() {
 //
 func (f *trapexFilter) isFilterMatch(sgt *sgTrap) bool {
 	// Assume true - until one of the filter items does not match
-	trap := &(sgt.data)
 	for _, fo := range f.filterItems {
-		fval := fo.filterValue
-		switch fo.filterItem {
-		case version:
-			if fval != sgt.trapVer {
-				return false
-			}
-		case srcIP:
-			if fo.filterType == parseTypeString && fval.(string) != sgt.srcIP.String() {
-				return false
-			} else if fo.filterType == parseTypeCIDR && !fval.(*network).contains(sgt.srcIP) {
-				return false
-			} else if fo.filterType == parseTypeRegex && !fval.(*regexp.Regexp).MatchString(sgt.srcIP.String()) {
-				return false
-			} else if fo.filterType == parseTypeIPSet {
-				_, ok := teConfig.ipSets[fval.(string)][sgt.srcIP.String()]
-				if ok != true {
-					return false
-				}
-			}
-		case agentAddr:
-			if fo.filterType == parseTypeString && fval.(string) != trap.AgentAddress {
-				return false
-			} else if fo.filterType == parseTypeCIDR && !fval.(*network).contains(net.ParseIP(trap.AgentAddress)) {
-				return false
-			} else if fo.filterType == parseTypeRegex && !fval.(*regexp.Regexp).MatchString(trap.AgentAddress) {
-				return false
-			} else if fo.filterType == parseTypeIPSet {
-				_, ok := teConfig.ipSets[fval.(string)][trap.AgentAddress]
-				if ok != true {
-					return false
-				}
-			}
-		case enterprise:
-			if fo.filterType == parseTypeRegex && !fval.(*regexp.Regexp).MatchString(strings.TrimLeft(trap.Enterprise, ".")) {
-				return false
-			} else if fo.filterType == parseTypeString && fval.(string) != strings.TrimLeft(trap.Enterprise, ".") {
-				return false
+		if fo.isMatch(sgt) == fo.negate {
+			return false
+		}
+	}
+	return true
+}
+
+// isMatch checks trap data against a single filter item (before any
+// negation is applied).
+//
+func (fo *filterObj) isMatch(sgt *sgTrap) bool {
+	trap := &(sgt.data)
+	fval := fo.filterValue
+	if fo.filterType == parseTypeAnyOf {
+		for _, alt := range fval.([]filterObj) {
+			if alt.isMatch(sgt) {
+				return true
 			}
-		case genericType:
-			if fo.filterType == parseTypeInt && fval.(int) != trap.GenericTrap {
+		}
+		return false
+	}
+	switch fo.filterItem {
+	case version:
+		if fval != sgt.trapVer {
+			return false
+		}
+	case srcIP:
+		if fo.filterType == parseTypeString && fval.(string) != sgt.srcIP.String() {
+			return false
+		} else if fo.filterType == parseTypeCIDR && !fval.(*network).contains(sgt.srcIP) {
+			return false
+		} else if fo.filterType == parseTypeRegex && !fval.(*regexp.Regexp).MatchString(sgt.srcIP.String()) {
+			return false
+		} else if fo.filterType == parseTypeIPSet {
+			_, ok := sgt.config().ipSets[fval.(string)][sgt.srcIP.String()]
+			if ok != true {
 				return false
 			}
-		case specificType:
-			if fo.filterType == parseTypeInt && fval.(int) != trap.SpecificTrap {
+		}
+	case agentAddr:
+		if fo.filterType == parseTypeString && fval.(string) != trap.AgentAddress {
+			return false
+		} else if fo.filterType == parseTypeCIDR && !fval.(*network).contains(net.ParseIP(trap.AgentAddress)) {
+			return false
+		} else if fo.filterType == parseTypeRegex && !fval.(*regexp.Regexp).MatchString(trap.AgentAddress) {
+			return false
+		} else if fo.filterType == parseTypeIPSet {
+			_, ok := sgt.config().ipSets[fval.(string)][trap.AgentAddress]
+			if ok != true {
 				return false
 			}
 		}
+	case enterprise:
+		if fo.filterType == parseTypeRegex && !fval.(*regexp.Regexp).MatchString(strings.TrimLeft(trap.Enterprise, ".")) {
+			return false
+		} else if fo.filterType == parseTypeString && fval.(string) != strings.TrimLeft(trap.Enterprise, ".") {
+			return false
+		}
+	case v3User:
+		if fo.filterType == parseTypeString && fval.(string) != sgt.v3User {
+			return false
+		} else if fo.filterType == parseTypeRegex && !fval.(*regexp.Regexp).MatchString(sgt.v3User) {
+			return false
+		}
+	case varbind:
+		// Varbinds are matched as they were received (not the v1 view).
+		if !fval.(*varbindMatch).matches(sgt.origVars) {
+			return false
+		}
+	case community:
+		if fo.filterType == parseTypeString && fval.(string) != sgt.community {
+			return false
+		} else if fo.filterType == parseTypeRegex && !fval.(*regexp.Regexp).MatchString(sgt.community) {
+			return false
+		} else if fo.filterType == parseTypeSet && !sgt.config().communitySets[fval.(string)][sgt.community] {
+			return false
+		}
+	case trapOID:
+		if !fval.(*oidMatch).oidMatches(sgt.trapOID) {
+			return false
+		}
+	case genericType:
+		if fo.filterType == parseTypeInt && fval.(int) != trap.GenericTrap {
+			return false
+		} else if fo.filterType == parseTypeIntRange && !fval.(intRanges).contains(trap.GenericTrap) {
+			return false
+		}
+	case specificType:
+		if fo.filterType == parseTypeInt && fval.(int) != trap.SpecificTrap {
+			return false
+		} else if fo.filterType == parseTypeIntRange && !fval.(intRanges).contains(trap.SpecificTrap) {
+			return false
+		}
 	}
 	return true
 }
@@ -269,36 +525,75 @@ func (f *trapexFilter) processAction(sgt *sgTrap) {
 		sgt.dropped = true
 		return
 	case actionNat:
-		if f.actionArg == "$SRC_IP" {
-			sgt.data.AgentAddress = sgt.srcIP.String()
-		} else {
-			sgt.data.AgentAddress = f.actionArg
+		addr := f.actionArg
+		if addr == "$SRC_IP" {
+			// An IPv6 source can't be used as an agent address (which is
+			// always IPv4), so the trap is left as is.
+			if sgt.srcIP.To4() == nil {
+				logger.Warn().Str("source", sgt.srcIP.String()).Uint64("trap", sgt.trapNumber).Msg("Can not nat to an IPv6 source address, agent address not changed")
+				return
+			}
+			addr = sgt.srcIP.String()
 		}
+		sgt.data.AgentAddress = addr
+		sgt.natAddress = addr
 	case actionForward:
-		f.action.(*trapForwarder).processTrap(sgt)
+		f.worker.queueTrap(sgt)
 	case actionForwardBreak:
-		f.action.(*trapForwarder).processTrap(sgt)
+		f.worker.queueTrap(sgt)
 		sgt.dropped = true
 		return
 	case actionLog:
 		if !sgt.dropped {
-			f.action.(*trapLogger).processTrap(sgt)
+			f.worker.queueTrap(sgt)
 		}
 	case actionLogBreak:
 		if !sgt.dropped {
-			f.action.(*trapLogger).processTrap(sgt)
+			f.worker.queueTrap(sgt)
 		}
 		sgt.dropped = true
 		return
 	case actionCsv:
 		if !sgt.dropped {
-			f.action.(*trapCsvLogger).processTrap(sgt)
+			f.worker.queueTrap(sgt)
 		}
 	case actionCsvBreak:
 		if !sgt.dropped {
-			f.action.(*trapCsvLogger).processTrap(sgt)
+			f.worker.queueTrap(sgt)
+		}
+		sgt.dropped = true
+		return
+	case actionJson:
+		if !sgt.dropped {
+			f.worker.queueTrap(sgt)
+		}
+	case actionJsonBreak:
+		if !sgt.dropped {
+			f.worker.queueTrap(sgt)
 		}
 		sgt.dropped = true
 		return
+	case actionSyslog:
+		if !sgt.dropped {
+			f.worker.queueTrap(sgt)
+		}
+	case actionSyslogBreak:
+		if !sgt.dropped {
+			f.worker.queueTrap(sgt)
+		}
+		sgt.dropped = true
+		return
+	case actionWebhook:
+		f.action.(*trapWebhook).processTrap(sgt)
+	case actionWebhookBreak:
+		f.action.(*trapWebhook).processTrap(sgt)
+		sgt.dropped = true
+		return
+	case actionClickhouse:
+		f.action.(*trapClickhouse).processTrap(sgt)
+	case actionClickhouseBreak:
+		f.action.(*trapClickhouse).processTrap(sgt)
+		sgt.dropped = true
+		return
 	}
 }
@@ -0,0 +1,522 @@
+// Copyright (c) 2021 Damien Stuart. All rights reserved.
+//
+// Use of this source code is governed by the MIT License that can be found
+// in the LICENSE file.
+//
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/creasty/defaults"
+	g "github.com/gosnmp/gosnmp"
+)
+
+// forwardQueueParams are the settings for a named store-and-forward queue
+// (forward_queues) used by the forward action's queue:<name> option.
+//
+type forwardQueueParams struct {
+	Dir           string        `yaml:"dir"`
+	SegmentSize   int           `default:"1" yaml:"segment_size"`
+	MaxSize       int           `default:"256" yaml:"max_size"`
+	MaxAge        time.Duration `default:"24h" yaml:"max_age"`
+	DrainRate     int           `default:"100" yaml:"drain_rate"`
+	RetryInterval time.Duration `default:"10s" yaml:"retry_interval"`
+}
+
+// forwardQueue is a disk-backed queue of traps for one forward destination.
+// Traps are sent straight to the destination while the queue is empty.
+// When a send fails, that trap and the ones after it are appended to
+// segment files, and a drainer goroutine sends them (at up to drain_rate
+// per second) once the destination is back.
+//
+// The queue for a directory is shared by the forwarders that use it, which
+// includes the forwarders of a reloaded config while the old ones finish.
+// The directory is keyed by the forwarder settings, so these forwarders
+// send the same traps the same way, and the queue sends its traps with
+// whichever one was opened last.
+//
+type forwardQueue struct {
+	name    string
+	dir     string
+	params  *forwardQueueParams
+	senders []trapSender // Of the forwarders using the queue
+
+	mu        sync.Mutex
+	segments  []int64 // Segment file numbers, oldest first
+	readSeq   int64
+	readOff   int64
+	writeFile *os.File
+	writeSize int64
+	depth     int
+
+	wake chan struct{}
+	stop chan struct{}
+	done chan struct{}
+}
+
+// trapSender sends traps to a forward destination (a *g.GoSNMP).
+//
+type trapSender interface {
+	SendTrap(trap g.SnmpTrap) (*g.SnmpPacket, error)
+}
+
+// queuedTrap is the record stored in the segment files.
+//
+type queuedTrap struct {
+	Queued time.Time
+	Trap   g.SnmpTrap
+}
+
+var (
+	forwardQueuesMu sync.Mutex
+	forwardQueues   = make(map[string]*forwardQueue)
+)
+
+// processForwardQueues validates each of the named forward queues.
+//
+func processForwardQueues(newConfig *trapexConfig) error {
+	for _, stanza := range newConfig.ForwardQueues {
+		for queueName, params := range stanza {
+			if _, ok := newConfig.forwardQueues[queueName]; ok {
+				return fmt.Errorf("duplicate forward_queues entry: %s", queueName)
+			}
+			fq := params
+			if err := defaults.Set(&fq); err != nil {
+				return err
+			}
+			if fq.Dir == "" {
+				return fmt.Errorf("forward_queues:%s: missing dir", queueName)
+			}
+			if fq.SegmentSize <= 0 || fq.MaxSize < fq.SegmentSize || fq.MaxAge <= 0 || fq.DrainRate <= 0 || fq.RetryInterval <= 0 {
+				return fmt.Errorf("forward_queues:%s: invalid segment_size, max_size, max_age, drain_rate, or retry_interval", queueName)
+			}
+			logger.Info().Str("forward_queue", queueName).Str("dir", fq.Dir).Msg("Loading forward queue")
+			newConfig.forwardQueues[queueName] = &fq
+		}
+	}
+	return nil
+}
+
+// openForwardQueue opens (or shares) the queue for a forward destination in
+// a subdirectory of the queue's dir, named by destination, SNMP version,
+// and a hash of the other forwarder settings (community, inform, v3
+// security parameters). dest is the forwarder's GoSNMP.
+//
+func openForwardQueue(name string, version g.SnmpVersion, settings string, params *forwardQueueParams, dest trapSender) (*forwardQueue, error) {
+	hash := sha256.Sum256([]byte(settings))
+	subdir := strings.NewReplacer(":", "_", "[", "", "]", "").Replace(name) + "-v" + version.String() + "-" + hex.EncodeToString(hash[:4])
+	dir, err := filepath.Abs(filepath.Join(params.Dir, subdir))
+	if err != nil {
+		return nil, err
+	}
+	forwardQueuesMu.Lock()
+	defer forwardQueuesMu.Unlock()
+	if q, ok := forwardQueues[dir]; ok {
+		q.mu.Lock()
+		q.params = params
+		q.senders = append(q.senders, dest)
+		q.mu.Unlock()
+		return q, nil
+	}
+
+	q := &forwardQueue{
+		name:    name,
+		dir:     dir,
+		params:  params,
+		senders: []trapSender{dest},
+		wake:    make(chan struct{}, 1),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	if err := q.load(); err != nil {
+		return nil, err
+	}
+	forwardQueues[dir] = q
+	go q.drain()
+	if q.depth > 0 {
+		logger.Info().Str("destination", name).Int("depth", q.depth).Msg("Forward queue has traps from before the restart")
+	}
+	return q, nil
+}
+
+// release drops a forwarder (by its GoSNMP) from the queue, and closes the
+// queue when there are none left.
+//
+func (q *forwardQueue) release(dest trapSender) {
+	forwardQueuesMu.Lock()
+	q.mu.Lock()
+	for i, s := range q.senders {
+		if s == dest {
+			q.senders = append(q.senders[:i], q.senders[i+1:]...)
+			break
+		}
+	}
+	last := len(q.senders) == 0
+	q.mu.Unlock()
+	if last {
+		delete(forwardQueues, q.dir)
+	}
+	forwardQueuesMu.Unlock()
+	if !last {
+		return
+	}
+	close(q.stop)
+	<-q.done
+	q.mu.Lock()
+	if q.writeFile != nil {
+		q.writeFile.Close()
+		q.writeFile = nil
+	}
+	q.mu.Unlock()
+}
+
+// load reads the queue state (segment files and the read cursor) from the
+// queue directory.
+//
+func (q *forwardQueue) load() error {
+	if err := os.MkdirAll(q.dir, 0755); err != nil {
+		return err
+	}
+	files, err := filepath.Glob(filepath.Join(q.dir, "*.seg"))
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		if seq, err := strconv.ParseInt(strings.TrimSuffix(filepath.Base(f), ".seg"), 10, 64); err == nil {
+			q.segments = append(q.segments, seq)
+		}
+	}
+	sort.Slice(q.segments, func(i, j int) bool { return q.segments[i] < q.segments[j] })
+
+	if data, err := ioutil.ReadFile(filepath.Join(q.dir, "cursor")); err == nil {
+		fmt.Sscanf(string(data), "%d %d", &q.readSeq, &q.readOff)
+	}
+	// Segments before the cursor have been sent.
+	for len(q.segments) > 0 && q.segments[0] < q.readSeq {
+		os.Remove(q.segmentFile(q.segments[0]))
+		q.segments = q.segments[1:]
+	}
+	if len(q.segments) == 0 || q.segments[0] != q.readSeq {
+		q.readOff = 0
+		if len(q.segments) > 0 {
+			q.readSeq = q.segments[0]
+		}
+	}
+	for _, seq := range q.segments {
+		off := int64(0)
+		if seq == q.readSeq {
+			off = q.readOff
+		}
+		q.depth += q.countRecords(seq, off)
+	}
+	forwardQueueDepth.WithLabelValues(q.name).Set(float64(q.depth))
+	return nil
+}
+
+// sender returns the GoSNMP of the newest forwarder using the queue. The
+// queue must be locked.
+//
+func (q *forwardQueue) sender() trapSender {
+	return q.senders[len(q.senders)-1]
+}
+
+func (q *forwardQueue) segmentFile(seq int64) string {
+	return filepath.Join(q.dir, fmt.Sprintf("%020d.seg", seq))
+}
+
+// countRecords returns the number of records in a segment from the given
+// offset.
+//
+func (q *forwardQueue) countRecords(seq int64, off int64) int {
+	f, err := os.Open(q.segmentFile(seq))
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+	n := 0
+	for {
+		if _, err := f.Seek(off, io.SeekStart); err != nil {
+			return n
+		}
+		var size uint32
+		if err := binary.Read(f, binary.BigEndian, &size); err != nil {
+			return n
+		}
+		off += 4 + int64(size)
+		n++
+	}
+}
+
+// forward sends a trap to the destination with the forwarder's GoSNMP, or
+// queues it if the destination is failing or there are already queued
+// traps (to keep them in order). The queue isn't locked while sending, which
+// can take the whole timeout and retries.
+//
+func (q *forwardQueue) forward(dest trapSender, trap g.SnmpTrap) error {
+	q.mu.Lock()
+	direct := q.depth == 0
+	q.mu.Unlock()
+	if direct {
+		_, err := dest.SendTrap(trap)
+		if err == nil {
+			return nil
+		}
+		logger.Warn().Err(err).Str("destination", q.name).Msg("Error forwarding trap, queueing traps for this destination")
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if err := q.append(trap); err != nil {
+		logger.Warn().Err(err).Str("destination", q.name).Msg("Error queueing trap")
+		return err
+	}
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// append adds a trap to the newest segment, starting a new segment when it
+// is full, and enforces the max_size limit. The queue must be locked.
+//
+func (q *forwardQueue) append(trap g.SnmpTrap) error {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(queuedTrap{Queued: time.Now(), Trap: trap}); err != nil {
+		return err
+	}
+	size := int64(buf.Len()) + 4
+	if q.writeFile == nil || q.writeSize+size > int64(q.params.SegmentSize)*1024*1024 {
+		if err := q.newSegment(); err != nil {
+			return err
+		}
+	}
+	rec := make([]byte, 4, size)
+	binary.BigEndian.PutUint32(rec, uint32(buf.Len()))
+	rec = append(rec, buf.Bytes()...)
+	if _, err := q.writeFile.Write(rec); err != nil {
+		return err
+	}
+	q.writeSize += size
+	q.depth++
+	forwardQueued.WithLabelValues(q.name).Inc()
+
+	// Only the newest segment is not full.
+	segmentSize := int64(q.params.SegmentSize) * 1024 * 1024
+	for len(q.segments) > 1 && int64(len(q.segments)-1)*segmentSize+q.writeSize > int64(q.params.MaxSize)*1024*1024 {
+		q.dropOldest("max_size")
+	}
+	forwardQueueDepth.WithLabelValues(q.name).Set(float64(q.depth))
+	return nil
+}
+
+func (q *forwardQueue) newSegment() error {
+	if q.writeFile != nil {
+		q.writeFile.Sync()
+		q.writeFile.Close()
+		q.writeFile = nil
+	}
+	seq := int64(1)
+	if len(q.segments) > 0 {
+		seq = q.segments[len(q.segments)-1] + 1
+	}
+	f, err := os.OpenFile(q.segmentFile(seq), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	if len(q.segments) == 0 {
+		q.readSeq, q.readOff = seq, 0
+	}
+	q.segments = append(q.segments, seq)
+	q.writeFile = f
+	q.writeSize = 0
+	return nil
+}
+
+// dropOldest removes the oldest segment (and the traps in it that were
+// not sent yet). The queue must be locked.
+//
+func (q *forwardQueue) dropOldest(reason string) {
+	seq := q.segments[0]
+	off := int64(0)
+	if seq == q.readSeq {
+		off = q.readOff
+	}
+	n := q.countRecords(seq, off)
+	if len(q.segments) == 1 && q.writeFile != nil {
+		q.writeFile.Close()
+		q.writeFile = nil
+	}
+	os.Remove(q.segmentFile(seq))
+	q.segments = q.segments[1:]
+	q.depth -= n
+	if len(q.segments) > 0 {
+		q.readSeq, q.readOff = q.segments[0], 0
+	} else {
+		q.readOff = 0
+	}
+	q.saveCursor()
+	forwardQueueDropped.WithLabelValues(q.name).Add(float64(n))
+	forwardQueueDepth.WithLabelValues(q.name).Set(float64(q.depth))
+	logger.Warn().Str("destination", q.name).Int("traps", n).Str("reason", reason).Msg("Dropped traps from the forward queue")
+}
+
+// expire drops segments whose newest trap is older than max_age. The queue
+// must be locked.
+//
+func (q *forwardQueue) expire() {
+	for len(q.segments) > 0 {
+		fi, err := os.Stat(q.segmentFile(q.segments[0]))
+		if err == nil && time.Since(fi.ModTime()) < q.params.MaxAge {
+			return
+		}
+		q.dropOldest("max_age")
+	}
+}
+
+// next reads the oldest queued trap, and returns it with the offset just
+// past it. Segments that have been read to the end are removed. The queue
+// must be locked.
+//
+func (q *forwardQueue) next() (*queuedTrap, int64, error) {
+	for q.depth > 0 && len(q.segments) > 0 {
+		f, err := os.Open(q.segmentFile(q.readSeq))
+		if err != nil {
+			return nil, 0, err
+		}
+		var size uint32
+		_, err = f.Seek(q.readOff, io.SeekStart)
+		if err == nil {
+			err = binary.Read(f, binary.BigEndian, &size)
+		}
+		if err == io.EOF && len(q.segments) > 1 {
+			// Done with this segment.
+			f.Close()
+			os.Remove(q.segmentFile(q.readSeq))
+			q.segments = q.segments[1:]
+			q.readSeq, q.readOff = q.segments[0], 0
+			q.saveCursor()
+			continue
+		}
+		if err != nil {
+			f.Close()
+			return nil, 0, err
+		}
+		data := make([]byte, size)
+		_, err = io.ReadFull(f, data)
+		f.Close()
+		if err != nil {
+			return nil, 0, err
+		}
+		var qt queuedTrap
+		if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&qt); err != nil {
+			return nil, 0, err
+		}
+		return &qt, q.readOff + 4 + int64(size), nil
+	}
+	return nil, 0, io.EOF
+}
+
+func (q *forwardQueue) saveCursor() {
+	cursor := filepath.Join(q.dir, "cursor")
+	ioutil.WriteFile(cursor+".tmp", []byte(fmt.Sprintf("%d %d\n", q.readSeq, q.readOff)), 0644)
+	os.Rename(cursor+".tmp", cursor)
+}
+
+// drain sends the queued traps at up to drain_rate per second, waiting
+// retry_interval after a failure.
+//
+func (q *forwardQueue) drain() {
+	defer close(q.done)
+	for {
+		wait := q.sendNext()
+		if wait == 0 {
+			// Nothing queued
+			select {
+			case <-q.stop:
+				return
+			case <-q.wake:
+			case <-time.After(time.Minute):
+			}
+			continue
+		}
+		select {
+		case <-q.stop:
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// sendNext sends the oldest queued trap, and returns how long to wait
+// before the next one (0 if the queue is empty). The queue is only locked
+// to read the trap and then to move the read cursor past it.
+//
+func (q *forwardQueue) sendNext() time.Duration {
+	q.mu.Lock()
+	if len(q.senders) == 0 {
+		// The queue is being closed.
+		q.mu.Unlock()
+		return 0
+	}
+	q.expire()
+	qt, off, err := q.next()
+	if err == io.EOF {
+		q.mu.Unlock()
+		return 0
+	}
+	if err != nil {
+		// An unreadable record can't be sent, so skip the segment.
+		logger.Warn().Err(err).Str("destination", q.name).Msg("Error reading forward queue")
+		q.dropOldest("unreadable")
+		q.mu.Unlock()
+		return time.Second / time.Duration(q.params.DrainRate)
+	}
+	dest, readSeq, readOff := q.sender(), q.readSeq, q.readOff
+	q.mu.Unlock()
+
+	_, err = dest.SendTrap(qt.Trap)
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if err != nil {
+		logger.Debug().Err(err).Str("destination", q.name).Int("depth", q.depth).Msg("Forward destination is still failing")
+		return q.params.RetryInterval
+	}
+	if q.readSeq != readSeq || q.readOff != readOff {
+		// The segment was dropped (max_size) while the trap was sent.
+		return time.Second / time.Duration(q.params.DrainRate)
+	}
+	q.readOff = off
+	q.depth--
+	q.saveCursor()
+	if q.depth == 0 {
+		logger.Info().Str("destination", q.name).Msg("Forward queue drained")
+		// Start over with a fresh segment next time.
+		for len(q.segments) > 0 {
+			if q.writeFile != nil && len(q.segments) == 1 {
+				q.writeFile.Close()
+				q.writeFile = nil
+			}
+			os.Remove(q.segmentFile(q.segments[0]))
+			q.segments = q.segments[1:]
+		}
+		q.readOff = 0
+		q.saveCursor()
+	}
+	forwardQueueDepth.WithLabelValues(q.name).Set(float64(q.depth))
+	return time.Second / time.Duration(q.params.DrainRate)
+}
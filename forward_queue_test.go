@@ -0,0 +1,251 @@
+// Copyright (c) 2021 Damien Stuart. All rights reserved.
+//
+// Use of this source code is governed by the MIT License that can be found
+// in the LICENSE file.
+//
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	g "github.com/gosnmp/gosnmp"
+)
+
+// testSender is a trapSender that records the traps sent to it, and fails
+// while failing is set.
+//
+type testSender struct {
+	mu       sync.Mutex
+	failing  bool
+	attempts int
+	sent     []g.SnmpTrap
+}
+
+func (s *testSender) SendTrap(trap g.SnmpTrap) (*g.SnmpPacket, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.attempts++
+	if s.failing {
+		return nil, errors.New("connection refused")
+	}
+	s.sent = append(s.sent, trap)
+	return nil, nil
+}
+
+func (s *testSender) setFailing(failing bool) {
+	s.mu.Lock()
+	s.failing = failing
+	s.mu.Unlock()
+}
+
+func (s *testSender) sentTraps() []g.SnmpTrap {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]g.SnmpTrap{}, s.sent...)
+}
+
+// blockedSender is a trapSender that waits for each send to be released.
+//
+type blockedSender struct {
+	testSender
+	started chan struct{}
+	release chan struct{}
+}
+
+func (s *blockedSender) SendTrap(trap g.SnmpTrap) (*g.SnmpPacket, error) {
+	s.started <- struct{}{}
+	<-s.release
+	return s.testSender.SendTrap(trap)
+}
+
+func forwardQueueTestTrap(specific int) g.SnmpTrap {
+	return testTrap(g.Version1, specific,
+		g.SnmpPDU{Name: ".1.3.6.1.2.1.1.3.0", Type: g.TimeTicks, Value: uint32(1234)},
+		sysNameVar("router1"),
+		g.SnmpPDU{Name: ".1.3.6.1.2.1.2.2.1.1.3", Type: g.Integer, Value: 3},
+		g.SnmpPDU{Name: ".1.3.6.1.2.1.31.1.1.1.6.3", Type: g.Counter64, Value: uint64(1) << 40},
+		g.SnmpPDU{Name: ".1.3.6.1.2.1.4.20.1.1", Type: g.IPAddress, Value: "10.1.1.1"},
+		g.SnmpPDU{Name: ".1.3.6.1.2.1.1.2.0", Type: g.ObjectIdentifier, Value: ".1.3.6.1.4.1.9.1.1"},
+		g.SnmpPDU{Name: ".1.3.6.1.2.1.1.9.0", Type: g.Null, Value: nil},
+	).data
+}
+
+func waitForwardQueueDepth(t *testing.T, q *forwardQueue, depth int) {
+	for i := 0; i < 500; i++ {
+		q.mu.Lock()
+		d := q.depth
+		q.mu.Unlock()
+		if d == depth {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("forward queue depth did not get to %d", depth)
+}
+
+func TestForwardQueueConfig(t *testing.T) {
+	var testConfig trapexConfig
+	testConfig.forwardQueues = make(map[string]*forwardQueueParams)
+	if err := loadConfig("tests/config/forward_queues.yml", &testConfig); err != nil {
+		t.Fatalf("%s", err)
+	}
+	if err := processForwardQueues(&testConfig); err != nil {
+		t.Fatalf("%s", err)
+	}
+	p := testConfig.forwardQueues["outage"]
+	if p == nil {
+		t.Fatalf("outage forward queue not loaded")
+	}
+	if p.Dir != "tests/tmp/forward_queues" || p.MaxSize != 64 || p.DrainRate != 50 || p.SegmentSize != 1 || p.MaxAge != 24*time.Hour || p.RetryInterval != 10*time.Second {
+		t.Errorf("outage forward queue not set correctly: %+v", p)
+	}
+	if err := processFilters(&testConfig); err != nil {
+		t.Fatalf("%s", err)
+	}
+	fwd := testConfig.filters[0].action.(*trapForwarder)
+	if fwd.queue == nil || filepath.Base(filepath.Dir(fwd.queue.dir)) != "forward_queues" || !strings.HasPrefix(filepath.Base(fwd.queue.dir), "127.0.0.1_10162-v2c-") {
+		t.Errorf("forward queue not set up for the forward action: %+v", fwd.queue)
+	}
+	if testConfig.filters[1].action.(*trapForwarder).queue != nil {
+		t.Errorf("forward action without the queue option has a queue")
+	}
+	// A different community doesn't share the queue.
+	if other := testConfig.filters[2].action.(*trapForwarder); other.queue == nil || other.queue == fwd.queue || len(fwd.queue.senders) != 1 {
+		t.Errorf("forward actions with different settings share a forward queue")
+	}
+	useTestConfig(t, &testConfig)
+	closeTrapexHandles()
+	if _, err := processFilterLine(strings.Fields("* * * * * * forward 127.0.0.1:10162 queue:nosuchqueue"), &testConfig, 2); err == nil {
+		t.Errorf("Should have detected an unknown forward queue")
+	}
+}
+
+func TestForwardQueue(t *testing.T) {
+	dir := "tests/tmp/forward_queue"
+	os.RemoveAll(dir)
+	params := forwardQueueParams{Dir: dir, SegmentSize: 1, MaxSize: 4, MaxAge: time.Hour, DrainRate: 1000, RetryInterval: 20 * time.Millisecond}
+	sender := &testSender{}
+	q, err := openForwardQueue("127.0.0.1:162", g.Version2c, "", &params, sender)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	// Traps go straight to the destination while it works.
+	q.forward(sender, forwardQueueTestTrap(1))
+	if len(sender.sentTraps()) != 1 || q.depth != 0 {
+		t.Fatalf("trap not sent directly")
+	}
+
+	// Once a send fails, traps are queued (without trying the destination
+	// until the queue drains).
+	sender.setFailing(true)
+	for i := 2; i <= 4; i++ {
+		if err := q.forward(sender, forwardQueueTestTrap(i)); err != nil {
+			t.Fatalf("%s", err)
+		}
+	}
+	waitForwardQueueDepth(t, q, 3)
+
+	// The queue survives a restart.
+	q.release(sender)
+	q, err = openForwardQueue("127.0.0.1:162", g.Version2c, "", &params, sender)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if q.depth != 3 {
+		t.Fatalf("forward queue depth after a restart should be 3: %d", q.depth)
+	}
+
+	// Queued traps are sent in order once the destination is back.
+	sender.setFailing(false)
+	waitForwardQueueDepth(t, q, 0)
+	q.forward(sender, forwardQueueTestTrap(5))
+	sent := sender.sentTraps()
+	if len(sent) != 5 {
+		t.Fatalf("expected 5 traps sent: %d", len(sent))
+	}
+	for i, trap := range sent {
+		if trap.SpecificTrap != i+1 {
+			t.Errorf("trap %d sent out of order: %d", i+1, trap.SpecificTrap)
+		}
+	}
+	if !reflect.DeepEqual(sent[2], forwardQueueTestTrap(3)) {
+		t.Errorf("queued trap does not match the original:\n%+v\n%+v", sent[2], forwardQueueTestTrap(3))
+	}
+	q.release(sender)
+	if files, _ := filepath.Glob(filepath.Join(q.dir, "*.seg")); len(files) != 0 {
+		t.Errorf("segment files not removed after draining: %v", files)
+	}
+}
+
+func TestForwardQueueLimits(t *testing.T) {
+	dir := "tests/tmp/forward_queue_limits"
+	os.RemoveAll(dir)
+	params := forwardQueueParams{Dir: dir, SegmentSize: 1, MaxSize: 2, MaxAge: time.Hour, DrainRate: 1000, RetryInterval: time.Hour}
+	sender := &testSender{failing: true}
+	q, err := openForwardQueue("127.0.0.1:162", g.Version1, "", &params, sender)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	defer q.release(sender)
+
+	// 100 KB traps, so 10 fit in a segment and 20 fit in the queue.
+	trap := forwardQueueTestTrap(1)
+	trap.Variables = append(trap.Variables, g.SnmpPDU{Name: ".1.3.6.1.2.1.1.1.0", Type: g.OctetString, Value: []byte(strings.Repeat("x", 100*1024))})
+	for i := 0; i < 35; i++ {
+		q.forward(sender, trap)
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.depth > 20 || q.depth < 10 || len(q.segments) > 3 {
+		t.Errorf("forward queue not kept under max_size: depth %d, %d segments", q.depth, len(q.segments))
+	}
+
+	params.MaxAge = time.Nanosecond
+	q.expire()
+	if q.depth != 0 || len(q.segments) != 0 {
+		t.Errorf("forward queue traps not expired: depth %d, %d segments", q.depth, len(q.segments))
+	}
+}
+
+func TestForwardQueueSendUnlocked(t *testing.T) {
+	dir := "tests/tmp/forward_queue_unlocked"
+	os.RemoveAll(dir)
+	params := forwardQueueParams{Dir: dir, SegmentSize: 1, MaxSize: 4, MaxAge: time.Hour, DrainRate: 1000, RetryInterval: time.Hour}
+	sender := &blockedSender{started: make(chan struct{}, 10), release: make(chan struct{})}
+	q, err := openForwardQueue("127.0.0.1:162", g.Version2c, "", &params, sender)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	defer q.release(sender)
+
+	// The first trap is queued, and the drainer gets stuck sending it.
+	q.forward(&testSender{failing: true}, forwardQueueTestTrap(1))
+	<-sender.started
+
+	// Traps are still queued while the drainer is sending.
+	queued := make(chan error)
+	go func() { queued <- q.forward(sender, forwardQueueTestTrap(2)) }()
+	select {
+	case err := <-queued:
+		if err != nil {
+			t.Fatalf("%s", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("forward blocked while the drainer was sending")
+	}
+	waitForwardQueueDepth(t, q, 2)
+
+	close(sender.release)
+	waitForwardQueueDepth(t, q, 0)
+	if sent := sender.sentTraps(); len(sent) != 2 || sent[0].SpecificTrap != 1 || sent[1].SpecificTrap != 2 {
+		t.Errorf("queued traps not sent in order: %+v", sent)
+	}
+}
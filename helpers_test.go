@@ -0,0 +1,128 @@
+// Copyright (c) 2021 Damien Stuart. All rights reserved.
+//
+// Use of this source code is governed by the MIT License that can be found
+// in the LICENSE file.
+//
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	g "github.com/gosnmp/gosnmp"
+)
+
+// testTrap returns a trap from 192.168.1.10 (enterprise specific, for v1)
+// with the given varbinds.
+//
+func testTrap(version g.SnmpVersion, specific int, vars ...g.SnmpPDU) *sgTrap {
+	return &sgTrap{
+		trapVer:  version,
+		srcIP:    net.ParseIP("192.168.1.10"),
+		origVars: vars,
+		data: g.SnmpTrap{
+			AgentAddress: "192.168.1.10",
+			Enterprise:   ".1.3.6.1.4.1.9",
+			GenericTrap:  6,
+			SpecificTrap: specific,
+			Variables:    vars,
+		},
+	}
+}
+
+// sysNameVar returns a sysName.0 varbind.
+//
+func sysNameVar(name string) g.SnmpPDU {
+	return g.SnmpPDU{Name: ".1.3.6.1.2.1.1.5.0", Type: g.OctetString, Value: []byte(name)}
+}
+
+// useTestConfig makes testConfig the running configuration until the test
+// ends.
+//
+func useTestConfig(t *testing.T, testConfig *trapexConfig) {
+	saved := teConfig
+	teConfig = testConfig
+	t.Cleanup(func() { teConfig = saved })
+}
+
+// captureServer records the requests posted to it, and answers with the
+// given status codes in turn, then with its status (200 unless set). It is
+// closed when the test ends.
+//
+type captureServer struct {
+	*httptest.Server
+	mu       sync.Mutex
+	statuses []int
+	status   int
+	requests []capturedRequest
+	posted   chan int
+}
+
+// capturedRequest is a request to a captureServer and the status it got.
+//
+type capturedRequest struct {
+	status int
+	header http.Header
+	query  url.Values
+	body   []byte
+}
+
+func newCaptureServer(t *testing.T, statuses ...int) *captureServer {
+	s := &captureServer{statuses: statuses, status: http.StatusOK, posted: make(chan int, 100)}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		s.mu.Lock()
+		status := s.status
+		if len(s.statuses) > 0 {
+			status, s.statuses = s.statuses[0], s.statuses[1:]
+		}
+		s.requests = append(s.requests, capturedRequest{status: status, header: r.Header, query: r.URL.Query(), body: body})
+		s.mu.Unlock()
+		w.WriteHeader(status)
+		s.posted <- status
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *captureServer) setStatus(status int) {
+	s.mu.Lock()
+	s.status = status
+	s.mu.Unlock()
+}
+
+// accepted returns the requests that were answered with 200.
+//
+func (s *captureServer) accepted() []capturedRequest {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var ok []capturedRequest
+	for _, r := range s.requests {
+		if r.status == http.StatusOK {
+			ok = append(ok, r)
+		}
+	}
+	return ok
+}
+
+func (s *captureServer) all() []capturedRequest {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]capturedRequest{}, s.requests...)
+}
+
+func (s *captureServer) waitPosts(t *testing.T, n int) {
+	for i := 0; i < n; i++ {
+		select {
+		case <-s.posted:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for request %d", i+1)
+		}
+	}
+}
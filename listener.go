@@ -0,0 +1,360 @@
+// Copyright (c) 2021 Damien Stuart. All rights reserved.
+//
+// Use of this source code is governed by the MIT License that can be found
+// in the LICENSE file.
+//
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"time"
+
+	g "github.com/gosnmp/gosnmp"
+)
+
+// BER tags we need to walk the SNMP v3 message header.
+const (
+	berInteger     byte = 0x02
+	berOctetString byte = 0x04
+	berSequence    byte = 0x30
+)
+
+// The USM counters (RFC 3414) sent back in Report PDUs
+const (
+	usmStatsNotInTimeWindows = ".1.3.6.1.6.3.15.1.1.2.0"
+	usmStatsUnknownEngineIDs = ".1.3.6.1.6.3.15.1.1.4.0"
+)
+
+// A v3 INFORM's engine time must be within this many seconds of ours.
+const usmTimeWindow = 150
+
+// How long the listener waits before reading again after an error. The wait
+// doubles for each error in a row.
+const (
+	minReadErrorDelay = 10 * time.Millisecond
+	maxReadErrorDelay = 5 * time.Second
+)
+
+// trapex is the authoritative SNMP engine for the v3 INFORMs sent to it.
+// The engine boots are the time trapex started (in seconds), so they go up
+// on each restart without keeping any state.
+//
+var (
+	engineStart = time.Now()
+	engineBoots = uint32(engineStart.Unix())
+
+	usmUnknownEngineIDs uint32
+	usmNotInTimeWindows uint32
+)
+
+// discoveryReceiver decodes the unencrypted v3 messages sent to discover
+// our engine ID.
+//
+var discoveryReceiver = &g.GoSNMP{
+	Version:            g.Version3,
+	SecurityModel:      g.UserSecurityModel,
+	MsgFlags:           g.NoAuthNoPriv,
+	SecurityParameters: &g.UsmSecurityParameters{},
+}
+
+func engineTime() uint32 {
+	return uint32(time.Since(engineStart) / time.Second)
+}
+
+// listenForTraps receives trap packets on the given address and passes them
+// on to the processing workers (trapPipeline), which decode them and call
+// trapHandler. Each v3 packet is decoded with the USM user that matches its
+// username (and engine ID, if set for that user).
+//
+func listenForTraps(listenAddr string) error {
+	udpAddr, err := net.ResolveUDPAddr("udp", listenAddr)
+	if err != nil {
+		return err
+	}
+	conn, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	pipeline := newTrapPipeline(conn, teConfig)
+	defer pipeline.close()
+
+	return readTraps(conn, pipeline)
+}
+
+// readTraps passes the packets read from conn to the pipeline until conn is
+// closed. Other read errors are retried, waiting longer (up to
+// maxReadErrorDelay) while they persist so a broken socket does not spin.
+//
+func readTraps(conn *net.UDPConn, pipeline *trapPipeline) error {
+	buf := make([]byte, 65535)
+	var delay time.Duration
+	for {
+		n, remote, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
+			if delay == 0 {
+				delay = minReadErrorDelay
+			} else if delay *= 2; delay > maxReadErrorDelay {
+				delay = maxReadErrorDelay
+			}
+			logger.Warn().Err(err).Dur("retry_in", delay).Msg("Error reading from trap listener")
+			time.Sleep(delay)
+			continue
+		}
+		delay = 0
+		// The packet is handled after buf is reused (and the decoded
+		// packet may reference the message bytes), so each packet gets its
+		// own copy.
+		msg := make([]byte, n)
+		copy(msg, buf[:n])
+		// Count every packet received, which also gives the trap its
+		// number (in the order received, not the order handled).
+		trapNumber := atomic.AddUint64(&stats.TrapCount, 1)
+		trapsCount.Inc()
+		pipeline.dispatch(msg, remote, trapNumber)
+	}
+}
+
+// sendInformResponse sends the response for an InformRequest back to the
+// sender. The response carries the same varbinds as the request. The request
+// packet itself is left as is since it may not have been handled yet.
+//
+func sendInformResponse(conn *net.UDPConn, p *g.SnmpPacket, remote *net.UDPAddr) {
+	resp := *p
+	resp.PDUType = g.GetResponse
+	resp.MsgFlags &^= g.Reportable
+	resp.Error = g.NoError
+	resp.ErrorIndex = 0
+	if usm, ok := p.SecurityParameters.(*g.UsmSecurityParameters); ok {
+		resp.SecurityParameters = localEngineParams(usm)
+	}
+	ob, err := resp.MarshalMsg()
+	if err == nil {
+		_, err = conn.WriteTo(ob, remote)
+	}
+	if err != nil {
+		atomic.AddUint64(&stats.InformErrors, 1)
+		informErrors.Inc()
+		logger.Warn().Err(err).Str("source", remote.String()).Msg("Error sending INFORM response")
+		return
+	}
+	atomic.AddUint64(&stats.InformResponses, 1)
+	informResponses.Inc()
+}
+
+// localEngineParams returns a copy of the USM params of a v3 INFORM with
+// our current engine boots and time, for a reply to it.
+//
+func localEngineParams(usm *g.UsmSecurityParameters) *g.UsmSecurityParameters {
+	sp := usm.Copy().(*g.UsmSecurityParameters)
+	sp.AuthoritativeEngineBoots = engineBoots
+	sp.AuthoritativeEngineTime = engineTime()
+	return sp
+}
+
+// sendDiscoveryReport answers a v3 message sent to another (or no) engine
+// ID, which is how a sender discovers our engine ID, boots, and time before
+// it sends an INFORM (RFC 3414 section 3.2). The request ID is only known
+// when the PDU is not encrypted.
+//
+func sendDiscoveryReport(conn *net.UDPConn, msg []byte, hdr v3Header, engineID string, remote *net.UDPAddr) {
+	var requestID uint32
+	if hdr.msgFlags&g.AuthPriv != g.AuthPriv {
+		if p := discoveryReceiver.UnmarshalTrap(msg, false); p != nil {
+			requestID = p.RequestID
+		}
+	}
+	usm := &g.UsmSecurityParameters{
+		AuthoritativeEngineID:    engineID,
+		AuthoritativeEngineBoots: engineBoots,
+		AuthoritativeEngineTime:  engineTime(),
+		UserName:                 hdr.username,
+	}
+	count := atomic.AddUint32(&usmUnknownEngineIDs, 1)
+	sendReport(conn, hdr.msgID, requestID, g.NoAuthNoPriv, usm, engineID, usmStatsUnknownEngineIDs, count, remote)
+}
+
+// inTimeWindow checks the engine boots and time of an authenticated v3
+// INFORM against ours (RFC 3414 section 3.2.7). If they are out of the
+// window, a Report with our boots and time is sent so the sender can sync
+// up and send the INFORM again.
+//
+func inTimeWindow(conn *net.UDPConn, p *g.SnmpPacket, remote *net.UDPAddr) bool {
+	usm, ok := p.SecurityParameters.(*g.UsmSecurityParameters)
+	if !ok || p.MsgFlags&g.AuthNoPriv == 0 {
+		return true
+	}
+	diff := int64(usm.AuthoritativeEngineTime) - int64(engineTime())
+	if usm.AuthoritativeEngineBoots == engineBoots && diff <= usmTimeWindow && diff >= -usmTimeWindow {
+		return true
+	}
+	logger.Debug().Str("source", remote.String()).Uint32("engine_boots", usm.AuthoritativeEngineBoots).Uint32("engine_time", usm.AuthoritativeEngineTime).Msg("v3 INFORM is not in the time window")
+	count := atomic.AddUint32(&usmNotInTimeWindows, 1)
+	sendReport(conn, p.MsgID, p.RequestID, g.AuthNoPriv, localEngineParams(usm), usm.AuthoritativeEngineID, usmStatsNotInTimeWindows, count, remote)
+	return false
+}
+
+// sendReport sends a v3 Report PDU with one of the USM counters.
+//
+func sendReport(conn *net.UDPConn, msgID uint32, requestID uint32, flags g.SnmpV3MsgFlags, usm *g.UsmSecurityParameters, engineID string, oid string, count uint32, remote *net.UDPAddr) {
+	report := &g.SnmpPacket{
+		Version:            g.Version3,
+		MsgID:              msgID,
+		MsgFlags:           flags,
+		SecurityModel:      g.UserSecurityModel,
+		SecurityParameters: usm,
+		ContextEngineID:    engineID,
+		PDUType:            g.Report,
+		RequestID:          requestID,
+		Variables:          []g.SnmpPDU{{Name: oid, Type: g.Counter32, Value: count}},
+	}
+	ob, err := report.MarshalMsg()
+	if err == nil {
+		_, err = conn.WriteTo(ob, remote)
+	}
+	if err != nil {
+		logger.Warn().Err(err).Str("source", remote.String()).Msg("Error sending v3 Report")
+	}
+}
+
+// receiverParams returns the gosnmp parameters to use for decoding the given
+// packet. v3 packets are matched against the snmpv3_users table; anything else
+// (including v3 users not in the table) uses the snmpv3 section params.
+//
+func (c *trapexConfig) receiverParams(msg []byte) *g.GoSNMP {
+	username, engineID, err := peekUsmParams(msg)
+	if err != nil {
+		return c.V3Params.receiver
+	}
+	var fallback *g.GoSNMP
+	for _, user := range c.v3Users[username] {
+		if user.engineID == engineID {
+			return user.receiver
+		}
+		if user.engineID == "" && fallback == nil {
+			fallback = user.receiver
+		}
+	}
+	if fallback != nil {
+		return fallback
+	}
+	return c.V3Params.receiver
+}
+
+// peekUsmParams pulls the USM username and authoritative engine ID out of an
+// SNMP v3 message without decoding the rest of it. An error is returned for
+// anything that is not a well-formed v3 USM message.
+//
+func peekUsmParams(msg []byte) (string, string, error) {
+	hdr, err := peekV3Header(msg)
+	return hdr.username, hdr.engineID, err
+}
+
+// v3Header holds the parts of an SNMP v3 message header that are needed
+// before it can be decoded.
+//
+type v3Header struct {
+	msgID    uint32
+	msgFlags g.SnmpV3MsgFlags
+	engineID string
+	username string
+}
+
+// peekV3Header reads the header of an SNMP v3 USM message.
+//
+func peekV3Header(msg []byte) (v3Header, error) {
+	var hdr v3Header
+	tag, message, _, err := readBerTLV(msg)
+	if err != nil {
+		return hdr, err
+	}
+	if tag != berSequence {
+		return hdr, fmt.Errorf("not an SNMP message")
+	}
+	tag, version, rest, err := readBerTLV(message)
+	if err != nil {
+		return hdr, err
+	}
+	if tag != berInteger || len(version) != 1 || version[0] != byte(g.Version3) {
+		return hdr, fmt.Errorf("not an SNMP v3 message")
+	}
+	// msgGlobalData holds the sequence of: message ID, max size, flags,
+	// and security model.
+	tag, global, rest, err := readBerTLV(rest)
+	if err != nil {
+		return hdr, err
+	}
+	if tag != berSequence {
+		return hdr, fmt.Errorf("invalid msgGlobalData")
+	}
+	var globalFields [3][]byte
+	for i := range globalFields {
+		if _, globalFields[i], global, err = readBerTLV(global); err != nil {
+			return hdr, err
+		}
+	}
+	if len(globalFields[0]) > 5 || len(globalFields[2]) != 1 {
+		return hdr, fmt.Errorf("invalid msgGlobalData")
+	}
+	for _, b := range globalFields[0] {
+		hdr.msgID = hdr.msgID<<8 | uint32(b)
+	}
+	hdr.msgFlags = g.SnmpV3MsgFlags(globalFields[2][0])
+
+	tag, secParams, _, err := readBerTLV(rest)
+	if err != nil {
+		return hdr, err
+	}
+	if tag != berOctetString {
+		return hdr, fmt.Errorf("invalid msgSecurityParameters")
+	}
+	// msgSecurityParameters holds the USM sequence of: engine ID, engine
+	// boots, engine time, and username (followed by auth/priv params).
+	_, usm, _, err := readBerTLV(secParams)
+	if err != nil {
+		return hdr, err
+	}
+	var fields [4][]byte
+	for i := range fields {
+		if _, fields[i], usm, err = readBerTLV(usm); err != nil {
+			return hdr, err
+		}
+	}
+	hdr.engineID = string(fields[0])
+	hdr.username = string(fields[3])
+	return hdr, nil
+}
+
+// readBerTLV reads a single BER tag-length-value from the start of b, and
+// returns the tag, the value, and whatever follows it.
+//
+func readBerTLV(b []byte) (byte, []byte, []byte, error) {
+	if len(b) < 2 {
+		return 0, nil, nil, fmt.Errorf("truncated BER data")
+	}
+	tag := b[0]
+	length := int(b[1])
+	offset := 2
+	if length&0x80 != 0 {
+		n := length & 0x7f
+		if n == 0 || n > 3 || len(b) < offset+n {
+			return 0, nil, nil, fmt.Errorf("invalid BER length")
+		}
+		length = 0
+		for _, lb := range b[offset : offset+n] {
+			length = length<<8 | int(lb)
+		}
+		offset += n
+	}
+	if len(b) < offset+length {
+		return 0, nil, nil, fmt.Errorf("truncated BER data")
+	}
+	return tag, b[offset : offset+length], b[offset+length:], nil
+}
@@ -0,0 +1,254 @@
+// Copyright (c) 2021 Damien Stuart. All rights reserved.
+//
+// Use of this source code is governed by the MIT License that can be found
+// in the LICENSE file.
+//
+package main
+
+import (
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	g "github.com/gosnmp/gosnmp"
+)
+
+// makeV3TrapPacket encodes a NoAuthNoPriv v3 trap from the given user and
+// engine ID.
+//
+func makeV3TrapPacket(t *testing.T, username string, engineID string) []byte {
+	p := &g.SnmpPacket{
+		Version:       g.Version3,
+		MsgFlags:      g.NoAuthNoPriv,
+		SecurityModel: g.UserSecurityModel,
+		SecurityParameters: &g.UsmSecurityParameters{
+			UserName:              username,
+			AuthoritativeEngineID: engineID,
+		},
+		ContextEngineID: engineID,
+		PDUType:         g.SNMPv2Trap,
+		MsgMaxSize:      65507,
+		Variables: []g.SnmpPDU{
+			{Name: sysUpTime, Type: g.TimeTicks, Value: uint32(100)},
+			{Name: snmpTrapOID, Type: g.ObjectIdentifier, Value: ".1.3.6.1.6.3.1.1.5.1"},
+		},
+	}
+	msg, err := p.MarshalMsg()
+	if err != nil {
+		t.Fatalf("unable to encode v3 trap: %s", err)
+	}
+	return msg
+}
+
+func TestPeekUsmParams(t *testing.T) {
+	engineID := "\x80\x00\x1f\x88\x80\x56\xc5\xd6\xa3"
+	username, gotEngineID, err := peekUsmParams(makeV3TrapPacket(t, "router_user", engineID))
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if username != "router_user" || gotEngineID != engineID {
+		t.Errorf("got username %q and engine ID %x", username, gotEngineID)
+	}
+
+	if _, _, err = peekUsmParams([]byte{0x30, 0x03, 0x02, 0x01, 0x01}); err == nil {
+		t.Errorf("Should not have found USM params in a v2c message")
+	}
+	if _, _, err = peekUsmParams([]byte{0x30, 0x82, 0x01}); err == nil {
+		t.Errorf("Should have detected a truncated message")
+	}
+}
+
+func TestReceiverParams(t *testing.T) {
+	var testConfig trapexConfig
+	loadConfig("tests/config/snmpv3_users.yml", &testConfig)
+	if err := validateSnmpV3Args(&testConfig); err != nil {
+		t.Fatalf("%s", err)
+	}
+	if err := processV3Users(&testConfig); err != nil {
+		t.Fatalf("%s", err)
+	}
+	routers := testConfig.v3Users["router_user"]
+	coreEngineID := routers[1].engineID
+
+	if r := testConfig.receiverParams(makeV3TrapPacket(t, "router_user", coreEngineID)); r != routers[1].receiver {
+		t.Errorf("router_user with a matching engine ID did not get its own receiver params")
+	}
+	if r := testConfig.receiverParams(makeV3TrapPacket(t, "router_user", "\x80\x00\x00\x00\x01")); r != routers[0].receiver {
+		t.Errorf("router_user with another engine ID did not get the receiver params without an engine ID")
+	}
+	if r := testConfig.receiverParams(makeV3TrapPacket(t, "someone_else", coreEngineID)); r != testConfig.V3Params.receiver {
+		t.Errorf("unknown user did not fall back to the snmpv3 section receiver params")
+	}
+
+	lab := testConfig.v3Users["lab_user"][0]
+	msg := makeV3TrapPacket(t, "lab_user", coreEngineID)
+	p := testConfig.receiverParams(msg).UnmarshalTrap(msg, false)
+	if p == nil || p.SecurityParameters.(*g.UsmSecurityParameters).UserName != lab.Username {
+		t.Errorf("unable to decode a trap from lab_user: %+v", p)
+	}
+}
+
+func TestSendInformResponse(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	defer conn.Close()
+	sender, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	defer sender.Close()
+
+	inform := &g.SnmpPacket{
+		Version:   g.Version2c,
+		Community: "public",
+		PDUType:   g.InformRequest,
+		RequestID: 4242,
+		Variables: []g.SnmpPDU{
+			{Name: sysUpTime, Type: g.TimeTicks, Value: uint32(100)},
+			{Name: snmpTrapOID, Type: g.ObjectIdentifier, Value: ".1.3.6.1.6.3.1.1.5.1"},
+		},
+	}
+	sendInformResponse(conn, inform, sender.LocalAddr().(*net.UDPAddr))
+	if inform.PDUType != g.InformRequest {
+		t.Errorf("the inform request packet was modified: %v", inform.PDUType)
+	}
+
+	buf := make([]byte, 4096)
+	sender.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, _, err := sender.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatalf("no INFORM response received: %s", err)
+	}
+	resp, err := g.Default.SnmpDecodePacket(buf[:n])
+	if err != nil {
+		t.Fatalf("unable to decode INFORM response: %s", err)
+	}
+	if resp.PDUType != g.GetResponse || resp.RequestID != 4242 || len(resp.Variables) != 2 {
+		t.Errorf("INFORM response is not correct: %+v", resp)
+	}
+}
+
+// startTestListener runs a listener for the configuration on a local port
+// until conn is closed.
+//
+func startTestListener(t *testing.T, testConfig *trapexConfig) (*net.UDPConn, *trapPipeline) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	pipeline := newTrapPipeline(conn, testConfig)
+	go readTraps(conn, pipeline)
+	return conn, pipeline
+}
+
+func TestReadTrapsClosed(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	pipeline := newTrapPipeline(conn, &trapexConfig{})
+	defer pipeline.close()
+	done := make(chan error, 1)
+	go func() { done <- readTraps(conn, pipeline) }()
+	conn.Close()
+	select {
+	case err := <-done:
+		if !errors.Is(err, net.ErrClosed) {
+			t.Errorf("unexpected error from a closed listener: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("listener did not stop when its connection was closed")
+	}
+}
+
+func TestV3InformRoundTrip(t *testing.T) {
+	var testConfig trapexConfig
+	if err := loadConfig("tests/config/snmpv3_users.yml", &testConfig); err != nil {
+		t.Fatalf("%s", err)
+	}
+	testConfig.General.Hostname = "informs"
+	for _, step := range []func(*trapexConfig) error{validateInformResponse, validateActionQueue, validateSnmpV3Args, processV3Users, processFilters} {
+		if err := step(&testConfig); err != nil {
+			t.Fatalf("%s", err)
+		}
+	}
+	teConfig = &testConfig
+	defer closeTrapexHandles()
+	conn, pipeline := startTestListener(t, &testConfig)
+	defer pipeline.close()
+	defer conn.Close()
+
+	sendInform := func(usm *g.UsmSecurityParameters) (*g.SnmpPacket, error) {
+		sender := &g.GoSNMP{
+			Target:             "127.0.0.1",
+			Port:               uint16(conn.LocalAddr().(*net.UDPAddr).Port),
+			Version:            g.Version3,
+			SecurityModel:      g.UserSecurityModel,
+			MsgFlags:           g.AuthPriv,
+			SecurityParameters: usm,
+			Timeout:            500 * time.Millisecond,
+			Retries:            1,
+		}
+		if err := sender.Connect(); err != nil {
+			t.Fatalf("%s", err)
+		}
+		defer sender.Conn.Close()
+		return sender.SendTrap(g.SnmpTrap{
+			IsInform:  true,
+			Variables: []g.SnmpPDU{{Name: snmpTrapOID, Type: g.ObjectIdentifier, Value: ".1.3.6.1.6.3.1.1.5.1"}},
+		})
+	}
+	// The snmpv3 section user
+	informUser := func() *g.UsmSecurityParameters {
+		return &g.UsmSecurityParameters{
+			UserName:                 "myuser",
+			AuthenticationProtocol:   g.SHA,
+			AuthenticationPassphrase: "v3authPass",
+			PrivacyProtocol:          g.AES,
+			PrivacyPassphrase:        "v3privPW",
+		}
+	}
+
+	// The sender first discovers our engine ID, boots, and time.
+	handled := atomic.LoadUint64(&stats.HandledTraps)
+	usm := informUser()
+	resp, err := sendInform(usm)
+	if err != nil || resp.PDUType != g.GetResponse {
+		t.Fatalf("no response to a v3 INFORM: %v %+v", err, resp)
+	}
+	if usm.AuthoritativeEngineID != testConfig.General.engineID || usm.AuthoritativeEngineBoots != engineBoots {
+		t.Errorf("sender did not discover our engine: %x %d", usm.AuthoritativeEngineID, usm.AuthoritativeEngineBoots)
+	}
+
+	// A sender with an old engine boots value gets our boots and time, and
+	// sends the INFORM again.
+	usm = informUser()
+	usm.AuthoritativeEngineID = testConfig.General.engineID
+	usm.AuthoritativeEngineBoots = engineBoots - 1
+	usm.AuthoritativeEngineTime = 12345
+	resp, err = sendInform(usm)
+	if err != nil || resp.PDUType != g.GetResponse {
+		t.Fatalf("no response to a v3 INFORM out of the time window: %v %+v", err, resp)
+	}
+	if usm.AuthoritativeEngineBoots != engineBoots {
+		t.Errorf("sender did not get our engine boots: %d", usm.AuthoritativeEngineBoots)
+	}
+	for i := 0; i < 100 && atomic.LoadUint64(&stats.HandledTraps)-handled < 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := atomic.LoadUint64(&stats.HandledTraps) - handled; n != 2 {
+		t.Errorf("expected 2 handled INFORMs, got %d", n)
+	}
+
+	// Ignored versions get no response.
+	configLock.Lock()
+	testConfig.General.ignoreVersions = []g.SnmpVersion{g.Version3}
+	configLock.Unlock()
+	if _, err = sendInform(informUser()); err == nil {
+		t.Errorf("got a response to an INFORM for an ignored version")
+	}
+}
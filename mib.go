@@ -0,0 +1,568 @@
+// Copyright (c) 2021 Damien Stuart. All rights reserved.
+//
+// Use of this source code is governed by the MIT License that can be found
+// in the LICENSE file.
+//
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	g "github.com/gosnmp/gosnmp"
+)
+
+// Macros whose invocations assign an OID to a name. TRAP-TYPE (SMIv1) is
+// handled a little differently since its value is a trap number under the
+// ENTERPRISE OID.
+//
+var mibOIDMacros = map[string]bool{
+	"OBJECT-TYPE":        true,
+	"NOTIFICATION-TYPE":  true,
+	"MODULE-IDENTITY":    true,
+	"OBJECT-IDENTITY":    true,
+	"OBJECT-GROUP":       true,
+	"NOTIFICATION-GROUP": true,
+	"MODULE-COMPLIANCE":  true,
+	"AGENT-CAPABILITIES": true,
+	"TRAP-TYPE":          true,
+}
+
+// mibWellKnown are the top of the OID tree, used when the MIB files that
+// define them (SNMPv2-SMI, RFC1155-SMI) are not loaded.
+//
+var mibWellKnown = map[string]string{
+	"ccitt":           "0",
+	"iso":             "1",
+	"joint-iso-ccitt": "2",
+	"org":             "1.3",
+	"dod":             "1.3.6",
+	"internet":        "1.3.6.1",
+	"directory":       "1.3.6.1.1",
+	"mgmt":            "1.3.6.1.2",
+	"mib-2":           "1.3.6.1.2.1",
+	"transmission":    "1.3.6.1.2.1.10",
+	"experimental":    "1.3.6.1.3",
+	"private":         "1.3.6.1.4",
+	"enterprises":     "1.3.6.1.4.1",
+	"security":        "1.3.6.1.5",
+	"snmpV2":          "1.3.6.1.6",
+	"snmpDomains":     "1.3.6.1.6.1",
+	"snmpProxys":      "1.3.6.1.6.2",
+	"snmpModules":     "1.3.6.1.6.3",
+}
+
+// mibNode is a named node of the OID tree loaded from the MIB files.
+//
+type mibNode struct {
+	module string
+	name   string
+	oid    string         // Dotted numeric OID (no leading dot)
+	enums  map[int]string // Labels for enumerated INTEGER values
+}
+
+// mibDB holds the OID names loaded from a set of MIB files.
+//
+type mibDB struct {
+	byOID  map[string]*mibNode
+	byName map[string]*mibNode // By "MODULE::name" and by plain name
+	// Plain names that more than one module gives a different OID, and the
+	// modules that define them
+	ambiguous map[string][]string
+}
+
+// mibModule is a MIB module as parsed from a MIB file, before the OIDs
+// are resolved.
+//
+type mibModule struct {
+	name    string
+	imports map[string]string // Imported name -> module
+	defs    map[string]*mibDef
+	types   map[string]map[int]string // Enums of textual conventions and types
+}
+
+// mibDef is an OID assignment in a MIB module: the OID is the parent's OID
+// followed by subIDs.
+//
+type mibDef struct {
+	parent string
+	subIDs []int
+	syntax string
+	enums  map[int]string
+}
+
+// loadMibs loads all of the MIB files in the given directories.
+//
+func loadMibs(dirs []string) (*mibDB, error) {
+	modules := make(map[string]*mibModule)
+	for _, dir := range dirs {
+		files, err := ioutil.ReadDir(dir)
+		if err != nil {
+			return nil, err
+		}
+		for _, fi := range files {
+			if fi.IsDir() || strings.HasPrefix(fi.Name(), ".") {
+				continue
+			}
+			data, err := ioutil.ReadFile(filepath.Join(dir, fi.Name()))
+			if err != nil {
+				return nil, err
+			}
+			mods := parseMibModules(tokenizeMib(string(data)))
+			if len(mods) == 0 {
+				logger.Debug().Str("file", fi.Name()).Msg("No MIB modules found in file")
+			}
+			for _, m := range mods {
+				modules[m.name] = m
+			}
+		}
+	}
+
+	db := &mibDB{
+		byOID:     make(map[string]*mibNode),
+		byName:    make(map[string]*mibNode),
+		ambiguous: make(map[string][]string),
+	}
+	// Go through the modules in order so the same OID defined in more than
+	// one module always gets the same name.
+	moduleNames := make([]string, 0, len(modules))
+	for name := range modules {
+		moduleNames = append(moduleNames, name)
+	}
+	sort.Strings(moduleNames)
+	r := mibResolver{modules: modules, names: moduleNames, oids: make(map[string]string)}
+	for _, modName := range moduleNames {
+		m := modules[modName]
+		for name, def := range m.defs {
+			oid, ok := r.resolve(m, name, 0)
+			if !ok {
+				logger.Debug().Str("module", m.name).Str("name", name).Msg("Unable to resolve MIB OID")
+				continue
+			}
+			node := &mibNode{module: m.name, name: name, oid: oid, enums: def.enums}
+			if node.enums == nil && def.syntax != "" {
+				node.enums = r.typeEnums(m, def.syntax)
+			}
+			if _, ok := db.byOID[oid]; !ok {
+				db.byOID[oid] = node
+			}
+			db.byName[m.name+"::"+name] = node
+			if n, ok := db.byName[name]; !ok {
+				db.byName[name] = node
+			} else if n.oid != oid {
+				if db.ambiguous[name] == nil {
+					db.ambiguous[name] = []string{n.module}
+				}
+				db.ambiguous[name] = append(db.ambiguous[name], m.name)
+			}
+		}
+	}
+	for name, mods := range db.ambiguous {
+		delete(db.byName, name)
+		sort.Strings(mods)
+		logger.Debug().Str("name", name).Strs("modules", mods).Msg("MIB name is defined by more than one module")
+	}
+	logger.Info().Int("modules", len(modules)).Int("nodes", len(db.byOID)).Msg("Loaded MIBs")
+	return db, nil
+}
+
+// mibResolver resolves names to numeric OIDs across the parsed modules.
+//
+type mibResolver struct {
+	modules map[string]*mibModule
+	names   []string          // Module names, sorted
+	oids    map[string]string // "MODULE::name" -> OID
+}
+
+func (r *mibResolver) resolve(m *mibModule, name string, depth int) (string, bool) {
+	if depth > 64 {
+		return "", false
+	}
+	if oid, ok := r.oids[m.name+"::"+name]; ok {
+		return oid, true
+	}
+	def, ok := m.defs[name]
+	if !ok {
+		// Follow the import, or look for the name in the other modules
+		// (SMIv1 MIBs are not always careful with their imports). A name
+		// that they give different OIDs is ambiguous.
+		if from, ok := m.imports[name]; ok {
+			if fm, ok := r.modules[from]; ok {
+				if oid, ok := r.resolve(fm, name, depth+1); ok {
+					return oid, true
+				}
+			}
+		}
+		var found string
+		for _, modName := range r.names {
+			om := r.modules[modName]
+			if _, ok := om.defs[name]; !ok || om == m {
+				continue
+			}
+			oid, ok := r.resolve(om, name, depth+1)
+			if !ok {
+				continue
+			}
+			if found != "" && oid != found {
+				logger.Debug().Str("module", m.name).Str("name", name).Msg("MIB name is not imported and is defined by more than one module")
+				return "", false
+			}
+			found = oid
+		}
+		if found != "" {
+			return found, true
+		}
+		oid, ok := mibWellKnown[name]
+		return oid, ok
+	}
+	var oid string
+	if def.parent != "" {
+		if oid, ok = r.resolve(m, def.parent, depth+1); !ok {
+			return "", false
+		}
+	}
+	for _, id := range def.subIDs {
+		if oid == "" {
+			oid = strconv.Itoa(id)
+		} else {
+			oid += "." + strconv.Itoa(id)
+		}
+	}
+	r.oids[m.name+"::"+name] = oid
+	return oid, true
+}
+
+// typeEnums returns the enums of a named syntax (textual convention or type
+// assignment) from the module or the module it was imported from.
+//
+func (r *mibResolver) typeEnums(m *mibModule, syntax string) map[int]string {
+	if enums, ok := m.types[syntax]; ok {
+		return enums
+	}
+	if from, ok := m.imports[syntax]; ok {
+		if fm, ok := r.modules[from]; ok {
+			return fm.types[syntax]
+		}
+	}
+	return nil
+}
+
+// tokenizeMib splits MIB text into tokens, dropping comments. Quoted strings
+// are kept as single tokens.
+//
+func tokenizeMib(data string) []string {
+	var tokens []string
+	for i := 0; i < len(data); {
+		c := data[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\r' || c == '\n' || c == '\f':
+			i++
+		case strings.HasPrefix(data[i:], "--"):
+			// Comments are taken to run to the end of the line. A closing
+			// "--" is allowed by ASN.1, but MIB files often have lines of
+			// dashes that would then leave some of the comment as tokens.
+			end := strings.IndexByte(data[i:], '\n')
+			if end < 0 {
+				end = len(data) - i
+			}
+			i += end
+		case c == '"':
+			end := strings.IndexByte(data[i+1:], '"') + i + 2
+			if end < i+2 {
+				end = len(data)
+			}
+			tokens = append(tokens, data[i:end])
+			i = end
+		case strings.HasPrefix(data[i:], "::="):
+			tokens = append(tokens, "::=")
+			i += 3
+		case strings.HasPrefix(data[i:], ".."):
+			tokens = append(tokens, "..")
+			i += 2
+		case strings.IndexByte("{}()[],;|.:", c) >= 0:
+			tokens = append(tokens, string(c))
+			i++
+		case c == '\'':
+			// Binary or hex strings: 'xxxx'H
+			end := strings.IndexByte(data[i+1:], '\'') + i + 2
+			if end < i+2 {
+				end = len(data)
+			}
+			if end < len(data) && (data[end] == 'H' || data[end] == 'h' || data[end] == 'B' || data[end] == 'b') {
+				end++
+			}
+			tokens = append(tokens, data[i:end])
+			i = end
+		default:
+			end := i + 1
+			for end < len(data) && isMibWordChar(data[end]) && !strings.HasPrefix(data[end:], "--") {
+				end++
+			}
+			tokens = append(tokens, data[i:end])
+			i = end
+		}
+	}
+	return tokens
+}
+
+func isMibWordChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_'
+}
+
+// parseMibModules picks the OID assignments, imports, and enumerations out
+// of the tokens of a MIB file. Anything else is skipped over.
+//
+func parseMibModules(tokens []string) []*mibModule {
+	var modules []*mibModule
+	var m *mibModule
+	tok := func(i int) string {
+		if i < len(tokens) {
+			return tokens[i]
+		}
+		return ""
+	}
+
+	for i := 0; i < len(tokens); {
+		t := tokens[i]
+		if tok(i+1) == "DEFINITIONS" {
+			m = &mibModule{name: t, imports: make(map[string]string), defs: make(map[string]*mibDef), types: make(map[string]map[int]string)}
+			modules = append(modules, m)
+			for i < len(tokens) && tokens[i] != "BEGIN" {
+				i++
+			}
+			i++
+			continue
+		}
+		if m == nil {
+			i++
+			continue
+		}
+
+		switch {
+		case t == "IMPORTS":
+			var names []string
+			for i++; i < len(tokens) && tokens[i] != ";"; i++ {
+				if tokens[i] == "FROM" {
+					for _, n := range names {
+						m.imports[n] = tok(i + 1)
+					}
+					names = nil
+					i++
+				} else if tokens[i] != "," {
+					names = append(names, tokens[i])
+				}
+			}
+			i++
+		case t == "END":
+			m = nil
+			i++
+		case tok(i+1) == "MACRO":
+			for i < len(tokens) && tokens[i] != "END" {
+				i++
+			}
+			i++
+		case tok(i+1) == "OBJECT" && tok(i+2) == "IDENTIFIER" && tok(i+3) == "::=":
+			i = m.parseOIDValue(t, tokens, i+4)
+		case mibOIDMacros[tok(i+1)] && isMibValueName(t):
+			def := &mibDef{}
+			var enterprise string
+			j := i + 2
+			for ; j < len(tokens) && tokens[j] != "::="; j++ {
+				switch tokens[j] {
+				case "SYNTAX":
+					if def.syntax == "" && def.enums == nil {
+						def.syntax = tok(j + 1)
+						if tok(j+2) == "{" && def.syntax == "INTEGER" {
+							def.enums, j = parseMibEnums(tokens, j+2)
+						}
+					}
+				case "ENTERPRISE":
+					enterprise = tok(j + 1)
+				}
+			}
+			if tok(i+1) == "TRAP-TYPE" {
+				// v1 traps are named as their RFC 3584 OID:
+				// <enterprise>.0.<specific>
+				if n, err := strconv.Atoi(tok(j + 1)); err == nil && enterprise != "" {
+					def.parent = enterprise
+					def.subIDs = []int{0, n}
+					m.defs[t] = def
+				}
+				i = j + 2
+			} else {
+				i = m.parseOIDValue(t, tokens, j+1)
+				if d, ok := m.defs[t]; ok {
+					d.syntax, d.enums = def.syntax, def.enums
+				}
+			}
+		case tok(i+1) == "::=" && tok(i+2) == "TEXTUAL-CONVENTION":
+			j := i + 3
+			for j < len(tokens) && tokens[j] != "SYNTAX" {
+				j++
+			}
+			if tok(j+1) == "INTEGER" && tok(j+2) == "{" {
+				m.types[t], j = parseMibEnums(tokens, j+2)
+			}
+			i = j + 1
+		case tok(i+1) == "::=" && tok(i+2) == "INTEGER" && tok(i+3) == "{":
+			m.types[t], i = parseMibEnums(tokens, i+3)
+		default:
+			i++
+		}
+	}
+	return modules
+}
+
+// parseOIDValue parses an OID value ("{ parent 1 2 }" or "{ iso org(3) 6 }")
+// starting at tokens[i], and adds the definition for name (and any named
+// sub-identifiers along the way). Returns the index after the value.
+//
+func (m *mibModule) parseOIDValue(name string, tokens []string, i int) int {
+	if i >= len(tokens) || tokens[i] != "{" {
+		return i
+	}
+	def := &mibDef{}
+	for i++; i < len(tokens) && tokens[i] != "}"; i++ {
+		t := tokens[i]
+		if n, err := strconv.Atoi(t); err == nil {
+			def.subIDs = append(def.subIDs, n)
+			continue
+		}
+		// A "name(n)" sub-identifier also names that node.
+		if i+3 < len(tokens) && tokens[i+1] == "(" && tokens[i+3] == ")" {
+			if n, err := strconv.Atoi(tokens[i+2]); err == nil {
+				def.subIDs = append(def.subIDs, n)
+				if _, ok := m.defs[t]; !ok {
+					m.defs[t] = &mibDef{parent: def.parent, subIDs: append([]int(nil), def.subIDs...)}
+				}
+				def = &mibDef{parent: t}
+				i += 3
+				continue
+			}
+		}
+		if def.parent == "" && len(def.subIDs) == 0 {
+			def.parent = t
+		}
+	}
+	if len(def.subIDs) == 0 && def.parent != "" {
+		// A name(n) last sub-identifier was the value itself.
+		if d, ok := m.defs[def.parent]; ok && def.parent != name {
+			def = &mibDef{parent: d.parent, subIDs: d.subIDs}
+		}
+	}
+	m.defs[name] = def
+	return i + 1
+}
+
+// parseMibEnums parses "{ label(n), ... }" starting at tokens[i] and returns
+// the enums and the index after the closing brace.
+//
+func parseMibEnums(tokens []string, i int) (map[int]string, int) {
+	enums := make(map[int]string)
+	for i++; i < len(tokens) && tokens[i] != "}"; i++ {
+		if i+3 < len(tokens) && tokens[i+1] == "(" && tokens[i+3] == ")" {
+			if n, err := strconv.Atoi(tokens[i+2]); err == nil {
+				enums[n] = tokens[i]
+			}
+			i += 3
+		}
+	}
+	return enums, i + 1
+}
+
+// isMibValueName returns true for names of values (which start in lower
+// case), as opposed to types and macros.
+//
+func isMibValueName(name string) bool {
+	return name != "" && name[0] >= 'a' && name[0] <= 'z'
+}
+
+// lookup returns the node for the longest known prefix of the OID, and the
+// remaining sub-identifiers (with a leading dot).
+//
+func (db *mibDB) lookup(oid string) (*mibNode, string) {
+	oid = strings.TrimLeft(oid, ".")
+	for p := oid; p != ""; {
+		if n, ok := db.byOID[p]; ok {
+			return n, oid[len(p):]
+		}
+		i := strings.LastIndex(p, ".")
+		if i < 0 {
+			break
+		}
+		p = p[:i]
+	}
+	return nil, ""
+}
+
+// oidName returns the symbolic form of a numeric OID, e.g. 1.3.6.1.2.1.2.2.1.8.3
+// becomes IF-MIB::ifOperStatus.3. The OID (without a leading dot) is returned
+// if no MIBs are loaded or no part of it has a name.
+//
+func (db *mibDB) oidName(oid string) string {
+	if db != nil {
+		if n, rest := db.lookup(oid); n != nil {
+			return n.module + "::" + n.name + rest
+		}
+	}
+	return strings.TrimLeft(oid, ".")
+}
+
+// resolveName returns the numeric OID for a symbolic name with an optional
+// instance suffix, e.g. IF-MIB::linkDown or ifIndex.3. Numeric OIDs are
+// returned as is.
+//
+func (db *mibDB) resolveName(name string) (string, error) {
+	name = strings.TrimLeft(name, ".")
+	base, rest := name, ""
+	// Module names can't contain dots, so the first dot after any module
+	// name starts the sub-identifiers.
+	start := strings.Index(name, "::") + 1
+	if i := strings.Index(name[start:], "."); i >= 0 {
+		base, rest = name[:start+i], name[start+i:]
+	}
+	if _, err := strconv.Atoi(base); err == nil {
+		return name, nil
+	}
+	if db == nil {
+		return "", fmt.Errorf("unknown OID name (no MIBs are loaded): %s", base)
+	}
+	n, ok := db.byName[base]
+	if mods, ambiguous := db.ambiguous[base]; ambiguous && !ok {
+		return "", fmt.Errorf("ambiguous OID name %s (use MODULE::%s, defined by %s)", base, base, strings.Join(mods, ", "))
+	}
+	if !ok {
+		return "", fmt.Errorf("unknown OID name: %s", base)
+	}
+	return n.oid + rest, nil
+}
+
+// formatValue returns the varbind value with enumerated INTEGER values as
+// "label(n)" and OID values by name. ok is false if there is no symbolic
+// form of the value.
+//
+func (db *mibDB) formatValue(v g.SnmpPDU) (string, bool) {
+	if db == nil {
+		return "", false
+	}
+	switch v.Type {
+	case g.Integer:
+		n, _ := db.lookup(v.Name)
+		if n == nil || n.enums == nil {
+			return "", false
+		}
+		label, ok := n.enums[v.Value.(int)]
+		if !ok {
+			return "", false
+		}
+		return fmt.Sprintf("%s(%d)", label, v.Value.(int)), true
+	case g.ObjectIdentifier:
+		name := db.oidName(v.Value.(string))
+		return name, name != strings.TrimLeft(v.Value.(string), ".")
+	}
+	return "", false
+}
@@ -0,0 +1,148 @@
+// Copyright (c) 2021 Damien Stuart. All rights reserved.
+//
+// Use of this source code is governed by the MIT License that can be found
+// in the LICENSE file.
+//
+package main
+
+import (
+	"strings"
+	"testing"
+
+	g "github.com/gosnmp/gosnmp"
+)
+
+func TestLoadMibs(t *testing.T) {
+	mibs, err := loadMibs([]string{"tests/mibs"})
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	names := []struct {
+		oid  string
+		name string
+	}{
+		{".1.3.6.1.6.3.1.1.5.3", "IF-MIB::linkDown"},
+		{".1.3.6.1.6.3.1.1.5.1", "SNMPv2-MIB::coldStart"},
+		{"1.3.6.1.6.3.1.1.4.1.0", "SNMPv2-MIB::snmpTrapOID.0"},
+		{".1.3.6.1.2.1.2.2.1.8.12", "IF-MIB::ifOperStatus.12"},
+		{".1.3.6.1.2.1.1.3.0", "SNMPv2-MIB::sysUpTime.0"},
+		{".1.3.6.1.2.1.31", "IF-MIB::ifMIB"},
+		{".1.3.6.1.4.1.99999.0.7", "ACME-MIB::acmeAlarm"},
+		{".1.3.6.1.4.1.99999.1.2.0", "ACME-MIB::acmeAlarmText.0"},
+		{".1.3.6.1.4.1.12345.1", "1.3.6.1.4.1.12345.1"},
+	}
+	for _, n := range names {
+		if got := mibs.oidName(n.oid); got != n.name {
+			t.Errorf("name for %s: got %s, want %s", n.oid, got, n.name)
+		}
+	}
+
+	for name, want := range map[string]string{
+		"IF-MIB::linkDown":     "1.3.6.1.6.3.1.1.5.3",
+		"linkUp":               "1.3.6.1.6.3.1.1.5.4",
+		"IF-MIB::ifIndex.3":    "1.3.6.1.2.1.2.2.1.1.3",
+		"ACME-MIB::acmeAlarm":  "1.3.6.1.4.1.99999.0.7",
+		".1.3.6.1.2.1.2.2.1.1": "1.3.6.1.2.1.2.2.1.1",
+	} {
+		if got, err := mibs.resolveName(name); err != nil || got != want {
+			t.Errorf("OID for %s: got %s (%v), want %s", name, got, err, want)
+		}
+	}
+	if _, err := mibs.resolveName("IF-MIB::ifBogus"); err == nil {
+		t.Errorf("Should have failed to resolve an unknown name")
+	}
+
+	// acmeAlarmText is in ACME-MIB and ACME-LEGACY-MIB with different OIDs.
+	if _, err := mibs.resolveName("acmeAlarmText.0"); err == nil || !strings.Contains(err.Error(), "ACME-LEGACY-MIB, ACME-MIB") {
+		t.Errorf("Should have failed to resolve an ambiguous name: %v", err)
+	}
+	if got, err := mibs.resolveName("ACME-LEGACY-MIB::acmeAlarmText.0"); err != nil || got != "1.3.6.1.4.1.99998.2.0" {
+		t.Errorf("OID for ACME-LEGACY-MIB::acmeAlarmText.0: got %s (%v)", got, err)
+	}
+	// Names used without an import are looked up in the other modules.
+	if got, err := mibs.resolveName("ACME-EXTRA-MIB::acmeExtra"); err != nil || got != "1.3.6.1.4.1.99999.1.9" {
+		t.Errorf("OID for ACME-EXTRA-MIB::acmeExtra: got %s (%v)", got, err)
+	}
+	if got, err := mibs.resolveName("ACME-EXTRA-MIB::acmeTextExtra"); err == nil {
+		t.Errorf("Should have failed to resolve a name under an ambiguous parent: %s", got)
+	}
+
+	values := []struct {
+		v    g.SnmpPDU
+		want string
+	}{
+		{g.SnmpPDU{Name: ".1.3.6.1.2.1.2.2.1.8.3", Type: g.Integer, Value: 2}, "down(2)"},
+		{g.SnmpPDU{Name: ".1.3.6.1.2.1.2.2.1.7.3", Type: g.Integer, Value: 3}, "testing(3)"},
+		{g.SnmpPDU{Name: ".1.3.6.1.4.1.99999.1.1.0", Type: g.Integer, Value: 1}, "critical(1)"},
+		{g.SnmpPDU{Name: ".1.3.6.1.6.3.1.1.4.1.0", Type: g.ObjectIdentifier, Value: ".1.3.6.1.6.3.1.1.5.4"}, "IF-MIB::linkUp"},
+	}
+	for _, tt := range values {
+		if got, ok := mibs.formatValue(tt.v); !ok || got != tt.want {
+			t.Errorf("value for %s: got %s, want %s", tt.v.Name, got, tt.want)
+		}
+	}
+	if _, ok := mibs.formatValue(g.SnmpPDU{Name: ".1.3.6.1.2.1.2.2.1.8.3", Type: g.Integer, Value: 42}); ok {
+		t.Errorf("Should not have a label for an unknown enum value")
+	}
+}
+
+func TestMibNamesInFilters(t *testing.T) {
+	var testConfig trapexConfig
+	if err := loadConfig("tests/config/mibs.yml", &testConfig); err != nil {
+		t.Fatalf("%s", err)
+	}
+	if err := processMibs(&testConfig); err != nil {
+		t.Fatalf("%s", err)
+	}
+	if err := processFilters(&testConfig); err != nil {
+		t.Fatalf("%s", err)
+	}
+	sgt := sgTrap{
+		trapOID: ".1.3.6.1.6.3.1.1.5.3",
+		origVars: []g.SnmpPDU{
+			{Name: ".1.3.6.1.2.1.2.2.1.1.3", Type: g.Integer, Value: 3},
+			{Name: ".1.3.6.1.2.1.2.2.1.8.3", Type: g.Integer, Value: 2},
+		},
+	}
+	for i, want := range []bool{true, true, false} {
+		if got := testConfig.filters[i].isFilterMatch(&sgt); got != want {
+			t.Errorf("filter %d: got %v, want %v", i, got, want)
+		}
+	}
+
+	// Names need the MIBs
+	testConfig.mibs = nil
+	if _, err := processFilterLine(strings.Fields("* * * * * * trap_oid=IF-MIB::linkDown break"), &testConfig, 0); err == nil {
+		t.Errorf("Should have detected a name without MIBs loaded")
+	}
+}
+
+func TestMibNamesInLogs(t *testing.T) {
+	var testConfig trapexConfig
+	teConfig = &testConfig
+	if mibs, err := loadMibs([]string{"tests/mibs"}); err != nil {
+		t.Fatalf("%s", err)
+	} else {
+		testConfig.mibs = mibs
+	}
+	sgt := sgTrap{
+		trapOID: ".1.3.6.1.6.3.1.1.5.3",
+		data: g.SnmpTrap{
+			Variables: []g.SnmpPDU{
+				{Name: ".1.3.6.1.2.1.2.2.1.1.3", Type: g.Integer, Value: 3},
+				{Name: ".1.3.6.1.2.1.2.2.1.8.3", Type: g.Integer, Value: 2},
+			},
+		},
+	}
+	entry := makeTrapLogEntry(&sgt)
+	for _, want := range []string{"Trap OID: IF-MIB::linkDown", "Object:IF-MIB::ifIndex.3 Value:3", "Object:IF-MIB::ifOperStatus.3 Value:down(2)"} {
+		if !strings.Contains(entry, want) {
+			t.Errorf("log entry is missing %s:\n%s", want, entry)
+		}
+	}
+	csv := makeTrapLogCsvEntry(&sgt)
+	if !strings.Contains(csv, "['IF-MIB::ifIndex.3','IF-MIB::ifOperStatus.3']") || !strings.Contains(csv, "['3','down(2)']") {
+		t.Errorf("CSV entry does not have the MIB names: %s", csv)
+	}
+}
@@ -0,0 +1,138 @@
+// Copyright (c) 2021 Damien Stuart. All rights reserved.
+//
+// Use of this source code is governed by the MIT License that can be found
+// in the LICENSE file.
+//
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net"
+	"runtime"
+	"sync"
+
+	g "github.com/gosnmp/gosnmp"
+)
+
+// trapPacket is a received packet waiting for a processing worker.
+//
+type trapPacket struct {
+	msg    []byte
+	remote *net.UDPAddr
+	number uint64 // Trap number, in the order received
+}
+
+// trapPipeline decodes and handles received packets with a pool of
+// processing workers. Each source IP always goes to the same worker, so
+// traps from a source are handled (and sent on) in the order they were
+// received, while traps from different sources are handled in parallel.
+//
+type trapPipeline struct {
+	conn    *net.UDPConn
+	workers []chan *trapPacket
+	wg      sync.WaitGroup
+}
+
+// validateProcessWorkers checks the general:process_* settings.
+//
+func validateProcessWorkers(newConfig *trapexConfig) error {
+	if newConfig.General.ProcessWorkers < 0 {
+		return fmt.Errorf("invalid value (%d) for general:process_workers", newConfig.General.ProcessWorkers)
+	}
+	if newConfig.General.ProcessQueueSize <= 0 {
+		return fmt.Errorf("invalid value (%d) for general:process_queue_size", newConfig.General.ProcessQueueSize)
+	}
+	return nil
+}
+
+// newTrapPipeline starts the processing workers (one per CPU unless set by
+// general:process_workers). Inform responses are sent on conn.
+//
+func newTrapPipeline(conn *net.UDPConn, teConf *trapexConfig) *trapPipeline {
+	n := teConf.General.ProcessWorkers
+	if n <= 0 {
+		n = runtime.NumCPU()
+	}
+	tp := &trapPipeline{
+		conn:    conn,
+		workers: make([]chan *trapPacket, n),
+	}
+	for i := range tp.workers {
+		tp.workers[i] = make(chan *trapPacket, teConf.General.ProcessQueueSize)
+		tp.wg.Add(1)
+		go tp.run(tp.workers[i])
+	}
+	logger.Info().Int("workers", n).Int("queue_size", teConf.General.ProcessQueueSize).Msg("Started trap processing workers")
+	return tp
+}
+
+// dispatch queues a packet for the worker that handles its source. This
+// waits for room if the worker is behind, which leaves the packets that
+// come in meanwhile in the socket buffer.
+//
+func (tp *trapPipeline) dispatch(msg []byte, remote *net.UDPAddr, number uint64) {
+	h := fnv.New32a()
+	h.Write(remote.IP.To16())
+	tp.workers[h.Sum32()%uint32(len(tp.workers))] <- &trapPacket{msg: msg, remote: remote, number: number}
+}
+
+// run handles packets for one worker. Each packet is handled with the
+// configLock read lock held, so a reload waits for it.
+//
+func (tp *trapPipeline) run(queue chan *trapPacket) {
+	defer tp.wg.Done()
+	for pkt := range queue {
+		configLock.RLock()
+		tp.handle(pkt)
+		configLock.RUnlock()
+	}
+}
+
+// handle decodes a packet and passes it on to trapHandler. Informs are
+// answered with a response PDU either before or after the trap has been
+// handled (per the general:inform_response setting).
+//
+func (tp *trapPipeline) handle(pkt *trapPacket) {
+	// A v3 message that expects a reply (an INFORM, or the probe sent
+	// before one) has to be sent to our engine ID. The sender learns it
+	// from the Report sent back.
+	engineID := teConfig.General.engineID
+	if hdr, err := peekV3Header(pkt.msg); err == nil && hdr.msgFlags&g.Reportable != 0 && hdr.engineID != engineID {
+		if !isIgnoredVersion(g.Version3) {
+			sendDiscoveryReport(tp.conn, pkt.msg, hdr, engineID, pkt.remote)
+		}
+		return
+	}
+
+	p := teConfig.receiverParams(pkt.msg).UnmarshalTrap(pkt.msg, false)
+	if p == nil {
+		logger.Debug().Str("source", pkt.remote.String()).Msg("Unable to decode trap packet")
+		return
+	}
+	// Informs that will be rejected for their community or version get no
+	// response, and v3 informs that are out of the time window are
+	// dropped (the sender sends them again once it has our time).
+	isInform := p.PDUType == g.InformRequest && teConfig.isAllowedCommunity(p) && !isIgnoredVersion(p.Version)
+	if isInform && p.Version == g.Version3 && !inTimeWindow(tp.conn, p, pkt.remote) {
+		return
+	}
+	respondFirst := teConfig.General.informResponseFirst
+
+	if isInform && respondFirst {
+		sendInformResponse(tp.conn, p, pkt.remote)
+	}
+	trapHandler(p, pkt.remote, pkt.number)
+	if isInform && !respondFirst {
+		sendInformResponse(tp.conn, p, pkt.remote)
+	}
+}
+
+// close stops the workers once the queued packets have been handled.
+//
+func (tp *trapPipeline) close() {
+	for _, queue := range tp.workers {
+		close(queue)
+	}
+	tp.wg.Wait()
+}
@@ -0,0 +1,170 @@
+// Copyright (c) 2021 Damien Stuart. All rights reserved.
+//
+// Use of this source code is governed by the MIT License that can be found
+// in the LICENSE file.
+//
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	g "github.com/gosnmp/gosnmp"
+)
+
+const pipelineSeqOID = ".1.3.6.1.4.1.99999.1"
+
+// makeV2cTrapPacket encodes a v2c trap with a sequence number varbind.
+//
+func makeV2cTrapPacket(t *testing.T, seq int) []byte {
+	p := &g.SnmpPacket{
+		Version:   g.Version2c,
+		Community: "public",
+		PDUType:   g.SNMPv2Trap,
+		Variables: []g.SnmpPDU{
+			{Name: sysUpTime, Type: g.TimeTicks, Value: uint32(100)},
+			{Name: snmpTrapOID, Type: g.ObjectIdentifier, Value: ".1.3.6.1.6.3.1.1.5.1"},
+			{Name: pipelineSeqOID, Type: g.Integer, Value: seq},
+		},
+	}
+	msg, err := p.MarshalMsg()
+	if err != nil {
+		t.Fatalf("unable to encode v2c trap: %s", err)
+	}
+	return msg
+}
+
+func TestProcessWorkersConfig(t *testing.T) {
+	var testConfig trapexConfig
+	if err := loadConfig("tests/config/general.yml", &testConfig); err != nil {
+		t.Fatalf("%s", err)
+	}
+	if testConfig.General.ProcessWorkers != 0 || testConfig.General.ProcessQueueSize != 1000 {
+		t.Errorf("process worker defaults not set correctly: %d %d", testConfig.General.ProcessWorkers, testConfig.General.ProcessQueueSize)
+	}
+	if err := validateProcessWorkers(&testConfig); err != nil {
+		t.Errorf("%s", err)
+	}
+	testConfig.General.ProcessWorkers = -1
+	if err := validateProcessWorkers(&testConfig); err == nil {
+		t.Errorf("Should have detected an invalid process_workers")
+	}
+	testConfig.General.ProcessWorkers = 2
+	testConfig.General.ProcessQueueSize = 0
+	if err := validateProcessWorkers(&testConfig); err == nil {
+		t.Errorf("Should have detected an invalid process_queue_size")
+	}
+}
+
+// TestTrapPipelineLoad sends traps from several sources at once through the
+// processing workers, and checks that every trap gets a unique number and
+// that each source's traps come out in order.
+//
+func TestTrapPipelineLoad(t *testing.T) {
+	const sources = 8
+	const perSource = 500
+
+	var testConfig trapexConfig
+	os.Remove("tests/tmp/pipeline.json")
+	if err := loadConfig("tests/config/pipeline.yml", &testConfig); err != nil {
+		t.Fatalf("%s", err)
+	}
+	if err := validateActionQueue(&testConfig); err != nil {
+		t.Fatalf("%s", err)
+	}
+	if err := validateSnmpV3Args(&testConfig); err != nil {
+		t.Fatalf("%s", err)
+	}
+	if err := processV3Users(&testConfig); err != nil {
+		t.Fatalf("%s", err)
+	}
+	if err := processFilters(&testConfig); err != nil {
+		t.Fatalf("%s", err)
+	}
+	teConfig = &testConfig
+
+	firstNumber := atomic.LoadUint64(&stats.TrapCount) + 1
+	handled := atomic.LoadUint64(&stats.HandledTraps)
+
+	pipeline := newTrapPipeline(nil, &testConfig)
+	sendPipelineTraps(t, pipeline, sources, perSource)
+	pipeline.close()
+	closeTrapexHandles()
+
+	if n := atomic.LoadUint64(&stats.HandledTraps) - handled; n != sources*perSource {
+		t.Errorf("expected %d handled traps, got %d", sources*perSource, n)
+	}
+	checkPipelineTraps(t, "tests/tmp/pipeline.json", sources, perSource, firstNumber)
+}
+
+// sendPipelineTraps dispatches perSource traps (numbered by a sequence
+// varbind) from each of the sources at the same time.
+//
+func sendPipelineTraps(t *testing.T, pipeline *trapPipeline, sources int, perSource int) {
+	msgs := make([][]byte, perSource)
+	for i := range msgs {
+		msgs[i] = makeV2cTrapPacket(t, i)
+	}
+	var wg sync.WaitGroup
+	for s := 0; s < sources; s++ {
+		wg.Add(1)
+		go func(s int) {
+			defer wg.Done()
+			remote := &net.UDPAddr{IP: net.IPv4(10, 0, 0, byte(s+1)), Port: 162}
+			for _, msg := range msgs {
+				pipeline.dispatch(msg, remote, atomic.AddUint64(&stats.TrapCount, 1))
+			}
+		}(s)
+	}
+	wg.Wait()
+}
+
+// checkPipelineTraps checks that a JSON log has all of the traps sent by
+// sendPipelineTraps, each with a unique number from firstNumber on, and
+// with each source's traps in order.
+//
+func checkPipelineTraps(t *testing.T, logfile string, sources int, perSource int, firstNumber uint64) {
+	data, err := ioutil.ReadFile(logfile)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != sources*perSource {
+		t.Fatalf("expected %d JSON lines, got %d", sources*perSource, len(lines))
+	}
+	numbers := make(map[uint64]bool)
+	nextSeq := make(map[string]int)
+	lastNumber := make(map[string]uint64)
+	for _, line := range lines {
+		var entry trapJsonEntry
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("invalid JSON entry: %s: %s", err, line)
+		}
+		if entry.TrapNumber < firstNumber || entry.TrapNumber >= firstNumber+uint64(sources*perSource) || numbers[entry.TrapNumber] {
+			t.Errorf("trap number %d is out of range or not unique", entry.TrapNumber)
+		}
+		numbers[entry.TrapNumber] = true
+
+		seq := -1
+		for _, vb := range entry.Varbinds {
+			if "."+vb.OID == pipelineSeqOID {
+				seq = int(vb.Value.(float64))
+			}
+		}
+		if seq != nextSeq[entry.SourceIP] || entry.TrapNumber <= lastNumber[entry.SourceIP] {
+			t.Fatalf("trap from %s is out of order: %s", entry.SourceIP, line)
+		}
+		nextSeq[entry.SourceIP] = seq + 1
+		lastNumber[entry.SourceIP] = entry.TrapNumber
+	}
+	if len(nextSeq) != sources {
+		t.Errorf("expected traps from %d sources: %s", sources, fmt.Sprint(nextSeq))
+	}
+}
@@ -7,6 +7,7 @@ package main
 
 import (
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net"
 	"net/http"
 )
 
@@ -15,6 +16,6 @@ import (
 func exposeMetrics() {
 	server := http.NewServeMux()
 	server.Handle("/"+teConfig.General.PrometheusEndpoint, promhttp.Handler())
-	var listenAddress = teConfig.General.PrometheusIp + ":" + teConfig.General.PrometheusPort
+	var listenAddress = net.JoinHostPort(teConfig.General.PrometheusIp, teConfig.General.PrometheusPort)
 	http.ListenAndServe(listenAddress, server)
 }
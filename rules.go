@@ -0,0 +1,285 @@
+// Copyright (c) 2021 Damien Stuart. All rights reserved.
+//
+// Use of this source code is governed by the MIT License that can be found
+// in the LICENSE file.
+//
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// How often expired rules are looked for
+//
+const ruleExpiryInterval = 10 * time.Second
+
+var errRuleNotFound = fmt.Errorf("rule not found")
+
+var ruleExpiryOnce sync.Once
+
+// overlayRule is a filter line added at runtime (through the admin API). Its
+// position is its index in the main filters list: the filters from there
+// on (from the configuration file or other rules) move down one. Once it
+// expires, the rule is removed.
+//
+type overlayRule struct {
+	ID       int        `yaml:"id" json:"id"`
+	Position int        `yaml:"position" json:"position"`
+	Filter   string     `yaml:"filter" json:"filter"`
+	Expires  *time.Time `yaml:"expires,omitempty" json:"expires,omitempty"`
+	Created  time.Time  `yaml:"created" json:"created"`
+	Comment  string     `yaml:"comment,omitempty" json:"comment,omitempty"`
+}
+
+// overlayFile is the content of the admin:overlay_file.
+//
+type overlayFile struct {
+	Rules []*overlayRule `yaml:"rules"`
+}
+
+func (r *overlayRule) expired(now time.Time) bool {
+	return r.Expires != nil && !now.Before(*r.Expires)
+}
+
+// processRules loads the rules from the admin:overlay_file, if it has been
+// written yet.
+//
+func processRules(newConfig *trapexConfig) error {
+	file := newConfig.Admin.OverlayFile
+	if file == "" {
+		return nil
+	}
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("unable to read admin:overlay_file: %s", err)
+	}
+	var overlay overlayFile
+	if err = yaml.UnmarshalStrict(data, &overlay); err != nil {
+		return fmt.Errorf("invalid admin:overlay_file %s: %s", file, err)
+	}
+	ids := make(map[int]bool)
+	for _, rule := range overlay.Rules {
+		if rule == nil || rule.ID <= 0 || ids[rule.ID] {
+			return fmt.Errorf("invalid or duplicate rule id in admin:overlay_file %s", file)
+		}
+		if rule.Position < 0 {
+			return fmt.Errorf("invalid position (%d) for rule %d in admin:overlay_file %s", rule.Position, rule.ID, file)
+		}
+		ids[rule.ID] = true
+	}
+	sortRules(overlay.Rules)
+	newConfig.rules = overlay.Rules
+	return nil
+}
+
+func sortRules(rules []*overlayRule) {
+	sort.SliceStable(rules, func(i, j int) bool {
+		return rules[i].Position < rules[j].Position
+	})
+}
+
+// mergeRules inserts the rules (sorted by position) that have not expired
+// into the filters list. Rules past the end of the list go at the end.
+//
+func mergeRules(rawFilters []rawFilter, rules []*overlayRule, now time.Time) []rawFilter {
+	if len(rules) == 0 {
+		return rawFilters
+	}
+	merged := make([]rawFilter, len(rawFilters), len(rawFilters)+len(rules))
+	copy(merged, rawFilters)
+	for _, rule := range rules {
+		if rule.expired(now) {
+			continue
+		}
+		i := rule.Position
+		if i > len(merged) {
+			i = len(merged)
+		}
+		merged = append(merged, rawFilter{})
+		copy(merged[i+1:], merged[i:])
+		merged[i] = rawFilter{line: rule.Filter, rule: rule}
+	}
+	return merged
+}
+
+// insertRule adds a rule at its position (up to size, the length of the
+// filters list), moving the rules from there on down.
+//
+func insertRule(rules []*overlayRule, rule *overlayRule, size int) []*overlayRule {
+	if rule.Position < 0 {
+		rule.Position = 0
+	}
+	if rule.Position > size {
+		rule.Position = size
+	}
+	for _, r := range rules {
+		if r.Position >= rule.Position {
+			r.Position++
+		}
+	}
+	rules = append(rules, rule)
+	sortRules(rules)
+	return rules
+}
+
+// removeRule takes a rule out, moving the rules after it up.
+//
+func removeRule(rules []*overlayRule, id int) ([]*overlayRule, *overlayRule) {
+	var removed *overlayRule
+	kept := rules[:0]
+	for _, r := range rules {
+		if r.ID == id {
+			removed = r
+		} else {
+			kept = append(kept, r)
+		}
+	}
+	if removed != nil {
+		for _, r := range kept {
+			if r.Position > removed.Position {
+				r.Position--
+			}
+		}
+	}
+	return kept, removed
+}
+
+func nextRuleID(rules []*overlayRule) int {
+	id := 1
+	for _, r := range rules {
+		if r.ID >= id {
+			id = r.ID + 1
+		}
+	}
+	return id
+}
+
+// updateRules changes the rules of the running configuration, saves them to
+// the admin:overlay_file, and swaps in the filters with the new rules. The
+// change is given a copy of the rules and the length of the filters list.
+// Nothing changes if the new filters or saving them fail.
+//
+func updateRules(change func(rules []*overlayRule, size int) ([]*overlayRule, error)) error {
+	reloadLock.Lock()
+	defer reloadLock.Unlock()
+
+	oldConfig := currentConfig()
+	if oldConfig.Admin.OverlayFile == "" {
+		return fmt.Errorf("admin:overlay_file is not set")
+	}
+	// Expired rules that have not been removed yet don't count toward the
+	// positions.
+	now := time.Now()
+	var rules []*overlayRule
+	for _, rule := range oldConfig.rules {
+		r := *rule
+		rules = append(rules, &r)
+	}
+	rules = dropExpiredRules(rules, now)
+	rules, err := change(rules, len(oldConfig.RawFilters)+len(rules))
+	if err != nil {
+		return err
+	}
+
+	newConfig := *oldConfig
+	newConfig.rules = rules
+	newConfig.actions = nil
+	if oldConfig.teConfigured {
+		newConfig.previousActions = oldConfig.actions
+	}
+	err = processFilters(&newConfig)
+	newConfig.previousActions = nil
+	if err == nil {
+		err = saveRules(newConfig.Admin.OverlayFile, rules)
+	}
+	if err != nil {
+		closeActions(&newConfig, oldConfig)
+		return err
+	}
+	swapConfig(&newConfig, oldConfig)
+	return nil
+}
+
+// saveRules writes the rules to the overlay file. The file is replaced in
+// one step, so a crash can't leave half of it.
+//
+func saveRules(file string, rules []*overlayRule) error {
+	data, err := yaml.Marshal(overlayFile{Rules: rules})
+	if err != nil {
+		return err
+	}
+	data = append([]byte("# Filter rules added through the trapex admin API\n"), data...)
+	tmp := file + ".tmp"
+	if err = ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("unable to write admin:overlay_file: %s", err)
+	}
+	if err = os.Rename(tmp, file); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("unable to write admin:overlay_file: %s", err)
+	}
+	return nil
+}
+
+// startRuleExpiry starts removing expired rules, the first time there is an
+// admin:overlay_file.
+//
+func startRuleExpiry() {
+	ruleExpiryOnce.Do(func() {
+		go expireRules()
+	})
+}
+
+// expireRules removes the expired rules every ruleExpiryInterval.
+//
+func expireRules() {
+	for range time.Tick(ruleExpiryInterval) {
+		if err := removeExpiredRules(time.Now()); err != nil {
+			logger.Warn().Err(err).Msg("Unable to remove expired rules")
+		}
+	}
+}
+
+func removeExpiredRules(now time.Time) error {
+	conf := currentConfig()
+	if conf == nil {
+		return nil
+	}
+	expired := false
+	for _, rule := range conf.rules {
+		expired = expired || rule.expired(now)
+	}
+	if !expired {
+		return nil
+	}
+	return updateRules(func(rules []*overlayRule, size int) ([]*overlayRule, error) {
+		return dropExpiredRules(rules, now), nil
+	})
+}
+
+// dropExpiredRules removes the rules that have expired by now, moving the
+// rules after them up.
+//
+func dropExpiredRules(rules []*overlayRule, now time.Time) []*overlayRule {
+	var ids []int
+	for _, rule := range rules {
+		if rule.expired(now) {
+			ids = append(ids, rule.ID)
+		}
+	}
+	for _, id := range ids {
+		var removed *overlayRule
+		rules, removed = removeRule(rules, id)
+		logger.Info().Int("rule", id).Str("filter", removed.Filter).Msg("Removed expired rule")
+	}
+	return rules
+}
@@ -0,0 +1,229 @@
+// Copyright (c) 2021 Damien Stuart. All rights reserved.
+//
+// Use of this source code is governed by the MIT License that can be found
+// in the LICENSE file.
+//
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	g "github.com/gosnmp/gosnmp"
+)
+
+func TestRulePositions(t *testing.T) {
+	rawFilters := []rawFilter{{line: "f0"}, {line: "f1"}, {line: "f2"}}
+	var rules []*overlayRule
+	size := func() int { return len(rawFilters) + len(rules) }
+	rules = insertRule(rules, &overlayRule{ID: 1, Position: 1, Filter: "r1"}, size())
+	rules = insertRule(rules, &overlayRule{ID: 2, Position: 1, Filter: "r2"}, size())
+	rules = insertRule(rules, &overlayRule{ID: 3, Position: 99, Filter: "r3"}, size())
+	rules = insertRule(rules, &overlayRule{ID: 4, Position: 0, Filter: "r4"}, size())
+
+	checkMerged := func(expected string) {
+		merged := ""
+		for _, f := range mergeRules(rawFilters, rules, time.Now()) {
+			merged += f.line + " "
+		}
+		if merged != expected {
+			t.Errorf("expected filters %s, got %s", expected, merged)
+		}
+		for _, rule := range rules {
+			if merged := mergeRules(rawFilters, rules, time.Now()); merged[rule.Position].rule != rule {
+				t.Errorf("rule %d is not at its position %d", rule.ID, rule.Position)
+			}
+		}
+	}
+	checkMerged("r4 f0 r2 r1 f1 f2 r3 ")
+
+	var removed *overlayRule
+	rules, removed = removeRule(rules, 2)
+	if removed == nil || removed.ID != 2 {
+		t.Fatalf("rule 2 not removed: %v", removed)
+	}
+	checkMerged("r4 f0 r1 f1 f2 r3 ")
+	if _, removed = removeRule(rules, 2); removed != nil {
+		t.Errorf("removed rule 2 twice")
+	}
+	if id := nextRuleID(rules); id != 5 {
+		t.Errorf("expected next rule id 5, got %d", id)
+	}
+
+	// Expired rules are left out.
+	expires := time.Now().Add(-time.Minute)
+	rules[0].Expires = &expires
+	merged := mergeRules(rawFilters, rules, time.Now())
+	if len(merged) != 5 || merged[0].line != "f0" {
+		t.Errorf("expired rule not left out: %v", merged)
+	}
+}
+
+func TestAdminRules(t *testing.T) {
+	overlay := "tests/tmp/rules_overlay.yml"
+	os.Remove(overlay)
+	teCmdLine.configFile = "tests/config/rules.yml"
+	teConfig = nil
+	if err := getConfig(); err != nil {
+		t.Fatalf("%s", err)
+	}
+	defer closeTrapexHandles()
+	s := httptest.NewServer(newAdminHandler(true))
+	defer s.Close()
+	client := s.Client()
+
+	var rule overlayRule
+	var errResp map[string]string
+	if status := adminRequest(t, client, "POST", s.URL+"/api/rules", "s3cret", `{"filter": "* 10.4.5.6 * * * * drop", "expires_in": "2h", "comment": "storm"}`, &rule); status != http.StatusCreated {
+		t.Fatalf("add rule got %d", status)
+	}
+	if rule.ID != 1 || rule.Position != 0 || rule.Expires == nil || time.Until(*rule.Expires) < time.Hour {
+		t.Errorf("rule not added correctly: %+v", rule)
+	}
+	if status := adminRequest(t, client, "POST", s.URL+"/api/rules", "s3cret", `{"filter": "* * * * * * log", "position": 1}`, &errResp); status != http.StatusUnprocessableEntity {
+		t.Errorf("add invalid rule got %d", status)
+	}
+	if status := adminRequest(t, client, "POST", s.URL+"/api/rules", "s3cret", `{"filter": "* 10.4.5.7 * * * * drop", "expires_in": "soon"}`, &errResp); status != http.StatusBadRequest {
+		t.Errorf("add rule with invalid expiry got %d", status)
+	}
+	if status := adminRequest(t, client, "POST", s.URL+"/api/rules", "s3cret", `{"filter": "* 10.4.5.7 * * * * drop", "position": 1}`, &rule); status != http.StatusCreated || rule.ID != 2 {
+		t.Errorf("add second rule got %d: %+v", status, rule)
+	}
+
+	// The muted device's traps are dropped before they are logged.
+	for _, src := range []string{"10.4.5.6", "10.4.5.8"} {
+		processTrap(&sgTrap{
+			trapVer: g.Version1,
+			srcIP:   net.ParseIP(src),
+			data:    g.SnmpTrap{AgentAddress: src, Enterprise: ".1.3.6.1.4.1.9"},
+		})
+	}
+	var filters []filterInfo
+	adminRequest(t, client, "GET", s.URL+"/api/filters", "s3cret", "", &filters)
+	expected := []struct {
+		filter string
+		rule   int
+		hits   uint64
+	}{
+		{"* 10.4.5.6 * * * * drop", 1, 1},
+		{"* 10.4.5.7 * * * * drop", 2, 0},
+		{"* * * * * * csv tests/tmp/rules.csv", 0, 1},
+		{"* * * * * * log tests/tmp/rules.log", 0, 1},
+	}
+	if len(filters) != len(expected) {
+		t.Fatalf("expected %d filters: %+v", len(expected), filters)
+	}
+	for i, e := range expected {
+		if filters[i].Filter != e.filter || filters[i].Rule != e.rule || filters[i].Hits != e.hits {
+			t.Errorf("filter %d is not correct: %+v", i, filters[i])
+		}
+	}
+	if filters[0].Expires == nil || filters[1].Expires != nil {
+		t.Errorf("rule expiry not listed: %+v", filters[:2])
+	}
+
+	// Move rule 1 below the csv filter, which keeps the csv action.
+	csv := currentConfig().filters[2].action
+	if status := adminRequest(t, client, "PUT", s.URL+"/api/rules/1", "s3cret", `{"position": 2}`, &rule); status != http.StatusOK || rule.Position != 2 {
+		t.Errorf("move rule got %d: %+v", status, rule)
+	}
+	if status := adminRequest(t, client, "PUT", s.URL+"/api/rules/9", "s3cret", `{"position": 2}`, &errResp); status != http.StatusNotFound {
+		t.Errorf("move unknown rule got %d", status)
+	}
+	if f := currentConfig().filters; f[0].rule.ID != 2 || f[1].action != csv || f[2].rule.ID != 1 {
+		t.Errorf("rule 1 not moved: %+v", f)
+	}
+
+	// The rules are still there after a restart.
+	closeTrapexHandles()
+	teConfig = nil
+	if err := getConfig(); err != nil {
+		t.Fatalf("%s", err)
+	}
+	var rules []overlayRule
+	if status := adminRequest(t, client, "GET", s.URL+"/api/rules", "s3cret", "", &rules); status != http.StatusOK {
+		t.Fatalf("list rules got %d", status)
+	}
+	if len(rules) != 2 || rules[0].ID != 2 || rules[0].Position != 0 || rules[1].ID != 1 || rules[1].Position != 2 || rules[1].Comment != "storm" {
+		t.Errorf("rules not kept: %+v", rules)
+	}
+
+	if status := adminRequest(t, client, "DELETE", s.URL+"/api/rules/2", "s3cret", "", &rule); status != http.StatusOK || rule.ID != 2 {
+		t.Errorf("delete rule got %d: %+v", status, rule)
+	}
+	if status := adminRequest(t, client, "DELETE", s.URL+"/api/rules/2", "s3cret", "", &errResp); status != http.StatusNotFound {
+		t.Errorf("delete rule twice got %d", status)
+	}
+	f := currentConfig().filters
+	if len(f) != 3 || f[1].rule == nil || f[1].rule.Position != 1 {
+		t.Errorf("rule 2 not deleted: %+v", f)
+	}
+
+	// Rule 1 stops matching once it expires, before it is removed.
+	expires := time.Now().Add(-time.Second)
+	currentConfig().rules[0].Expires = &expires
+	processTrap(&sgTrap{
+		trapVer: g.Version1,
+		srcIP:   net.ParseIP("10.4.5.6"),
+		data:    g.SnmpTrap{AgentAddress: "10.4.5.6", Enterprise: ".1.3.6.1.4.1.9"},
+	})
+	if f := currentConfig().filters; atomic.LoadUint64(f[1].hits) != 0 || atomic.LoadUint64(f[0].hits) != 1 {
+		t.Errorf("trap from the unmuted device not logged: %d, %d hits", atomic.LoadUint64(f[1].hits), atomic.LoadUint64(f[0].hits))
+	}
+
+	// The expired rule is removed with the next change, and doesn't count
+	// toward the end position.
+	if status := adminRequest(t, client, "POST", s.URL+"/api/rules", "s3cret", `{"filter": "* 10.4.5.9 * * * * drop", "position": 99}`, &rule); status != http.StatusCreated || rule.Position != 2 {
+		t.Errorf("add rule at the end got %d: %+v", status, rule)
+	}
+	if f := currentConfig().filters; len(f) != 3 || len(currentConfig().rules) != 1 || f[2].rule == nil || f[2].rule.ID != rule.ID {
+		t.Errorf("expired rule not removed: %+v", f)
+	}
+
+	// Rules that expire later are removed by removeExpiredRules.
+	if status := adminRequest(t, client, "PUT", s.URL+"/api/rules/"+strconv.Itoa(rule.ID), "s3cret", `{"position": 0}`, &rule); status != http.StatusOK {
+		t.Fatalf("move rule got %d", status)
+	}
+	later := time.Now().Add(time.Hour)
+	currentConfig().rules[0].Expires = &later
+	if err := removeExpiredRules(time.Now().Add(3 * time.Hour)); err != nil {
+		t.Fatalf("%s", err)
+	}
+	if f := currentConfig().filters; len(f) != 2 || len(currentConfig().rules) != 0 {
+		t.Errorf("expired rule not removed: %+v", f)
+	}
+}
+
+func TestRulesOverlayFile(t *testing.T) {
+	var testConfig trapexConfig
+	testConfig.Admin.OverlayFile = "tests/tmp/rules_bad_overlay.yml"
+	defer os.Remove(testConfig.Admin.OverlayFile)
+	if err := processRules(&testConfig); err != nil || testConfig.rules != nil {
+		t.Errorf("missing overlay file should have no rules: %s", err)
+	}
+	for _, bad := range []string{
+		"rules:\n  - id: 1\n    filter: a\n  - id: 1\n    filter: b\n",
+		"rules:\n  - id: 1\n    position: -1\n    filter: a\n",
+		"rules:\n  - id: 1\n    filter: a\n    other: b\n",
+	} {
+		if err := ioutil.WriteFile(testConfig.Admin.OverlayFile, []byte(bad), 0644); err != nil {
+			t.Fatalf("%s", err)
+		}
+		if err := processRules(&testConfig); err == nil {
+			t.Errorf("should have detected a bad overlay file: %s", bad)
+		}
+	}
+	if err := saveRules(testConfig.Admin.OverlayFile, []*overlayRule{{ID: 3, Position: 1, Filter: "* * * * * * drop"}}); err != nil {
+		t.Fatalf("%s", err)
+	}
+	if err := processRules(&testConfig); err != nil || len(testConfig.rules) != 1 || testConfig.rules[0].ID != 3 {
+		t.Errorf("saved rules not loaded: %s", err)
+	}
+}
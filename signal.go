@@ -8,7 +8,6 @@ package main
 import (
 	"fmt"
 	"os"
-	"time"
 )
 
 // On SIGHUP we reload the configuration.
@@ -32,23 +31,26 @@ func handleSIGUSR1(sigCh chan os.Signal) {
 		select {
 		case <-sigCh:
 			//logger.Info().Msg("Got SIGUSR1 to dump stats")
-			// Compute uptime
-			stats.UptimeInt = time.Now().Unix() - stats.StartTime.Unix()
+			s := stats.snapshot()
 			logger.Info().
-				Str("uptime_str", secondsToDuration(uint(stats.UptimeInt))).
-				Uint("uptime", uint(stats.UptimeInt)).
-				Uint("traps_received", stats.TrapCount).
-				Uint("traps_ignored", stats.IgnoredTraps).
-				Uint("traps_processed", stats.HandledTraps).
-				Uint("traps_dropped", stats.DroppedTraps).
-				Uint("traps_tranlated_from_v2c", stats.TranslatedFromV2c).
-				Uint("traps_tranlated_from_v3", stats.TranslatedFromV3).
+				Str("uptime_str", s.Uptime).
+				Uint("uptime", uint(s.UptimeInt)).
+				Uint64("traps_received", s.TrapCount).
+				Uint64("informs_received", s.InformCount).
+				Uint64("inform_responses", s.InformResponses).
+				Uint64("inform_response_errors", s.InformErrors).
+				Uint64("traps_ignored", s.IgnoredTraps).
+				Uint64("traps_rejected", s.RejectedTraps).
+				Uint64("traps_processed", s.HandledTraps).
+				Uint64("traps_dropped", s.DroppedTraps).
+				Uint64("traps_translated_from_v2c", s.TranslatedFromV2c).
+				Uint64("traps_translated_from_v3", s.TranslatedFromV3).
 				Uint("trap_rate_1min", trapRateTracker.getRate(1)).
 				Uint("trap_rate_5min", trapRateTracker.getRate(5)).
 				Uint("trap_rate_15min", trapRateTracker.getRate(15)).
 				Uint("trap_rate_1hour", trapRateTracker.getRate(60)).
 				Uint("trap_rate_4hour", trapRateTracker.getRate(240)).
-				Uint("trap_rate_4hour", trapRateTracker.getRate(480)).
+				Uint("trap_rate_8hour", trapRateTracker.getRate(480)).
 				Uint("trap_rate_1day", trapRateTracker.getRate(1440)).
 				Uint("trap_rate_all", trapRateTracker.getRate(0)).
 				Msg("Got SIGUSR1 for trapex stats")
@@ -56,6 +58,21 @@ func handleSIGUSR1(sigCh chan os.Signal) {
 	}
 }
 
+// rotateCsvLogs forces a rotation of the CSV log files, and returns their
+// names.
+//
+func rotateCsvLogs() []string {
+	var rotated []string
+	for _, shared := range currentConfig().actions {
+		if csvLogger, ok := shared.action.(*trapCsvLogger); ok {
+			csvLogger.rotateLog()
+			logger.Info().Str("logfile", csvLogger.logfileName()).Msg("Rotated CSV file")
+			rotated = append(rotated, csvLogger.logfileName())
+		}
+	}
+	return rotated
+}
+
 // Use SIGUSR2 to force a rotation of CSV log files.
 //
 func handleSIGUSR2(sigCh chan os.Signal) {
@@ -63,12 +80,7 @@ func handleSIGUSR2(sigCh chan os.Signal) {
 		select {
 		case <-sigCh:
 			logger.Info().Msg("Got SIGUSR2")
-			for _, f := range teConfig.filters {
-				if f.actionType == actionCsv || f.actionType == actionCsvBreak {
-					f.action.(*trapCsvLogger).rotateLog()
-					logger.Info().Str("logfile", f.action.(*trapCsvLogger).logfileName()).Msg("Rotated CSV file")
-				}
-			}
+			rotateCsvLogs()
 		}
 	}
 }
@@ -8,6 +8,7 @@ package main
 import (
 	"math"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
@@ -29,23 +30,104 @@ type trapRates struct {
 	SinceStart uint
 }
 
-// teStats is a structure for holding trapex stats.
+// teStats is a structure for holding trapex stats. The counters are
+// updated by the processing workers, so they must only be accessed with
+// the sync/atomic functions (they come first to keep them 64-bit aligned).
 //
 type teStats struct {
+	TrapCount         uint64
+	InformCount       uint64
+	InformResponses   uint64
+	InformErrors      uint64
+	HandledTraps      uint64
+	DroppedTraps      uint64
+	IgnoredTraps      uint64
+	RejectedTraps     uint64
+	TranslatedFromV2c uint64
+	TranslatedFromV3  uint64
 	StartTime         time.Time
 	UptimeInt         int64
 	Uptime            string
-	TrapCount         uint
-	HandledTraps      uint
-	DroppedTraps      uint
-	IgnoredTraps      uint
-	TranslatedFromV2c uint
-	TranslatedFromV3  uint
 	TrapsPerSecond    trapRates
 }
 
 var stats teStats
 
+// snapshot returns a copy of the current stats with the uptime filled in.
+//
+func (s *teStats) snapshot() teStats {
+	snap := teStats{
+		TrapCount:         atomic.LoadUint64(&s.TrapCount),
+		InformCount:       atomic.LoadUint64(&s.InformCount),
+		InformResponses:   atomic.LoadUint64(&s.InformResponses),
+		InformErrors:      atomic.LoadUint64(&s.InformErrors),
+		HandledTraps:      atomic.LoadUint64(&s.HandledTraps),
+		DroppedTraps:      atomic.LoadUint64(&s.DroppedTraps),
+		IgnoredTraps:      atomic.LoadUint64(&s.IgnoredTraps),
+		RejectedTraps:     atomic.LoadUint64(&s.RejectedTraps),
+		TranslatedFromV2c: atomic.LoadUint64(&s.TranslatedFromV2c),
+		TranslatedFromV3:  atomic.LoadUint64(&s.TranslatedFromV3),
+		StartTime:         s.StartTime,
+		UptimeInt:         time.Now().Unix() - s.StartTime.Unix(),
+	}
+	snap.Uptime = secondsToDuration(uint(snap.UptimeInt))
+	return snap
+}
+
+// statsReport is the JSON form of the trapex stats (as logged on SIGUSR1)
+// for the admin API.
+//
+type statsReport struct {
+	UptimeStr              string `json:"uptime_str"`
+	Uptime                 uint   `json:"uptime"`
+	TrapsReceived          uint64 `json:"traps_received"`
+	InformsReceived        uint64 `json:"informs_received"`
+	InformResponses        uint64 `json:"inform_responses"`
+	InformResponseErrors   uint64 `json:"inform_response_errors"`
+	TrapsIgnored           uint64 `json:"traps_ignored"`
+	TrapsRejected          uint64 `json:"traps_rejected"`
+	TrapsProcessed         uint64 `json:"traps_processed"`
+	TrapsDropped           uint64 `json:"traps_dropped"`
+	TrapsTranslatedFromV2c uint64 `json:"traps_translated_from_v2c"`
+	TrapsTranslatedFromV3  uint64 `json:"traps_translated_from_v3"`
+	TrapRate1min           uint   `json:"trap_rate_1min"`
+	TrapRate5min           uint   `json:"trap_rate_5min"`
+	TrapRate15min          uint   `json:"trap_rate_15min"`
+	TrapRate1hour          uint   `json:"trap_rate_1hour"`
+	TrapRate4hour          uint   `json:"trap_rate_4hour"`
+	TrapRate8hour          uint   `json:"trap_rate_8hour"`
+	TrapRate1day           uint   `json:"trap_rate_1day"`
+	TrapRateAll            uint   `json:"trap_rate_all"`
+}
+
+// makeStatsReport gathers the current stats and trap rates.
+//
+func makeStatsReport() statsReport {
+	s := stats.snapshot()
+	return statsReport{
+		UptimeStr:              s.Uptime,
+		Uptime:                 uint(s.UptimeInt),
+		TrapsReceived:          s.TrapCount,
+		InformsReceived:        s.InformCount,
+		InformResponses:        s.InformResponses,
+		InformResponseErrors:   s.InformErrors,
+		TrapsIgnored:           s.IgnoredTraps,
+		TrapsRejected:          s.RejectedTraps,
+		TrapsProcessed:         s.HandledTraps,
+		TrapsDropped:           s.DroppedTraps,
+		TrapsTranslatedFromV2c: s.TranslatedFromV2c,
+		TrapsTranslatedFromV3:  s.TranslatedFromV3,
+		TrapRate1min:           trapRateTracker.getRate(1),
+		TrapRate5min:           trapRateTracker.getRate(5),
+		TrapRate15min:          trapRateTracker.getRate(15),
+		TrapRate1hour:          trapRateTracker.getRate(60),
+		TrapRate4hour:          trapRateTracker.getRate(240),
+		TrapRate8hour:          trapRateTracker.getRate(480),
+		TrapRate1day:           trapRateTracker.getRate(1440),
+		TrapRateAll:            trapRateTracker.getRate(0),
+	}
+}
+
 // Prometheus statistics
 var (
 	trapsCount = promauto.NewCounter(prometheus.CounterOpts{
@@ -64,6 +146,10 @@ var (
 		Name: "trapex_ignored_traps_total",
 		Help: "The total number of ignored SNMP traps",
 	})
+	trapsRejected = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "trapex_rejected_traps_total",
+		Help: "The total number of SNMP traps rejected for their community",
+	})
 	trapsFromV2c = promauto.NewCounter(prometheus.CounterOpts{
 		Name: "trapex_v2c_traps_total",
 		Help: "The total number of SNMPv2c traps translated",
@@ -72,12 +158,76 @@ var (
 		Name: "trapex_v3_traps_total",
 		Help: "The total number of SNMPv3 traps translated",
 	})
+	informsCount = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "trapex_incoming_informs_total",
+		Help: "The total number of incoming SNMP INFORM requests",
+	})
+	informResponses = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "trapex_inform_responses_total",
+		Help: "The total number of responses sent for SNMP INFORM requests",
+	})
+	informErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "trapex_inform_response_errors_total",
+		Help: "The total number of errors sending responses for SNMP INFORM requests",
+	})
+	webhookSent = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "trapex_webhook_traps_sent_total",
+		Help: "The total number of traps posted to webhook destinations",
+	}, []string{"destination"})
+	webhookFailed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "trapex_webhook_traps_failed_total",
+		Help: "The total number of traps that could not be posted to webhook destinations",
+	}, []string{"destination"})
+	webhookDropped = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "trapex_webhook_traps_dropped_total",
+		Help: "The total number of traps dropped because a webhook queue was full",
+	}, []string{"destination"})
+	webhookRetries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "trapex_webhook_retries_total",
+		Help: "The total number of retried webhook posts",
+	}, []string{"destination"})
+	clickhouseInserted = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "trapex_clickhouse_rows_inserted_total",
+		Help: "The total number of trap rows inserted into ClickHouse destinations",
+	}, []string{"destination"})
+	clickhouseSpooled = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "trapex_clickhouse_rows_spooled_total",
+		Help: "The total number of trap rows spooled to disk while a ClickHouse destination was down",
+	}, []string{"destination"})
+	clickhouseFailed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "trapex_clickhouse_rows_failed_total",
+		Help: "The total number of trap rows rejected by (or not spooled for) ClickHouse destinations",
+	}, []string{"destination"})
+	actionDropped = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "trapex_action_dropped_traps_total",
+		Help: "The total number of traps dropped because an action queue was full",
+	}, []string{"destination"})
+	forwardErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "trapex_forward_errors_total",
+		Help: "The total number of traps that could not be forwarded (or queued)",
+	}, []string{"destination"})
+	forwardQueued = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "trapex_forward_queued_traps_total",
+		Help: "The total number of traps queued for failing forward destinations",
+	}, []string{"destination"})
+	forwardQueueDropped = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "trapex_forward_queue_dropped_traps_total",
+		Help: "The total number of queued traps dropped for the forward queue size or age limits",
+	}, []string{"destination"})
+	forwardQueueDepth = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "trapex_forward_queue_depth",
+		Help: "The number of traps waiting in a forward queue",
+	}, []string{"destination"})
+	clickhouseDropped = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "trapex_clickhouse_rows_dropped_total",
+		Help: "The total number of trap rows dropped because a ClickHouse queue or spool was full",
+	}, []string{"destination"})
 )
 
 type tcountRingBuf struct {
 	mu  sync.Mutex
 	ndx int
-	buf [tBufSize]uint
+	buf [tBufSize]uint64
 }
 
 func newTrapRateTracker() *tcountRingBuf {
@@ -101,16 +251,18 @@ func (b *tcountRingBuf) setNextCount() {
 	if b.ndx >= tBufSize {
 		b.ndx = 0
 	}
-	b.buf[b.ndx] = stats.TrapCount
+	b.buf[b.ndx] = atomic.LoadUint64(&stats.TrapCount)
 	b.mu.Unlock()
 }
 
 func (b *tcountRingBuf) getRate(interval int) uint {
 	if interval == 0 {
-		if stats.TrapCount == 0 {
+		count := atomic.LoadUint64(&stats.TrapCount)
+		uptime := time.Now().Unix() - stats.StartTime.Unix()
+		if count == 0 || uptime <= 0 {
 			return 0
 		}
-		return uint(math.Ceil(float64(stats.TrapCount) / float64(stats.UptimeInt)))
+		return uint(math.Ceil(float64(count) / float64(uptime)))
 	}
 	b.mu.Lock()
 	e := b.ndx
@@ -0,0 +1,403 @@
+// Copyright (c) 2021 Damien Stuart. All rights reserved.
+//
+// Use of this source code is governed by the MIT License that can be found
+// in the LICENSE file.
+//
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/creasty/defaults"
+	g "github.com/gosnmp/gosnmp"
+)
+
+// Syslog facility names, in facility code order (RFC 5424 section 6.2.1).
+//
+var syslogFacilities = [...]string{
+	"kern", "user", "mail", "daemon", "auth", "syslog", "lpr", "news",
+	"uucp", "cron", "authpriv", "ftp", "ntp", "audit", "alert", "clock",
+	"local0", "local1", "local2", "local3", "local4", "local5", "local6", "local7",
+}
+
+// Syslog severity names, in severity code order.
+//
+var syslogSeverities = [...]string{"emerg", "alert", "crit", "err", "warning", "notice", "info", "debug"}
+
+// syslogParams are the settings for a named syslog destination
+// (syslog_destinations) used by the syslog action.
+//
+type syslogParams struct {
+	Address  string `yaml:"address"`
+	network  string
+	address  string
+	Format   string `default:"rfc5424" yaml:"format"`
+	Facility string `default:"local0" yaml:"facility"`
+	facility int
+	Severity string `default:"notice" yaml:"severity"`
+	severity int
+	AppName  string `default:"trapex" yaml:"app_name"`
+
+	// Severity for traps by generic type (0-6)
+	SeverityByGeneric map[int]string `default:"{}" yaml:"severity_by_generic"`
+	severityByGeneric map[int]int
+
+	// Severity taken from the value of a varbind, optionally mapped through
+	// severity_values (otherwise the value has to be a severity name or
+	// number).
+	SeverityVarbind string `yaml:"severity_varbind"`
+	severityVarbind *oidMatch
+	SeverityValues  map[string]string `default:"{}" yaml:"severity_values"`
+	severityValues  map[string]int
+
+	// Private enterprise number used in the structured data IDs
+	SdEnterpriseID int `default:"32473" yaml:"sd_enterprise_id"`
+}
+
+// How long a write to a syslog destination can block (e.g. on a stream
+// connection to a stuck server) before the connection is dropped
+//
+var syslogWriteTimeout = 5 * time.Second
+
+// trapSyslog is an instance of a syslog destination.
+//
+type trapSyslog struct {
+	name   string
+	params *syslogParams
+	mu     sync.Mutex
+	conn   net.Conn
+	stream bool
+}
+
+// syslogSeverity returns the code for a severity name or number.
+//
+func syslogSeverity(s string) (int, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	switch s {
+	case "emergency", "panic":
+		s = "emerg"
+	case "critical":
+		s = "crit"
+	case "error":
+		s = "err"
+	case "warn":
+		s = "warning"
+	case "informational":
+		s = "info"
+	}
+	for i, name := range syslogSeverities {
+		if s == name {
+			return i, nil
+		}
+	}
+	if n, err := strconv.Atoi(s); err == nil && n >= 0 && n < len(syslogSeverities) {
+		return n, nil
+	}
+	return 0, fmt.Errorf("invalid syslog severity: %s", s)
+}
+
+// parseSyslogAddress splits a syslog destination address into the network
+// and address to dial: udp://host:port, tcp://host:port, or unix:///path.
+// A plain host:port is UDP, and the port defaults to 514 (601 for TCP).
+//
+func parseSyslogAddress(addr string) (string, string, error) {
+	network := "udp"
+	if i := strings.Index(addr, "://"); i >= 0 {
+		network, addr = addr[:i], addr[i+3:]
+	}
+	switch network {
+	case "unix":
+		if addr == "" {
+			return "", "", fmt.Errorf("missing socket path")
+		}
+		return network, addr, nil
+	case "udp", "tcp":
+	default:
+		return "", "", fmt.Errorf("invalid syslog transport: %s", network)
+	}
+	if addr == "" {
+		return "", "", fmt.Errorf("missing host")
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		port := "514"
+		if network == "tcp" {
+			port = "601"
+		}
+		addr = net.JoinHostPort(strings.Trim(addr, "[]"), port)
+	}
+	return network, addr, nil
+}
+
+// processSyslogDestinations validates each of the named syslog destinations.
+//
+func processSyslogDestinations(newConfig *trapexConfig) error {
+	for _, stanza := range newConfig.SyslogDestinations {
+		for destName, params := range stanza {
+			if _, ok := newConfig.syslogDestinations[destName]; ok {
+				return fmt.Errorf("duplicate syslog_destinations entry: %s", destName)
+			}
+			dest := params
+			if err := defaults.Set(&dest); err != nil {
+				return err
+			}
+			if err := validateSyslogParams(&dest, newConfig); err != nil {
+				return fmt.Errorf("syslog_destinations:%s: %s", destName, err)
+			}
+			logger.Info().Str("syslog_destination", destName).Str("address", dest.Address).Msg("Loading syslog destination")
+			newConfig.syslogDestinations[destName] = &dest
+		}
+	}
+	return nil
+}
+
+func validateSyslogParams(p *syslogParams, newConfig *trapexConfig) error {
+	var err error
+	if p.network, p.address, err = parseSyslogAddress(p.Address); err != nil {
+		return fmt.Errorf("invalid address: %s: %s", p.Address, err)
+	}
+	p.Format = strings.ToLower(p.Format)
+	if p.Format != "rfc5424" && p.Format != "rfc3164" {
+		return fmt.Errorf("invalid format (should be rfc5424 or rfc3164): %s", p.Format)
+	}
+	p.facility = -1
+	for i, name := range syslogFacilities {
+		if strings.ToLower(p.Facility) == name {
+			p.facility = i
+		}
+	}
+	if p.facility < 0 {
+		return fmt.Errorf("invalid facility: %s", p.Facility)
+	}
+	if p.severity, err = syslogSeverity(p.Severity); err != nil {
+		return err
+	}
+	if p.AppName == "" || len(p.AppName) > 48 || strings.ContainsAny(p.AppName, " \t") {
+		return fmt.Errorf("invalid app_name: '%s'", p.AppName)
+	}
+	p.severityByGeneric = make(map[int]int)
+	for generic, sev := range p.SeverityByGeneric {
+		if generic < 0 || generic > 6 {
+			return fmt.Errorf("invalid generic type in severity_by_generic: %d", generic)
+		}
+		if p.severityByGeneric[generic], err = syslogSeverity(sev); err != nil {
+			return err
+		}
+	}
+	if p.SeverityVarbind != "" {
+		om, err := newOIDMatch(p.SeverityVarbind, newConfig.mibs)
+		if err != nil {
+			return fmt.Errorf("severity_varbind %s", err)
+		}
+		p.severityVarbind = &om
+	}
+	p.severityValues = make(map[string]int)
+	for value, sev := range p.SeverityValues {
+		if p.severityValues[value], err = syslogSeverity(sev); err != nil {
+			return err
+		}
+	}
+	if p.SdEnterpriseID <= 0 {
+		return fmt.Errorf("invalid sd_enterprise_id: %d", p.SdEnterpriseID)
+	}
+	return nil
+}
+
+// Initialize a trapSyslog instance for a named syslog destination, or for
+// an address (e.g. udp://127.0.0.1:514) with the default settings. The
+// connection is made when the first trap is sent.
+//
+func (a *trapSyslog) initAction(name string, teConf *trapexConfig) error {
+	params, err := syslogDestination(name, teConf)
+	if err != nil {
+		return err
+	}
+	a.name = name
+	a.params = params
+	logger.Info().Str("syslog_destination", name).Str("network", params.network).Str("address", params.address).Msg("Added syslog destination")
+	return nil
+}
+
+// syslogDestination returns the params for a named syslog destination, or
+// the default params for an address.
+//
+func syslogDestination(name string, teConf *trapexConfig) (*syslogParams, error) {
+	if params, ok := teConf.syslogDestinations[name]; ok {
+		return params, nil
+	}
+	if !strings.Contains(name, "://") {
+		return nil, fmt.Errorf("unknown syslog destination: %s", name)
+	}
+	params := &syslogParams{Address: name}
+	if err := defaults.Set(params); err != nil {
+		return nil, err
+	}
+	if err := validateSyslogParams(params, teConf); err != nil {
+		return nil, err
+	}
+	return params, nil
+}
+
+// Hook for sending a trap to this syslog destination. A broken or stuck
+// stream connection is redialed once before giving up on the trap.
+//
+func (a *trapSyslog) processTrap(trap *sgTrap) {
+	msg := a.params.makeMessage(trap, time.Now())
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	var err error
+	for try := 0; try < 2; try++ {
+		if a.conn == nil {
+			if a.conn, err = a.dial(); err != nil {
+				continue
+			}
+		}
+		// A timed out write may have sent part of the message, so the
+		// connection is not used again either way.
+		a.conn.SetWriteDeadline(time.Now().Add(syslogWriteTimeout))
+		if _, err = a.conn.Write(a.frame(msg)); err == nil {
+			return
+		}
+		a.conn.Close()
+		a.conn = nil
+	}
+	logger.Warn().Err(err).Str("syslog_destination", a.name).Msg("Error sending trap to syslog destination")
+}
+
+func (a *trapSyslog) dial() (net.Conn, error) {
+	a.stream = a.params.network == "tcp"
+	if a.params.network != "unix" {
+		return net.DialTimeout(a.params.network, a.params.address, 5*time.Second)
+	}
+	// /dev/log is normally a datagram socket, but some daemons use a
+	// stream socket.
+	conn, err := net.Dial("unixgram", a.params.address)
+	if err != nil {
+		a.stream = true
+		conn, err = net.Dial("unix", a.params.address)
+	}
+	return conn, err
+}
+
+// frame returns the message as written to the connection. Stream
+// connections use octet counting (RFC 6587) for RFC 5424 messages, and a
+// trailing newline for RFC 3164 ones.
+//
+func (a *trapSyslog) frame(msg string) []byte {
+	if !a.stream {
+		return []byte(msg)
+	}
+	if a.params.Format == "rfc3164" {
+		return []byte(msg + "\n")
+	}
+	return []byte(strconv.Itoa(len(msg)) + " " + msg)
+}
+
+// Close the syslog destination connection
+//
+func (a *trapSyslog) close() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.conn != nil {
+		a.conn.Close()
+		a.conn = nil
+	}
+}
+
+// trapSeverity picks the severity for a trap: from the severity varbind if
+// it is there and has a usable value, then by generic type, and otherwise
+// the default severity.
+//
+func (p *syslogParams) trapSeverity(trap *sgTrap) int {
+	if p.severityVarbind != nil {
+		for _, v := range trap.origVars {
+			if !p.severityVarbind.oidMatches(v.Name) {
+				continue
+			}
+			value := varbindValueString(v)
+			if sev, ok := p.severityValues[value]; ok {
+				return sev
+			}
+			if sev, err := syslogSeverity(value); err == nil {
+				return sev
+			}
+			break
+		}
+	}
+	if sev, ok := p.severityByGeneric[trap.data.GenericTrap]; ok {
+		return sev
+	}
+	return p.severity
+}
+
+// makeMessage renders a trap as a syslog message in the destination's
+// format (without any transport framing).
+//
+func (p *syslogParams) makeMessage(trap *sgTrap, now time.Time) string {
+	mibs := trap.config().mibs
+	hostname := trap.config().General.Hostname
+	if hostname == "" {
+		hostname = "-"
+	}
+	pri := p.facility*8 + p.trapSeverity(trap)
+	trapName := mibs.oidName(trap.trapOID)
+	summary := fmt.Sprintf("Trap %s from %s", trapName, trap.srcIP)
+
+	var b strings.Builder
+	if p.Format == "rfc3164" {
+		// The RFC 3164 format has no structured data, so everything goes
+		// into the message.
+		fmt.Fprintf(&b, "<%d>%s %s %s[%d]: %s agent=%s version=v%s generic=%d specific=%d enterprise=%s",
+			pri, now.Format(time.Stamp), hostname, p.AppName, os.Getpid(), summary, trap.data.AgentAddress,
+			trap.trapVer, trap.data.GenericTrap, trap.data.SpecificTrap, strings.Trim(trap.data.Enterprise, "."))
+		for _, v := range trap.data.Variables {
+			fmt.Fprintf(&b, " %s=%s", mibs.oidName(v.Name), syslogValue(v, mibs))
+		}
+		return b.String()
+	}
+
+	fmt.Fprintf(&b, "<%d>1 %s %s %s %d TRAP ", pri, now.Format("2006-01-02T15:04:05.000000Z07:00"), hostname, p.AppName, os.Getpid())
+	fmt.Fprintf(&b, `[trap@%d srcIP="%s" agent="%s" version="v%s" enterprise="%s" generic="%d" specific="%d" trapOID="%s" translated="%t"]`,
+		p.SdEnterpriseID, trap.srcIP, sdEscape(trap.data.AgentAddress), trap.trapVer, strings.Trim(trap.data.Enterprise, "."),
+		trap.data.GenericTrap, trap.data.SpecificTrap, strings.TrimLeft(trap.trapOID, "."), trap.translated)
+	if len(trap.data.Variables) > 0 {
+		fmt.Fprintf(&b, "[varbinds@%d", p.SdEnterpriseID)
+		for i, v := range trap.data.Variables {
+			fmt.Fprintf(&b, ` oid%d="%s" type%d="%s" value%d="%s"`, i+1, sdEscape(mibs.oidName(v.Name)),
+				i+1, v.Type, i+1, sdEscape(syslogValue(v, mibs)))
+		}
+		b.WriteString("]")
+	}
+	b.WriteString(" " + summary)
+	return b.String()
+}
+
+// syslogValue returns a varbind value for a syslog message, with the MIB
+// value names if there are any.
+//
+func syslogValue(v g.SnmpPDU, mibs *mibDB) string {
+	if val, ok := mibs.formatValue(v); ok {
+		return val
+	}
+	if v.Type == g.OctetString {
+		return strings.Map(func(r rune) rune {
+			if r < 32 || r == 127 {
+				return '.'
+			}
+			return r
+		}, string(v.Value.([]byte)))
+	}
+	return varbindValueString(v)
+}
+
+// sdEscape escapes the characters that are special in RFC 5424 structured
+// data parameter values.
+//
+func sdEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`).Replace(s)
+}
@@ -0,0 +1,250 @@
+// Copyright (c) 2021 Damien Stuart. All rights reserved.
+//
+// Use of this source code is governed by the MIT License that can be found
+// in the LICENSE file.
+//
+package main
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	g "github.com/gosnmp/gosnmp"
+)
+
+func syslogTestTrap() *sgTrap {
+	trap := testTrap(g.Version2c, 0,
+		g.SnmpPDU{Name: ".1.3.6.1.2.1.2.2.1.1.3", Type: g.Integer, Value: 3},
+		g.SnmpPDU{Name: ".1.3.6.1.2.1.2.2.1.2.3", Type: g.OctetString, Value: []byte(`eth"0]`)},
+	)
+	trap.trapOID = ".1.3.6.1.6.3.1.1.5.3"
+	trap.data.Enterprise = ".1.3.6.1.6.3.1.1.5"
+	trap.data.GenericTrap = 2
+	return trap
+}
+
+func testSyslogDest(t *testing.T, address string, format string) *trapSyslog {
+	var testConfig trapexConfig
+	testConfig.General.Hostname = "trapex_test"
+	useTestConfig(t, &testConfig)
+	p := syslogParams{Address: address, Format: format, Facility: "local4", Severity: "info", AppName: "trapex", SdEnterpriseID: 32473}
+	if err := validateSyslogParams(&p, &testConfig); err != nil {
+		t.Fatalf("%s", err)
+	}
+	return &trapSyslog{name: address, params: &p}
+}
+
+func TestSyslogConfig(t *testing.T) {
+	var testConfig trapexConfig
+	testConfig.syslogDestinations = make(map[string]*syslogParams)
+	if err := loadConfig("tests/config/syslog.yml", &testConfig); err != nil {
+		t.Fatalf("%s", err)
+	}
+	if err := processSyslogDestinations(&testConfig); err != nil {
+		t.Fatalf("%s", err)
+	}
+	siem := testConfig.syslogDestinations["siem"]
+	if siem == nil {
+		t.Fatalf("siem syslog destination not loaded")
+	}
+	if siem.network != "tcp" || siem.address != "127.0.0.1:6514" || siem.facility != 20 || siem.severity != 6 || siem.AppName != "trapex-test" {
+		t.Errorf("siem syslog destination not set correctly: %+v", siem)
+	}
+	legacy := testConfig.syslogDestinations["legacy"]
+	if legacy.network != "udp" || legacy.address != "192.168.1.20:514" || legacy.Format != "rfc3164" || legacy.facility != 16 || legacy.severity != 5 {
+		t.Errorf("legacy syslog destination defaults not set correctly: %+v", legacy)
+	}
+
+	useTestConfig(t, &testConfig)
+	trap := syslogTestTrap()
+	if sev := siem.trapSeverity(trap); sev != 3 {
+		t.Errorf("severity by generic type should be err(3): %d", sev)
+	}
+	trap.data.GenericTrap = 6
+	if sev := siem.trapSeverity(trap); sev != 6 {
+		t.Errorf("default severity should be info(6): %d", sev)
+	}
+	trap.origVars = []g.SnmpPDU{{Name: ".1.3.6.1.4.1.9.9.41.1.2.3.1.2.7", Type: g.Integer, Value: 4}}
+	trap.data.GenericTrap = 2
+	if sev := siem.trapSeverity(trap); sev != 4 {
+		t.Errorf("severity from varbind value should be warning(4): %d", sev)
+	}
+	trap.origVars[0].Value = 2
+	if sev := siem.trapSeverity(trap); sev != 2 {
+		t.Errorf("severity from varbind number should be crit(2): %d", sev)
+	}
+
+	if err := processFilters(&testConfig); err != nil {
+		t.Fatalf("%s", err)
+	}
+	if testConfig.filters[0].actionType != actionSyslog || testConfig.filters[1].actionType != actionSyslogBreak {
+		t.Errorf("syslog action types not set correctly")
+	}
+	if p := testConfig.filters[2].action.(*trapSyslog).params; p.network != "unix" || p.address != "/dev/log" {
+		t.Errorf("syslog action with an address not set correctly: %+v", p)
+	}
+	if _, err := processFilterLine(strings.Fields("* * * * * * syslog nosuchdest"), &testConfig, 0); err == nil {
+		t.Errorf("Should have detected an unknown syslog destination")
+	}
+
+	var badConfig trapexConfig
+	badConfig.syslogDestinations = make(map[string]*syslogParams)
+	if err := loadConfig("tests/config/syslog_bad.yml", &badConfig); err != nil {
+		t.Fatalf("%s", err)
+	}
+	if err := processSyslogDestinations(&badConfig); err == nil {
+		t.Errorf("Should have detected an invalid facility")
+	}
+	for _, addr := range []string{"", "sctp://host:514", "tcp://", "unix://"} {
+		if _, _, err := parseSyslogAddress(addr); err == nil {
+			t.Errorf("Should have detected an invalid address: '%s'", addr)
+		}
+	}
+}
+
+func TestSyslogUDP(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	defer pc.Close()
+	dest := testSyslogDest(t, "udp://"+pc.LocalAddr().String(), "rfc5424")
+	defer dest.close()
+	dest.processTrap(syslogTestTrap())
+
+	buf := make([]byte, 4096)
+	pc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := pc.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	msg := string(buf[:n])
+	// local4 (20) * 8 + info (6)
+	if !strings.HasPrefix(msg, "<166>1 ") || !strings.Contains(msg, " trapex_test trapex ") {
+		t.Errorf("RFC 5424 header not set correctly: %s", msg)
+	}
+	for _, want := range []string{
+		`[trap@32473 srcIP="192.168.1.10" agent="192.168.1.10" version="v2c" enterprise="1.3.6.1.6.3.1.1.5" generic="2" specific="0" trapOID="1.3.6.1.6.3.1.1.5.3" translated="false"]`,
+		`[varbinds@32473 oid1="1.3.6.1.2.1.2.2.1.1.3" type1="Integer" value1="3" oid2="1.3.6.1.2.1.2.2.1.2.3" type2="OctetString" value2="eth\"0\]"]`,
+		" Trap 1.3.6.1.6.3.1.1.5.3 from 192.168.1.10",
+	} {
+		if !strings.Contains(msg, want) {
+			t.Errorf("RFC 5424 message is missing %s:\n%s", want, msg)
+		}
+	}
+}
+
+func TestSyslogTCP(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	defer ln.Close()
+	received := make(chan string, 2)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			received <- line
+		}
+	}()
+
+	dest := testSyslogDest(t, "tcp://"+ln.Addr().String(), "rfc3164")
+	defer dest.close()
+	dest.processTrap(syslogTestTrap())
+	dest.processTrap(syslogTestTrap())
+	for i := 0; i < 2; i++ {
+		select {
+		case msg := <-received:
+			if !strings.HasPrefix(msg, "<166>") || !strings.Contains(msg, " trapex_test trapex[") ||
+				!strings.Contains(msg, "]: Trap 1.3.6.1.6.3.1.1.5.3 from 192.168.1.10 agent=192.168.1.10 version=v2c generic=2 specific=0") ||
+				!strings.HasSuffix(msg, ` 1.3.6.1.2.1.2.2.1.1.3=3 1.3.6.1.2.1.2.2.1.2.3=eth"0]`+"\n") {
+				t.Errorf("RFC 3164 message not set correctly: %s", msg)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for syslog message %d", i+1)
+		}
+	}
+}
+
+func TestSyslogWriteTimeout(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	defer ln.Close()
+	received := make(chan string, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		line, _ := bufio.NewReader(conn).ReadString('\n')
+		received <- line
+	}()
+
+	defer func(timeout time.Duration) { syslogWriteTimeout = timeout }(syslogWriteTimeout)
+	syslogWriteTimeout = 100 * time.Millisecond
+	dest := testSyslogDest(t, "tcp://"+ln.Addr().String(), "rfc3164")
+	defer dest.close()
+	// A connection to a server that doesn't read
+	stuck, server := net.Pipe()
+	defer server.Close()
+	dest.conn, dest.stream = stuck, true
+
+	start := time.Now()
+	dest.processTrap(syslogTestTrap())
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("write to the stuck connection took %s", elapsed)
+	}
+	select {
+	case msg := <-received:
+		if !strings.HasPrefix(msg, "<166>") {
+			t.Errorf("message not sent after reconnecting: %s", msg)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for the syslog message after reconnecting")
+	}
+}
+
+func TestSyslogUnix(t *testing.T) {
+	dir, err := ioutil.TempDir("", "trapex")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "log")
+	pc, err := net.ListenPacket("unixgram", path)
+	if err != nil {
+		t.Skipf("unix datagram sockets not available: %s", err)
+	}
+	defer pc.Close()
+
+	dest := testSyslogDest(t, "unix://"+path, "rfc5424")
+	defer dest.close()
+	dest.processTrap(syslogTestTrap())
+	buf := make([]byte, 4096)
+	pc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := pc.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if msg := string(buf[:n]); !strings.HasPrefix(msg, "<166>1 ") {
+		t.Errorf("RFC 5424 message not set correctly: %s", msg)
+	}
+}
@@ -4,6 +4,9 @@
 #
 # Takes trapex CSV logs and loads them into the clickhouse database.
 #
+# Note: The clickhouse filter action inserts traps directly (spooling them
+# while the database is down), which replaces this script.
+#
 ##############################################################################
 #
 TRAPEX_LOG_DIR="/opt/trapex/log"
@@ -5,9 +5,9 @@ CREATE TABLE snmp_traps
     `TrapDate` Date,
     `TrapTimestamp` DateTime,
     `TrapHost` LowCardinality(String),
-    `TrapNumber` UInt32,
-    `TrapSourceIP` IPv4,
-    `TrapAgentAddress` IPv4,
+    `TrapNumber` UInt64,
+    `TrapSourceIP` IPv6,
+    `TrapAgentAddress` IPv6,
     `TrapGenericType` UInt8,
     `TrapSpecificType` UInt32,
     `TrapEnterpriseOID` String,
@@ -19,3 +19,15 @@ PARTITION BY toYYYYMM(TrapDate)
 ORDER BY (TrapTimestamp, TrapHost, TrapAgentAddress, TrapEnterpriseOID, TrapGenericType)
 TTL TrapDate + toIntervalYear(3)
 SETTINGS index_granularity = 8192
+
+# Tables created with IPv4 address columns (before IPv6 support) can be
+# updated with:
+#
+# ALTER TABLE snmp_traps
+#     MODIFY COLUMN `TrapSourceIP` IPv6,
+#     MODIFY COLUMN `TrapAgentAddress` IPv6
+#
+# and tables with a UInt32 trap number column with:
+#
+# ALTER TABLE snmp_traps
+#     MODIFY COLUMN `TrapNumber` UInt64
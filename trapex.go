@@ -12,6 +12,7 @@ import (
 	"net"
 	"os"
 	"path/filepath"
+	"sync/atomic"
 	"time"
 
 	g "github.com/gosnmp/gosnmp"
@@ -21,17 +22,37 @@ import (
 )
 
 // sgTrap holds a pointer to a trap and the source IP of
-// the incoming trap.
+// the incoming trap. The data member holds the v1 view of the trap used
+// for filtering and logging, while origVars keeps the varbinds as they
+// were received so the trap can be forwarded in its original version.
+// The trapOID is the original snmpTrapOID (or its RFC-3584 form for v1),
+// and conf is the configuration the trap is handled with.
 //
 type sgTrap struct {
 	trapNumber uint64
+	conf       *trapexConfig
 	data       g.SnmpTrap
+	origVars   []g.SnmpPDU
+	trapOID    string
 	trapVer    g.SnmpVersion
+	community  string
+	v3User     string
 	srcIP      net.IP
+	natAddress string // Set by a nat action
 	translated bool
 	dropped    bool
 }
 
+// config returns the configuration the trap is handled with (or the running
+// configuration for a trap that has not been through trapHandler).
+//
+func (sgt *sgTrap) config() *trapexConfig {
+	if sgt.conf != nil {
+		return sgt.conf
+	}
+	return teConfig
+}
+
 var trapRateTracker = newTrapRateTracker()
 var logger = zerolog.New(os.Stdout).With().Timestamp().Logger()
 
@@ -47,73 +68,77 @@ func main() {
 	//
 	processCommandLine()
 
+	if teCmdLine.checkConfig {
+		os.Exit(checkConfigFile(teCmdLine.configFile))
+	}
+
 	if err := getConfig(); err != nil {
 		logger.Fatal().Err(err).Msg("Unable to load configuration")
 		os.Exit(1)
 	}
 
 	initSigHandlers()
+	if err := startAdmin(teConfig); err != nil {
+		logger.Fatal().Err(err).Msg("Unable to start the admin API")
+	}
 	go exposeMetrics()
-	var exporter = fmt.Sprintf("http://%s:%s/%s\n",
-		teConfig.General.PrometheusIp, teConfig.General.PrometheusPort, teConfig.General.PrometheusEndpoint)
+	var exporter = fmt.Sprintf("http://%s/%s\n",
+		net.JoinHostPort(teConfig.General.PrometheusIp, teConfig.General.PrometheusPort), teConfig.General.PrometheusEndpoint)
 	logger.Info().Str("endpoint", exporter).Msg("Prometheus metrics exported")
 
 	stats.StartTime = time.Now()
 
 	go trapRateTracker.start()
 
-	tl := g.NewTrapListener()
-
-	tl.OnNewTrap = trapHandler
-	tl.Params = g.Default
-	tl.Params.Community = ""
-
-	// Uncomment for debugging gosnmp
 	if teConfig.Logging.Level == "debug" {
 		logger.Info().Msg("gosnmp debug mode enabled")
-		tl.Params.Logger = g.NewLogger(log.New(os.Stdout, "", 0))
 	}
 
-	// SNMP v3 stuff
-	tl.Params.SecurityModel = g.UserSecurityModel
-	tl.Params.MsgFlags = teConfig.V3Params.msgFlags
-	tl.Params.Version = g.Version3
-	tl.Params.SecurityParameters = &g.UsmSecurityParameters{
-		UserName:                 teConfig.V3Params.Username,
-		AuthenticationProtocol:   teConfig.V3Params.authProto,
-		AuthenticationPassphrase: teConfig.V3Params.AuthPassword,
-		PrivacyProtocol:          teConfig.V3Params.privacyProto,
-		PrivacyPassphrase:        teConfig.V3Params.PrivacyPassword,
-	}
-
-	listenAddr := fmt.Sprintf("%s:%s", teConfig.General.ListenAddr, teConfig.General.ListenPort)
+	listenAddr := net.JoinHostPort(teConfig.General.ListenAddr, teConfig.General.ListenPort)
 	logger.Info().Str("listen_address", listenAddr).Msg("Start trapex listener")
-	err := tl.Listen(listenAddr)
+	err := listenForTraps(listenAddr)
 	if err != nil {
 		log.Panicf("error in listen on %s: %s", listenAddr, err)
 	}
 }
 
 // trapHandler is the callback for handling traps received by the listener.
+// It is called from the processing workers, so several traps can be handled
+// at once (though traps from the same source are handled in order). The
+// trap number is assigned by the listener when the packet is received. The
+// caller holds the configLock read lock.
 //
-func trapHandler(p *g.SnmpPacket, addr *net.UDPAddr) {
-	// Count every trap received
-	stats.TrapCount++
-	trapsCount.Inc()
+func trapHandler(p *g.SnmpPacket, addr *net.UDPAddr, trapNumber uint64) {
+	conf := teConfig
+
+	if p.PDUType == g.InformRequest {
+		atomic.AddUint64(&stats.InformCount, 1)
+		informsCount.Inc()
+	}
 
 	// First thing to do is check for ignored versions
 	if isIgnoredVersion(p.Version) {
-		stats.IgnoredTraps++
+		atomic.AddUint64(&stats.IgnoredTraps, 1)
 		trapsIgnored.Inc()
 		return
 	}
 
+	// Then for v1/v2c traps from communities that are not allowed
+	if !conf.isAllowedCommunity(p) {
+		atomic.AddUint64(&stats.RejectedTraps, 1)
+		trapsRejected.Inc()
+		logger.Debug().Str("source", addr.IP.String()).Str("community", p.Community).Msg("Rejected trap from community not on the allow list")
+		return
+	}
+
 	// Also keep track of traps we handle
-	stats.HandledTraps++
+	atomic.AddUint64(&stats.HandledTraps, 1)
 	trapsHandled.Inc()
 
 	// Make the trap
 	trap := sgTrap{
+		trapNumber: trapNumber,
+		conf:       conf,
 		data: g.SnmpTrap{
 			Variables:    p.Variables,
 			Enterprise:   p.Enterprise,
@@ -122,8 +147,26 @@ func trapHandler(p *g.SnmpPacket, addr *net.UDPAddr) {
 			SpecificTrap: p.SpecificTrap,
 			Timestamp:    p.Timestamp,
 		},
-		srcIP:   addr.IP,
-		trapVer: p.Version,
+		origVars:  p.Variables,
+		srcIP:     addr.IP,
+		trapVer:   p.Version,
+		community: p.Community,
+	}
+	if usp, ok := p.SecurityParameters.(*g.UsmSecurityParameters); ok && p.Version == g.Version3 {
+		trap.v3User = usp.UserName
+	}
+
+	// Keep the notification OID as sent (or as it would be for a v1 trap)
+	// since the v1 translation only keeps it as enterprise and specific.
+	if p.Version == g.Version1 {
+		trap.trapOID = v1TrapOID(&trap.data)
+	} else {
+		for _, v := range p.Variables {
+			if v.Name == snmpTrapOID && v.Type == g.ObjectIdentifier {
+				trap.trapOID = v.Value.(string)
+				break
+			}
+		}
 	}
 
 	// Translate to v1 if needed
@@ -138,10 +181,10 @@ func trapHandler(p *g.SnmpPacket, addr *net.UDPAddr) {
 		}
 	}
 
-	if teConfig.Logging.Level == "debug" {
+	if e := logger.Debug(); e.Enabled() {
 		var info string
 		info = makeTrapLogEntry(&trap)
-		logger.Debug().Str("trap", info).Msg("Raw trap info")
+		e.Str("trap", info).Msg("Raw trap info")
 	}
 
 	processTrap(&trap)
@@ -151,45 +194,55 @@ func trapHandler(p *g.SnmpPacket, addr *net.UDPAddr) {
 // against the filter list and processes the trap accordingly.
 //
 func processTrap(sgt *sgTrap) {
-	for _, f := range teConfig.filters {
-		// If this trap is tagged to drop, then continue.
+	processFilterChain(sgt.config().filters, sgt)
+}
+
+// processFilterChain runs a trap through a list of filters (the main filters
+// list or a chain). A jump runs the target chain and carries on with the next
+// filter, while a goto runs the target chain in place of the rest of this
+// list. A return stops this list, which goes back to the list that jumped to
+// it (or ends processing for the main list).
+//
+func processFilterChain(filters []trapexFilter, sgt *sgTrap) {
+	for _, f := range filters {
+		// If this trap is tagged to drop, there is nothing more to do.
 		if sgt.dropped {
+			return
+		}
+		// A rule no longer matches once it expires, even before it is
+		// removed.
+		if f.rule != nil && f.rule.expired(time.Now()) {
 			continue
 		}
-		// If matchAll is true, just process the action.
-		if f.matchAll == true {
-			// We don't expect to see this here (set a wide open filter for
-			// drop).... (but...)
-			if f.actionType == actionBreak {
-				sgt.dropped = true
-				stats.DroppedTraps++
-				trapsDropped.Inc()
-				continue
-			}
-			f.processAction(sgt)
-			if f.actionType == actionForwardBreak || f.actionType == actionLogBreak || f.actionType == actionCsvBreak {
-				sgt.dropped = true
-				stats.DroppedTraps++
-				trapsDropped.Inc()
-				continue
-			}
-		} else {
-			// Determine if this trap matches this filter
-			if f.isFilterMatch(sgt) {
-				if f.actionType == actionBreak {
-					sgt.dropped = true
-					stats.DroppedTraps++
-					trapsDropped.Inc()
-					continue
-				}
-				f.processAction(sgt)
-				if f.actionType == actionForwardBreak || f.actionType == actionLogBreak || f.actionType == actionCsvBreak {
-					sgt.dropped = true
-					stats.DroppedTraps++
-					trapsDropped.Inc()
-					continue
-				}
-			}
+		// If matchAll is true, just process the action. Otherwise, determine
+		// if this trap matches this filter.
+		if !f.matchAll && !f.isFilterMatch(sgt) {
+			continue
+		}
+		atomic.AddUint64(f.hits, 1)
+		switch f.actionType {
+		case actionBreak:
+			sgt.dropped = true
+			atomic.AddUint64(&stats.DroppedTraps, 1)
+			trapsDropped.Inc()
+			return
+		case actionJump:
+			processFilterChain(f.action.(*filterChain).filters, sgt)
+			continue
+		case actionGoto:
+			processFilterChain(f.action.(*filterChain).filters, sgt)
+			return
+		case actionReturn:
+			return
+		}
+		f.processAction(sgt)
+		if f.actionType == actionForwardBreak || f.actionType == actionLogBreak || f.actionType == actionCsvBreak ||
+			f.actionType == actionJsonBreak || f.actionType == actionSyslogBreak || f.actionType == actionWebhookBreak ||
+			f.actionType == actionClickhouseBreak {
+			sgt.dropped = true
+			atomic.AddUint64(&stats.DroppedTraps, 1)
+			trapsDropped.Inc()
+			return
 		}
 	}
 }
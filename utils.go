@@ -7,12 +7,14 @@ package main
 
 import (
 	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"log"
 	"net"
 	"strconv"
 	"strings"
 	"time"
+	"unicode/utf8"
 
 	g "github.com/gosnmp/gosnmp"
 	"github.com/natefinch/lumberjack"
@@ -60,6 +62,77 @@ func (n *network) contains(ip net.IP) bool {
 	return n.net.Contains(ip)
 }
 
+// Bounds for the open-ended integer ranges.
+const (
+	maxInt = int(^uint(0) >> 1)
+	minInt = -maxInt - 1
+)
+
+// intRange is an inclusive range of integers.
+//
+type intRange struct {
+	min int
+	max int
+}
+
+// intRanges is a list of integer ranges that a value can fall in.
+//
+type intRanges []intRange
+
+// newIntRanges parses a comma-separated list of integers (x), ranges (x:y),
+// and open-ended comparisons (>x, >=x, <x, <=x).
+//
+func newIntRanges(spec string) (intRanges, error) {
+	var ranges intRanges
+	for _, item := range strings.Split(spec, ",") {
+		var r intRange
+		var err error
+		switch {
+		case strings.HasPrefix(item, ">="):
+			r.max = maxInt
+			r.min, err = strconv.Atoi(item[2:])
+		case strings.HasPrefix(item, ">"):
+			r.max = maxInt
+			r.min, err = strconv.Atoi(item[1:])
+			r.min++
+		case strings.HasPrefix(item, "<="):
+			r.min = minInt
+			r.max, err = strconv.Atoi(item[2:])
+		case strings.HasPrefix(item, "<"):
+			r.min = minInt
+			r.max, err = strconv.Atoi(item[1:])
+			r.max--
+		case strings.Contains(item, ":"):
+			bounds := strings.SplitN(item, ":", 2)
+			if r.min, err = strconv.Atoi(bounds[0]); err == nil {
+				r.max, err = strconv.Atoi(bounds[1])
+			}
+			if err == nil && r.min > r.max {
+				return nil, fmt.Errorf("invalid integer range (start is after end): %s", item)
+			}
+		default:
+			r.min, err = strconv.Atoi(item)
+			r.max = r.min
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid integer range value: %s: %s", spec, err)
+		}
+		ranges = append(ranges, r)
+	}
+	return ranges, nil
+}
+
+// Returns true if the given value falls within any of the ranges.
+//
+func (ranges intRanges) contains(val int) bool {
+	for _, r := range ranges {
+		if val >= r.min && val <= r.max {
+			return true
+		}
+	}
+	return false
+}
+
 // logTrap takes care of logging the given trap to the given trapLogger
 // destination.
 //
@@ -71,7 +144,14 @@ func logTrap(sgt *sgTrap, l *log.Logger) {
 // destination.
 //
 func logCsvTrap(sgt *sgTrap, l *log.Logger) {
-	l.Printf(makeTrapLogCsvEntry(sgt))
+	l.Println(makeTrapLogCsvEntry(sgt))
+}
+
+// logJsonTrap takes care of logging the given trap to the given
+// trapJsonLogger destination.
+//
+func logJsonTrap(sgt *sgTrap, l *log.Logger) {
+	l.Println(makeTrapLogJsonEntry(sgt))
 }
 
 // panicOnError check an error pointer and panics if it is not nil.
@@ -121,7 +201,7 @@ func makeTrapLogEntry(sgt *sgTrap) string {
 	} else {
 		genTrapType = strconv.Itoa(trap.GenericTrap)
 	}
-	b.WriteString(fmt.Sprintf("\nTrap: %v", stats.TrapCount))
+	b.WriteString(fmt.Sprintf("\nTrap: %v", sgt.trapNumber))
 	if sgt.translated == true {
 		b.WriteString(fmt.Sprintf(" (translated from v%s)", sgt.trapVer.String()))
 	}
@@ -132,12 +212,18 @@ func makeTrapLogEntry(sgt *sgTrap) string {
 	b.WriteString(fmt.Sprintf("\tSpecific Type: %v\n", trap.SpecificTrap))
 	b.WriteString(fmt.Sprintf("\tEnterprise: %s\n", strings.Trim(trap.Enterprise, ".")))
 	b.WriteString(fmt.Sprintf("\tTimestamp: %v\n", trap.Timestamp))
+	// With MIBs loaded, names are shown for the notification, varbinds, and
+	// enumerated values.
+	mibs := sgt.config().mibs
+	if mibs != nil {
+		b.WriteString(fmt.Sprintf("\tTrap OID: %s\n", mibs.oidName(sgt.trapOID)))
+	}
 
 	replacer := strings.NewReplacer("\n", " - ", "%", "%%")
 
 	// Process the Varbinds for this trap.
 	for _, v := range trap.Variables {
-		vbName := strings.Trim(v.Name, ".")
+		vbName := mibs.oidName(v.Name)
 		switch v.Type {
 		case g.OctetString:
 			var nonASCII bool
@@ -158,7 +244,11 @@ func makeTrapLogEntry(sgt *sgTrap) string {
 				b.WriteString(fmt.Sprintf("\tObject:%s Value:%s\n", vbName, replacer.Replace(string(val))))
 			}
 		default:
-			b.WriteString(fmt.Sprintf("\tObject:%s Value:%v\n", vbName, v.Value))
+			if val, ok := mibs.formatValue(v); ok {
+				b.WriteString(fmt.Sprintf("\tObject:%s Value:%s\n", vbName, val))
+			} else {
+				b.WriteString(fmt.Sprintf("\tObject:%s Value:%v\n", vbName, v.Value))
+			}
 		}
 	}
 	return b.String()
@@ -190,10 +280,10 @@ func makeTrapLogCsvEntry(sgt *sgTrap) string {
 
 	csv[0] = fmt.Sprintf("%v", ts[:10])
 	csv[1] = fmt.Sprintf("%v %v", ts[:10], ts[11:19])
-	csv[2] = fmt.Sprintf("\"%v\"", teConfig.General.Hostname)
-	csv[3] = fmt.Sprintf("%v", stats.TrapCount)
-	csv[4] = fmt.Sprintf("\"%v\"", sgt.srcIP)
-	csv[5] = fmt.Sprintf("\"%v\"", trap.AgentAddress)
+	csv[2] = fmt.Sprintf("\"%v\"", sgt.config().General.Hostname)
+	csv[3] = fmt.Sprintf("%v", sgt.trapNumber)
+	csv[4] = fmt.Sprintf("\"%v\"", csvIPAddress(sgt.srcIP))
+	csv[5] = fmt.Sprintf("\"%v\"", csvIPAddress(net.ParseIP(trap.AgentAddress)))
 	csv[6] = fmt.Sprintf("%v", trap.GenericTrap)
 	csv[7] = fmt.Sprintf("%v", trap.SpecificTrap)
 	csv[8] = fmt.Sprintf("\"%v\"", strings.Trim(trap.Enterprise, "."))
@@ -202,14 +292,15 @@ func makeTrapLogCsvEntry(sgt *sgTrap) string {
 	var vbVal []string
 
 	// For escaping quotes and backslashes and replace newlines with a space
-	replacer := strings.NewReplacer("\"", "\"\"", "'", "''", "\\", "\\\\", "\n", " - ", "%", "%%")
+	replacer := strings.NewReplacer("\"", "\"\"", "'", "''", "\\", "\\\\", "\n", " - ")
 
 	// Process the Varbinds for this trap.
 	// Varbinds are split to separate arrays - one for the ObjectIDs,
 	// and the other for Values
+	mibs := sgt.config().mibs
 	for _, v := range trap.Variables {
-		// Get the OID
-		vbObj = append(vbObj, strings.Trim(v.Name, "."))
+		// Get the OID (by name if MIBs are loaded)
+		vbObj = append(vbObj, mibs.oidName(v.Name))
 		// Parse the value
 		switch v.Type {
 		case g.OctetString:
@@ -231,7 +322,11 @@ func makeTrapLogCsvEntry(sgt *sgTrap) string {
 				vbVal = append(vbVal, replacer.Replace(fmt.Sprintf("%v", string(val))))
 			}
 		default:
-			vbVal = append(vbVal, replacer.Replace(fmt.Sprintf("%v", v.Value)))
+			if val, ok := mibs.formatValue(v); ok {
+				vbVal = append(vbVal, replacer.Replace(val))
+			} else {
+				vbVal = append(vbVal, replacer.Replace(fmt.Sprintf("%v", v.Value)))
+			}
 		}
 	}
 	// Now we create the CS-escaped string representation of our varbind arrays
@@ -242,6 +337,20 @@ func makeTrapLogCsvEntry(sgt *sgTrap) string {
 	return strings.Join(csv[:], ",")
 }
 
+// csvIPAddress returns the IPv6 form of the given IP address for the
+// IPv6 columns of the Clickhouse table (IPv4 addresses are written as
+// IPv4-mapped IPv6 addresses).
+//
+func csvIPAddress(ip net.IP) string {
+	if ip == nil {
+		return "::"
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return "::ffff:" + ip4.String()
+	}
+	return ip.String()
+}
+
 // secondsToDuration converts the given number of seconds into a more
 // human-readable formatted string.
 //
@@ -275,3 +384,100 @@ func isIgnoredVersion(ver g.SnmpVersion) bool {
 	}
 	return false
 }
+
+// trapJsonEntry is the JSON form of a trap for the json action. The names
+// are only set when MIBs are loaded.
+//
+type trapJsonEntry struct {
+	Time         string            `json:"time"`
+	Hostname     string            `json:"hostname"`
+	TrapNumber   uint64            `json:"trap_number"`
+	SourceIP     string            `json:"source_ip"`
+	AgentAddress string            `json:"agent_address"`
+	Version      string            `json:"version"`
+	Translated   bool              `json:"translated"`
+	Enterprise   string            `json:"enterprise"`
+	GenericTrap  int               `json:"generic_trap"`
+	SpecificTrap int               `json:"specific_trap"`
+	TrapOID      string            `json:"trap_oid"`
+	TrapName     string            `json:"trap_name,omitempty"`
+	V3User       string            `json:"v3_user,omitempty"`
+	Varbinds     []varbindJsonItem `json:"varbinds"`
+}
+
+// varbindJsonItem is the JSON form of a varbind. OctetString values that
+// are not printable are hex encoded (with encoding set to "hex").
+//
+type varbindJsonItem struct {
+	OID       string      `json:"oid"`
+	Name      string      `json:"name,omitempty"`
+	Type      string      `json:"type"`
+	Value     interface{} `json:"value"`
+	ValueName string      `json:"value_name,omitempty"`
+	Encoding  string      `json:"encoding,omitempty"`
+}
+
+// makeTrapLogJsonEntry creates a JSON Lines log entry (without the newline)
+// for the given trap data.
+//
+func makeTrapLogJsonEntry(sgt *sgTrap) string {
+	b, err := json.Marshal(makeTrapJson(sgt))
+	if err != nil {
+		logger.Warn().Err(err).Msg("Error creating JSON log entry")
+		return ""
+	}
+	return string(b)
+}
+
+// makeTrapJson creates the JSON form of the given trap data (as used by the
+// json and webhook actions).
+//
+func makeTrapJson(sgt *sgTrap) *trapJsonEntry {
+	trap := sgt.data
+	mibs := sgt.config().mibs
+
+	entry := trapJsonEntry{
+		Time:         time.Now().Format(time.RFC3339Nano),
+		Hostname:     sgt.config().General.Hostname,
+		TrapNumber:   sgt.trapNumber,
+		SourceIP:     sgt.srcIP.String(),
+		AgentAddress: trap.AgentAddress,
+		Version:      "v" + sgt.trapVer.String(),
+		Translated:   sgt.translated,
+		Enterprise:   strings.Trim(trap.Enterprise, "."),
+		GenericTrap:  trap.GenericTrap,
+		SpecificTrap: trap.SpecificTrap,
+		TrapOID:      strings.TrimLeft(sgt.trapOID, "."),
+		V3User:       sgt.v3User,
+		Varbinds:     []varbindJsonItem{},
+	}
+	if name := mibs.oidName(sgt.trapOID); name != entry.TrapOID {
+		entry.TrapName = name
+	}
+
+	for _, v := range trap.Variables {
+		item := varbindJsonItem{OID: strings.Trim(v.Name, "."), Type: v.Type.String(), Value: v.Value}
+		if name := mibs.oidName(v.Name); name != item.OID {
+			item.Name = name
+		}
+		switch v.Type {
+		case g.OctetString:
+			val := v.Value.([]byte)
+			if utf8.Valid(val) && strings.IndexFunc(string(val), func(r rune) bool {
+				return r < 32 && r != '\t' && r != '\n' && r != '\r' || r == 127
+			}) < 0 {
+				item.Value = string(val)
+			} else {
+				item.Value = hex.EncodeToString(val)
+				item.Encoding = "hex"
+			}
+		case g.ObjectIdentifier:
+			item.Value = strings.TrimLeft(v.Value.(string), ".")
+		}
+		if val, ok := mibs.formatValue(v); ok {
+			item.ValueName = val
+		}
+		entry.Varbinds = append(entry.Varbinds, item)
+	}
+	return &entry
+}
@@ -0,0 +1,95 @@
+// Copyright (c) 2021 Damien Stuart. All rights reserved.
+//
+// Use of this source code is governed by the MIT License that can be found
+// in the LICENSE file.
+//
+package main
+
+import (
+	"strconv"
+	"strings"
+
+	g "github.com/gosnmp/gosnmp"
+)
+
+// Additional OID constants we need for v1 to v2c conversion.
+const (
+	snmpTrapCommunity = ".1.3.6.1.6.3.18.1.4.0"
+)
+
+// translateToV2c builds the v2c notification varbinds for a v1 trap per
+// RFC-3584 section 3.1. The trap itself is not modified so the v1 data
+// is still available for v1 destinations.
+//
+func translateToV2c(t *sgTrap) []g.SnmpPDU {
+	trap := &t.data
+
+	enterpriseOID := trap.Enterprise
+	if !strings.HasPrefix(enterpriseOID, ".") {
+		enterpriseOID = "." + enterpriseOID
+	}
+
+	vars := make([]g.SnmpPDU, 0, len(trap.Variables)+5)
+	vars = append(vars,
+		g.SnmpPDU{Name: sysUpTime, Type: g.TimeTicks, Value: uint32(trap.Timestamp)},
+		g.SnmpPDU{Name: snmpTrapOID, Type: g.ObjectIdentifier, Value: v1TrapOID(trap)},
+	)
+
+	// Keep the original varbinds, noting whether any of the ones we
+	// append below are already present.
+	var haveAddress, haveCommunity, haveEnterprise bool
+	for _, v := range trap.Variables {
+		switch v.Name {
+		case snmpTrapAddress:
+			haveAddress = true
+		case snmpTrapCommunity:
+			haveCommunity = true
+		case snmpTrapEnterprise:
+			haveEnterprise = true
+		}
+		vars = append(vars, v)
+	}
+
+	if !haveAddress {
+		vars = append(vars, g.SnmpPDU{Name: snmpTrapAddress, Type: g.IPAddress, Value: trap.AgentAddress})
+	}
+	if !haveCommunity {
+		vars = append(vars, g.SnmpPDU{Name: snmpTrapCommunity, Type: g.OctetString, Value: []byte(t.community)})
+	}
+	if !haveEnterprise {
+		vars = append(vars, g.SnmpPDU{Name: snmpTrapEnterprise, Type: g.ObjectIdentifier, Value: enterpriseOID})
+	}
+
+	return vars
+}
+
+// v1TrapOID returns the snmpTrapOID for a v1 trap per RFC-3584 section 3.1.
+// Standard (generic) traps map to the snmpTraps subtree, while enterprise
+// specific traps are <enterprise>.0.<specific>.
+//
+func v1TrapOID(trap *g.SnmpTrap) string {
+	if trap.GenericTrap >= 0 && trap.GenericTrap < 6 {
+		return snmpTraps + "." + strconv.Itoa(trap.GenericTrap+1)
+	}
+	return "." + strings.TrimLeft(trap.Enterprise, ".") + ".0." + strconv.Itoa(trap.SpecificTrap)
+}
+
+// setTrapAddress returns a copy of vars with the snmpTrapAddress varbind set
+// to addr (added if it is missing), which is how the agent address set by a
+// nat action is sent to v2c/v3 destinations.
+//
+func setTrapAddress(vars []g.SnmpPDU, addr string) []g.SnmpPDU {
+	out := make([]g.SnmpPDU, 0, len(vars)+1)
+	found := false
+	for _, v := range vars {
+		if v.Name == snmpTrapAddress {
+			v = g.SnmpPDU{Name: snmpTrapAddress, Type: g.IPAddress, Value: addr}
+			found = true
+		}
+		out = append(out, v)
+	}
+	if !found {
+		out = append(out, g.SnmpPDU{Name: snmpTrapAddress, Type: g.IPAddress, Value: addr})
+	}
+	return out
+}
@@ -0,0 +1,149 @@
+// Copyright (c) 2021 Damien Stuart. All rights reserved.
+//
+// Use of this source code is governed by the MIT License that can be found
+// in the LICENSE file.
+//
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	g "github.com/gosnmp/gosnmp"
+)
+
+var updateGolden = flag.Bool("update", false, "update the golden files in tests/golden")
+
+// v1TestTrap returns a v1 trap with the given generic/specific types and
+// a couple of varbinds to carry through the translation.
+//
+func v1TestTrap(generic int, specific int) *sgTrap {
+	return &sgTrap{
+		data: g.SnmpTrap{
+			Enterprise:   ".1.3.6.1.4.1.8072.3.2.10",
+			AgentAddress: "10.1.2.3",
+			GenericTrap:  generic,
+			SpecificTrap: specific,
+			Timestamp:    123456,
+			Variables: []g.SnmpPDU{
+				{Name: ".1.3.6.1.2.1.2.2.1.1.3", Type: g.Integer, Value: 3},
+				{Name: ".1.3.6.1.2.1.2.2.1.2.3", Type: g.OctetString, Value: []byte("eth0")},
+			},
+		},
+		trapVer:   g.Version1,
+		srcIP:     net.ParseIP("192.168.1.10"),
+		community: "public",
+	}
+}
+
+// formatVarbinds renders varbinds as one "name type value" line each for
+// comparison against the golden files.
+//
+func formatVarbinds(vars []g.SnmpPDU) string {
+	var b strings.Builder
+	for _, v := range vars {
+		switch val := v.Value.(type) {
+		case []byte:
+			b.WriteString(fmt.Sprintf("%s %s %s\n", v.Name, v.Type, string(val)))
+		default:
+			b.WriteString(fmt.Sprintf("%s %s %v\n", v.Name, v.Type, val))
+		}
+	}
+	return b.String()
+}
+
+func TestTranslateToV2cGolden(t *testing.T) {
+	tests := []struct {
+		name     string
+		generic  int
+		specific int
+	}{
+		{"cold_start", 0, 0},
+		{"warm_start", 1, 0},
+		{"link_down", 2, 0},
+		{"link_up", 3, 0},
+		{"auth_failure", 4, 0},
+		{"egp_neighbor_loss", 5, 0},
+		{"enterprise_specific", 6, 17},
+	}
+
+	for _, tc := range tests {
+		got := formatVarbinds(translateToV2c(v1TestTrap(tc.generic, tc.specific)))
+		golden := filepath.Join("tests", "golden", "v1_to_v2c_"+tc.name+".golden")
+		if *updateGolden {
+			if err := ioutil.WriteFile(golden, []byte(got), 0644); err != nil {
+				t.Fatalf("unable to update golden file %s: %s", golden, err)
+			}
+		}
+		want, err := ioutil.ReadFile(golden)
+		if err != nil {
+			t.Fatalf("unable to read golden file %s: %s", golden, err)
+		}
+		if got != string(want) {
+			t.Errorf("%s: translated varbinds do not match %s\ngot:\n%s\nwant:\n%s", tc.name, golden, got, want)
+		}
+	}
+}
+
+func TestTranslateToV2cKeepsExistingVarbinds(t *testing.T) {
+	trap := v1TestTrap(6, 1)
+	trap.data.Variables = append(trap.data.Variables,
+		g.SnmpPDU{Name: snmpTrapAddress, Type: g.IPAddress, Value: "10.9.9.9"})
+
+	count := 0
+	for _, v := range translateToV2c(trap) {
+		if v.Name == snmpTrapAddress {
+			count++
+			if v.Value != "10.9.9.9" {
+				t.Errorf("snmpTrapAddress was replaced: %v", v.Value)
+			}
+		}
+	}
+	if count != 1 {
+		t.Errorf("expected a single snmpTrapAddress varbind, got %d", count)
+	}
+	if len(trap.data.Variables) != 3 {
+		t.Errorf("translation modified the v1 varbinds: %v", trap.data.Variables)
+	}
+}
+
+func TestSetTrapAddress(t *testing.T) {
+	vars := []g.SnmpPDU{
+		{Name: sysUpTime, Type: g.TimeTicks, Value: uint32(100)},
+		{Name: snmpTrapAddress, Type: g.IPAddress, Value: "10.9.9.9"},
+	}
+	got := setTrapAddress(vars, "10.1.1.1")
+	if len(got) != 2 || got[1].Value != "10.1.1.1" {
+		t.Errorf("snmpTrapAddress was not replaced: %v", got)
+	}
+	if vars[1].Value != "10.9.9.9" {
+		t.Errorf("setTrapAddress modified the varbinds: %v", vars)
+	}
+	got = setTrapAddress(vars[:1], "10.1.1.1")
+	if len(got) != 2 || got[1].Name != snmpTrapAddress || got[1].Value != "10.1.1.1" {
+		t.Errorf("snmpTrapAddress was not added: %v", got)
+	}
+}
+
+func TestV1TrapOID(t *testing.T) {
+	tests := []struct {
+		generic  int
+		specific int
+		want     string
+	}{
+		{0, 0, ".1.3.6.1.6.3.1.1.5.1"},
+		{2, 0, ".1.3.6.1.6.3.1.1.5.3"},
+		{5, 0, ".1.3.6.1.6.3.1.1.5.6"},
+		{6, 17, ".1.3.6.1.4.1.8072.3.2.10.0.17"},
+	}
+	for _, tt := range tests {
+		if got := v1TrapOID(&v1TestTrap(tt.generic, tt.specific).data); got != tt.want {
+			t.Errorf("generic %d specific %d: got %s, want %s", tt.generic, tt.specific, got, tt.want)
+		}
+	}
+}
@@ -9,6 +9,7 @@ import (
 	"fmt"
 	"strconv"
 	"strings"
+	"sync/atomic"
 
 	g "github.com/gosnmp/gosnmp"
 )
@@ -105,9 +106,11 @@ func translateToV1(t *sgTrap) error {
 	// Now process the varbinds: Skip the first 2 and remove any Counter64
 	// types. We may be capturing the Enterprise and AgentAddress value
 	// from the varbinds as well. If not, we have fallbacks for them later.
+	// The v1 varbinds go into a new slice so the original list is left
+	// intact for forwarding to v2c/v3 destinations.
 	var enterprise string
 	var agentAddress string
-	n := 0
+	v1Vars := make([]g.SnmpPDU, 0, len(trap.Variables))
 	for i, v := range trap.Variables {
 		// Skip the first 2 varbinds as we don't need them in the v1 trap.
 		if i < 2 {
@@ -115,8 +118,7 @@ func translateToV1(t *sgTrap) error {
 		}
 		// Ignore/Skip any Counter64 types as they are not supported in v1.
 		if v.Type != g.Counter64 {
-			trap.Variables[n] = v
-			n++
+			v1Vars = append(v1Vars, v)
 		}
 		// If this is a standard trap and the snmpTrapEnterprise OID, set
 		// the v1 Enterprise value accordingly
@@ -127,7 +129,7 @@ func translateToV1(t *sgTrap) error {
 			agentAddress = v.Value.(string)
 		}
 	}
-	trap.Variables = trap.Variables[:n]
+	trap.Variables = v1Vars
 
 	// Figure out what our Enterprise value should be.
 	if len(enterprise) > 0 {
@@ -139,21 +141,24 @@ func translateToV1(t *sgTrap) error {
 	}
 
 	// Now set the Agent address. If it is not in the trap data, then use the
-	// packet source IP.
+	// packet source IP. v1 agent addresses are IPv4 only, so an IPv6 source
+	// gets 0.0.0.0 per RFC-3584.
 	if len(agentAddress) > 0 {
 		trap.AgentAddress = agentAddress
-	} else {
+	} else if t.srcIP.To4() != nil {
 		trap.AgentAddress = t.srcIP.String()
+	} else {
+		trap.AgentAddress = "0.0.0.0"
 	}
 
 	t.translated = true
 
 	// Update the translate stats
 	if t.trapVer == g.Version2c {
-		stats.TranslatedFromV2c++
+		atomic.AddUint64(&stats.TranslatedFromV2c, 1)
 		trapsFromV2c.Inc()
 	} else if t.trapVer == g.Version3 {
-		stats.TranslatedFromV3++
+		atomic.AddUint64(&stats.TranslatedFromV3, 1)
 		trapsFromV3.Inc()
 	}
 
@@ -0,0 +1,252 @@
+// Copyright (c) 2021 Damien Stuart. All rights reserved.
+//
+// Use of this source code is governed by the MIT License that can be found
+// in the LICENSE file.
+//
+package main
+
+import (
+	"fmt"
+	"math/big"
+	"regexp"
+	"strings"
+
+	g "github.com/gosnmp/gosnmp"
+)
+
+// Value comparison operators for varbind filters, in the order they are
+// looked for when parsing (so "<=" is found before "<").
+//
+var varbindOps = [...]string{"==", "=~", "<=", ">=", "<", ">"}
+
+// varbindMatch holds the criteria for a varbind filter: which varbinds to
+// look at (by OID), and an optional test on their value. With no test, the
+// filter matches if any varbind has a matching OID. The absent flag flips
+// the result, so the filter matches when no varbind passes.
+//
+type varbindMatch struct {
+	oidMatch
+	op       string // One of varbindOps, or "" to only check the OID
+	value    string
+	valueRe  *regexp.Regexp
+	valueNum *big.Int
+	absent   bool
+}
+
+// parseVarbindCriteria parses the string form of a varbind filter (the value
+// of a "varbind=" or "no_varbind=" filter criteria): an OID spec optionally
+// followed by an operator and value, e.g. "1.3.6.1.2.1.2.2.1.1.*>=10".
+//
+func parseVarbindCriteria(spec string, absent bool, mibs *mibDB) (*varbindMatch, error) {
+	var oid, rest string
+	if strings.HasPrefix(spec, "/") {
+		// A regex OID runs up to the next unescaped "/".
+		end := -1
+		for i := 1; i < len(spec); i++ {
+			if spec[i] == '\\' {
+				i++
+			} else if spec[i] == '/' {
+				end = i
+				break
+			}
+		}
+		if end < 0 {
+			return nil, fmt.Errorf("missing closing / for varbind OID regex: %s", spec)
+		}
+		oid, rest = spec[:end], spec[end+1:]
+	} else {
+		n := strings.IndexFunc(spec, func(r rune) bool {
+			return r > 127 || !isMibWordChar(byte(r)) && !strings.ContainsRune(".*:", r)
+		})
+		if n < 0 {
+			n = len(spec)
+		}
+		oid, rest = spec[:n], spec[n:]
+	}
+
+	var op, value string
+	if rest != "" {
+		for _, o := range varbindOps {
+			if strings.HasPrefix(rest, o) {
+				op, value = o, rest[len(o):]
+				break
+			}
+		}
+		if op == "" {
+			return nil, fmt.Errorf("invalid varbind operator: %s", rest)
+		}
+	}
+	return newVarbindMatch(oid, op, value, absent, mibs)
+}
+
+// oidMatch matches an OID exactly, by prefix, or by regex.
+//
+type oidMatch struct {
+	oidType int         // parseTypeString, parseTypePrefix, or parseTypeRegex
+	oid     interface{} // string or *regexp.Regexp
+}
+
+// newOIDMatch sets up an oidMatch. The OID can be an exact OID, a prefix
+// ending in ".*" that matches anything below it, or a regex starting with
+// "/" (matched against the OID without a leading dot). Exact and prefix
+// OIDs can be given by name (e.g. IF-MIB::linkDown) if MIBs are loaded.
+//
+func newOIDMatch(oid string, mibs *mibDB) (oidMatch, error) {
+	var err error
+	om := oidMatch{}
+	if strings.HasPrefix(oid, "/") {
+		om.oidType = parseTypeRegex
+		om.oid, err = regexp.Compile(oid[1:])
+		if err != nil {
+			return om, fmt.Errorf("unable to compile regexp for OID: %s: %s", oid, err)
+		}
+		return om, nil
+	}
+	oid = strings.TrimLeft(oid, ".")
+	om.oidType = parseTypeString
+	if strings.HasSuffix(oid, ".*") {
+		om.oidType = parseTypePrefix
+		oid = strings.TrimSuffix(oid, ".*")
+	}
+	// Anything that doesn't start with a number is a name from the MIBs.
+	if oid != "" && (oid[0] < '0' || oid[0] > '9') {
+		if oid, err = mibs.resolveName(oid); err != nil {
+			return om, err
+		}
+	}
+	if !isValidOID(oid) {
+		return om, fmt.Errorf("invalid OID: %s", oid)
+	}
+	if om.oidType == parseTypePrefix {
+		oid += "."
+	}
+	om.oid = oid
+	return om, nil
+}
+
+// newVarbindMatch sets up a varbindMatch from its parts. The OID is any of
+// the forms handled by newOIDMatch.
+//
+func newVarbindMatch(oid string, op string, value string, absent bool, mibs *mibDB) (*varbindMatch, error) {
+	var err error
+	vm := varbindMatch{op: op, value: value, absent: absent}
+
+	if vm.oidMatch, err = newOIDMatch(oid, mibs); err != nil {
+		return nil, fmt.Errorf("varbind %s", err)
+	}
+
+	switch op {
+	case "", "==":
+	case "=~":
+		vm.valueRe, err = regexp.Compile(value)
+		if err != nil {
+			return nil, fmt.Errorf("unable to compile regexp for varbind value: %s: %s", value, err)
+		}
+	case "<", "<=", ">", ">=":
+		var ok bool
+		vm.valueNum, ok = new(big.Int).SetString(value, 10)
+		if !ok {
+			return nil, fmt.Errorf("invalid integer for varbind comparison: %s", value)
+		}
+	default:
+		return nil, fmt.Errorf("invalid varbind operator: %s", op)
+	}
+	return &vm, nil
+}
+
+// isValidOID returns true if the given string is a dotted numeric OID
+// (without a leading dot).
+//
+func isValidOID(oid string) bool {
+	if oid == "" {
+		return false
+	}
+	for _, sub := range strings.Split(oid, ".") {
+		if sub == "" || strings.Trim(sub, "0123456789") != "" {
+			return false
+		}
+	}
+	return true
+}
+
+// matches checks the given varbinds against the varbindMatch criteria.
+//
+func (vm *varbindMatch) matches(vars []g.SnmpPDU) bool {
+	for _, v := range vars {
+		if vm.oidMatches(v.Name) && vm.valueMatches(v) {
+			return !vm.absent
+		}
+	}
+	return vm.absent
+}
+
+// oidMatches checks an OID (with or without a leading dot) against the
+// oidMatch.
+//
+func (om *oidMatch) oidMatches(oid string) bool {
+	oid = strings.TrimLeft(oid, ".")
+	switch om.oidType {
+	case parseTypeRegex:
+		return om.oid.(*regexp.Regexp).MatchString(oid)
+	case parseTypePrefix:
+		return strings.HasPrefix(oid, om.oid.(string))
+	default:
+		return oid == om.oid.(string)
+	}
+}
+
+func (vm *varbindMatch) valueMatches(v g.SnmpPDU) bool {
+	switch vm.op {
+	case "":
+		return true
+	case "==":
+		return varbindValueString(v) == vm.value
+	case "=~":
+		return vm.valueRe.MatchString(varbindValueString(v))
+	}
+	n, ok := varbindValueNumber(v)
+	if !ok {
+		return false
+	}
+	c := n.Cmp(vm.valueNum)
+	switch vm.op {
+	case "<":
+		return c < 0
+	case "<=":
+		return c <= 0
+	case ">":
+		return c > 0
+	default:
+		return c >= 0
+	}
+}
+
+// varbindValueString returns the value of a varbind as the string that the
+// "==" and "=~" varbind filters compare against.
+//
+func varbindValueString(v g.SnmpPDU) string {
+	switch v.Type {
+	case g.OctetString:
+		return string(v.Value.([]byte))
+	case g.ObjectIdentifier:
+		return strings.TrimLeft(v.Value.(string), ".")
+	case g.Null, g.NoSuchObject, g.NoSuchInstance, g.EndOfMibView:
+		return ""
+	default:
+		return fmt.Sprintf("%v", v.Value)
+	}
+}
+
+// varbindValueNumber returns the value of a varbind as an integer for the
+// numeric comparison varbind filters. Strings holding a number count too.
+//
+func varbindValueNumber(v g.SnmpPDU) (*big.Int, bool) {
+	switch v.Type {
+	case g.Integer, g.Counter32, g.Gauge32, g.TimeTicks, g.Counter64, g.Uinteger32:
+		return g.ToBigInt(v.Value), true
+	case g.OctetString:
+		return new(big.Int).SetString(strings.TrimSpace(string(v.Value.([]byte))), 10)
+	default:
+		return nil, false
+	}
+}
@@ -0,0 +1,82 @@
+// Copyright (c) 2021 Damien Stuart. All rights reserved.
+//
+// Use of this source code is governed by the MIT License that can be found
+// in the LICENSE file.
+//
+package main
+
+import (
+	"testing"
+
+	g "github.com/gosnmp/gosnmp"
+)
+
+// varbindTestVars is a linkDown-style set of varbinds with a vendor
+// severity and alarm text tacked on.
+//
+var varbindTestVars = []g.SnmpPDU{
+	{Name: ".1.3.6.1.2.1.1.3.0", Type: g.TimeTicks, Value: uint32(12345)},
+	{Name: ".1.3.6.1.6.3.1.1.4.1.0", Type: g.ObjectIdentifier, Value: ".1.3.6.1.6.3.1.1.5.3"},
+	{Name: ".1.3.6.1.2.1.2.2.1.1.7", Type: g.Integer, Value: 7},
+	{Name: ".1.3.6.1.4.1.9999.1.2.0", Type: g.OctetString, Value: []byte("4")},
+	{Name: ".1.3.6.1.4.1.9999.1.3.0", Type: g.OctetString, Value: []byte("Link to core-1 down")},
+	{Name: ".1.3.6.1.4.1.9999.1.4.0", Type: g.Counter64, Value: uint64(18446744073709551615)},
+}
+
+func TestVarbindFilterMatch(t *testing.T) {
+	tests := []struct {
+		spec   string
+		absent bool
+		want   bool
+	}{
+		{"1.3.6.1.2.1.2.2.1.1.7", false, true},
+		{".1.3.6.1.2.1.2.2.1.1.7", false, true},
+		{"1.3.6.1.2.1.2.2.1.1", false, false},
+		{"1.3.6.1.2.1.2.2.1.1.*", false, true},
+		{"1.3.6.1.2.1.2.2.1.2.*", false, false},
+		{"/^1\\.3\\.6\\.1\\.4\\.1\\.9999\\./", false, true},
+		{"/^1\\.3\\.6\\.1\\.4\\.1\\.9\\./", false, false},
+		{"1.3.6.1.2.1.2.2.1.1.*==7", false, true},
+		{"1.3.6.1.2.1.2.2.1.1.*==8", false, false},
+		{"1.3.6.1.6.3.1.1.4.1.0==1.3.6.1.6.3.1.1.5.3", false, true},
+		{"1.3.6.1.4.1.9999.1.3.0=~core-[0-9]+", false, true},
+		{"1.3.6.1.4.1.9999.1.3.0=~^core", false, false},
+		{"/9999\\.1\\.3/=~down$", false, true},
+		{"1.3.6.1.4.1.9999.1.2.0>=4", false, true},
+		{"1.3.6.1.4.1.9999.1.2.0>4", false, false},
+		{"1.3.6.1.4.1.9999.1.2.0<5", false, true},
+		{"1.3.6.1.2.1.2.2.1.1.7<=6", false, false},
+		{"1.3.6.1.4.1.9999.1.4.0>18446744073709551614", false, true},
+		{"1.3.6.1.4.1.9999.1.3.0>0", false, false},
+		{"1.3.6.1.4.1.9999.1.9.0", true, true},
+		{"1.3.6.1.2.1.2.2.1.1.*", true, false},
+		{"1.3.6.1.2.1.2.2.1.1.*==8", true, true},
+	}
+	for _, tt := range tests {
+		vm, err := parseVarbindCriteria(tt.spec, tt.absent, nil)
+		if err != nil {
+			t.Errorf("%s: %s", tt.spec, err)
+			continue
+		}
+		if got := vm.matches(varbindTestVars); got != tt.want {
+			t.Errorf("%s (absent=%v): got %v, want %v", tt.spec, tt.absent, got, tt.want)
+		}
+	}
+}
+
+func TestVarbindFilterBad(t *testing.T) {
+	for _, spec := range []string{
+		"",
+		"1.3..6",
+		"1.3.*.6",
+		"1.3.6.1!7",
+		"/^1\\.3",
+		"/[/",
+		"1.3.6.1=~[",
+		"1.3.6.1>high",
+	} {
+		if _, err := parseVarbindCriteria(spec, false, nil); err == nil {
+			t.Errorf("Should have detected a bad varbind filter: %s", spec)
+		}
+	}
+}
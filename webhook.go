@@ -0,0 +1,274 @@
+// Copyright (c) 2021 Damien Stuart. All rights reserved.
+//
+// Use of this source code is governed by the MIT License that can be found
+// in the LICENSE file.
+//
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/creasty/defaults"
+)
+
+// webhookParams are the settings for a named webhook destination
+// (webhook_destinations) used by the webhook action.
+//
+type webhookParams struct {
+	URL     string            `yaml:"url"`
+	Headers map[string]string `default:"{}" yaml:"headers"`
+	Timeout time.Duration     `default:"10s" yaml:"timeout"`
+
+	// Traps are posted in batches of up to batch_size, waiting at most
+	// batch_timeout for a batch to fill.
+	BatchSize    int           `default:"1" yaml:"batch_size"`
+	BatchTimeout time.Duration `default:"5s" yaml:"batch_timeout"`
+
+	// Failed posts are retried with an exponential backoff, while new traps
+	// wait in a queue of up to queue_size traps.
+	Retries         int           `default:"5" yaml:"retries"`
+	RetryBackoff    time.Duration `default:"1s" yaml:"retry_backoff"`
+	RetryBackoffMax time.Duration `default:"60s" yaml:"retry_backoff_max"`
+	QueueSize       int           `default:"1000" yaml:"queue_size"`
+}
+
+// trapWebhook is an instance of a webhook destination. Traps are queued by
+// processTrap and posted by a worker goroutine.
+//
+type trapWebhook struct {
+	name   string
+	params *webhookParams
+	client *http.Client
+	mu     sync.RWMutex
+	closed bool
+	queue  chan *trapJsonEntry
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+// processWebhookDestinations validates each of the named webhook
+// destinations.
+//
+func processWebhookDestinations(newConfig *trapexConfig) error {
+	for _, stanza := range newConfig.WebhookDestinations {
+		for destName, params := range stanza {
+			if _, ok := newConfig.webhookDestinations[destName]; ok {
+				return fmt.Errorf("duplicate webhook_destinations entry: %s", destName)
+			}
+			dest := params
+			if err := defaults.Set(&dest); err != nil {
+				return err
+			}
+			if err := validateWebhookParams(&dest); err != nil {
+				return fmt.Errorf("webhook_destinations:%s: %s", destName, err)
+			}
+			logger.Info().Str("webhook_destination", destName).Str("url", dest.URL).Msg("Loading webhook destination")
+			newConfig.webhookDestinations[destName] = &dest
+		}
+	}
+	return nil
+}
+
+func validateWebhookParams(p *webhookParams) error {
+	u, err := url.Parse(p.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid url: '%s'", p.URL)
+	}
+	if p.Timeout <= 0 || p.BatchTimeout <= 0 || p.RetryBackoff <= 0 || p.RetryBackoffMax < p.RetryBackoff {
+		return fmt.Errorf("invalid timeout, batch_timeout, retry_backoff, or retry_backoff_max")
+	}
+	if p.BatchSize <= 0 || p.Retries < 0 || p.QueueSize <= 0 {
+		return fmt.Errorf("invalid batch_size, retries, or queue_size")
+	}
+	return nil
+}
+
+// Initialize a trapWebhook instance for a named webhook destination, or for
+// a URL with the default settings, and start its worker.
+//
+func (a *trapWebhook) initAction(name string, teConf *trapexConfig) error {
+	params, err := webhookDestination(name, teConf)
+	if err != nil {
+		return err
+	}
+	a.name = name
+	a.params = params
+	a.client = &http.Client{Timeout: params.Timeout}
+	a.queue = make(chan *trapJsonEntry, params.QueueSize)
+	a.stop = make(chan struct{})
+	a.done = make(chan struct{})
+	go a.run()
+	logger.Info().Str("webhook_destination", name).Str("url", params.URL).Int("batch_size", params.BatchSize).Msg("Added webhook destination")
+	return nil
+}
+
+// webhookDestination returns the params for a named webhook destination, or
+// the default params for a URL.
+//
+func webhookDestination(name string, teConf *trapexConfig) (*webhookParams, error) {
+	if params, ok := teConf.webhookDestinations[name]; ok {
+		return params, nil
+	}
+	if !strings.HasPrefix(name, "http://") && !strings.HasPrefix(name, "https://") {
+		return nil, fmt.Errorf("unknown webhook destination: %s", name)
+	}
+	params := &webhookParams{URL: name}
+	if err := defaults.Set(params); err != nil {
+		return nil, err
+	}
+	if err := validateWebhookParams(params); err != nil {
+		return nil, err
+	}
+	return params, nil
+}
+
+// Hook for queueing a trap for this webhook destination. The trap is
+// dropped if the queue is full.
+//
+func (a *trapWebhook) processTrap(trap *sgTrap) {
+	entry := makeTrapJson(trap)
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	if a.closed {
+		return
+	}
+	select {
+	case a.queue <- entry:
+	default:
+		webhookDropped.WithLabelValues(a.name).Inc()
+		logger.Warn().Str("webhook_destination", a.name).Msg("Webhook queue is full, dropping trap")
+	}
+}
+
+// Close the webhook destination. Queued traps are still posted, but
+// without retries.
+//
+func (a *trapWebhook) close() {
+	a.mu.Lock()
+	if a.closed {
+		a.mu.Unlock()
+		return
+	}
+	a.closed = true
+	close(a.stop)
+	close(a.queue)
+	a.mu.Unlock()
+	<-a.done
+}
+
+// run collects queued traps into batches and posts them.
+//
+func (a *trapWebhook) run() {
+	defer close(a.done)
+	var batch []*trapJsonEntry
+	timer := time.NewTimer(a.params.BatchTimeout)
+	timer.Stop()
+	for {
+		select {
+		case entry, ok := <-a.queue:
+			if !ok {
+				if len(batch) > 0 {
+					a.post(batch)
+				}
+				return
+			}
+			batch = append(batch, entry)
+			if len(batch) >= a.params.BatchSize {
+				if !timer.Stop() {
+					select {
+					case <-timer.C:
+					default:
+					}
+				}
+				a.post(batch)
+				batch = nil
+			} else if len(batch) == 1 {
+				timer.Reset(a.params.BatchTimeout)
+			}
+		case <-timer.C:
+			if len(batch) > 0 {
+				a.post(batch)
+				batch = nil
+			}
+		}
+	}
+}
+
+// post sends a batch of traps as a JSON array, retrying with an
+// exponential backoff on connection errors and 408, 429, and 5xx
+// responses.
+//
+func (a *trapWebhook) post(batch []*trapJsonEntry) {
+	body, err := json.Marshal(batch)
+	if err != nil {
+		logger.Warn().Err(err).Str("webhook_destination", a.name).Msg("Error creating webhook payload")
+		webhookFailed.WithLabelValues(a.name).Add(float64(len(batch)))
+		return
+	}
+	backoff := a.params.RetryBackoff
+	for try := 0; ; try++ {
+		var retry bool
+		if retry, err = a.send(body); err == nil {
+			webhookSent.WithLabelValues(a.name).Add(float64(len(batch)))
+			return
+		}
+		if !retry || try >= a.params.Retries || !a.sleep(backoff) {
+			break
+		}
+		webhookRetries.WithLabelValues(a.name).Inc()
+		logger.Debug().Err(err).Str("webhook_destination", a.name).Int("retry", try+1).Msg("Retrying webhook post")
+		if backoff *= 2; backoff > a.params.RetryBackoffMax {
+			backoff = a.params.RetryBackoffMax
+		}
+	}
+	webhookFailed.WithLabelValues(a.name).Add(float64(len(batch)))
+	logger.Warn().Err(err).Str("webhook_destination", a.name).Int("traps", len(batch)).Msg("Error posting traps to webhook destination")
+}
+
+// sleep waits before a retry, and returns false if the destination was
+// closed in the meantime.
+//
+func (a *trapWebhook) sleep(d time.Duration) bool {
+	select {
+	case <-a.stop:
+		return false
+	case <-time.After(d):
+		return true
+	}
+}
+
+// send makes one POST request, and returns whether a failure is worth
+// retrying.
+//
+func (a *trapWebhook) send(body []byte) (bool, error) {
+	req, err := http.NewRequest("POST", a.params.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "trapex/"+myVersion)
+	for k, v := range a.params.Headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	// Read the body so the connection can be reused.
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+	retry := resp.StatusCode == http.StatusRequestTimeout || resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+	return retry, fmt.Errorf("webhook returned %s", resp.Status)
+}
@@ -0,0 +1,174 @@
+// Copyright (c) 2021 Damien Stuart. All rights reserved.
+//
+// Use of this source code is governed by the MIT License that can be found
+// in the LICENSE file.
+//
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	g "github.com/gosnmp/gosnmp"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func testWebhook(t *testing.T, name string, p webhookParams) *trapWebhook {
+	var testConfig trapexConfig
+	useTestConfig(t, &testConfig)
+	testConfig.webhookDestinations = map[string]*webhookParams{name: &p}
+	a := trapWebhook{}
+	if err := a.initAction(name, &testConfig); err != nil {
+		t.Fatalf("%s", err)
+	}
+	return &a
+}
+
+// webhookBatches returns the batches of traps posted to the server.
+//
+func webhookBatches(s *captureServer) [][]trapJsonEntry {
+	var batches [][]trapJsonEntry
+	for _, r := range s.accepted() {
+		var batch []trapJsonEntry
+		json.Unmarshal(r.body, &batch)
+		batches = append(batches, batch)
+	}
+	return batches
+}
+
+// webhookCounts returns the sent, failed, dropped, and retries counters for
+// a webhook destination.
+//
+func webhookCounts(name string) [4]float64 {
+	return [4]float64{
+		testutil.ToFloat64(webhookSent.WithLabelValues(name)),
+		testutil.ToFloat64(webhookFailed.WithLabelValues(name)),
+		testutil.ToFloat64(webhookDropped.WithLabelValues(name)),
+		testutil.ToFloat64(webhookRetries.WithLabelValues(name)),
+	}
+}
+
+func TestWebhookConfig(t *testing.T) {
+	var testConfig trapexConfig
+	testConfig.webhookDestinations = make(map[string]*webhookParams)
+	if err := loadConfig("tests/config/webhooks.yml", &testConfig); err != nil {
+		t.Fatalf("%s", err)
+	}
+	if err := processWebhookDestinations(&testConfig); err != nil {
+		t.Fatalf("%s", err)
+	}
+	p := testConfig.webhookDestinations["incidents"]
+	if p == nil {
+		t.Fatalf("incidents webhook destination not loaded")
+	}
+	if p.BatchSize != 20 || p.BatchTimeout != 2*time.Second || p.Headers["Authorization"] != "Bearer abc123" {
+		t.Errorf("incidents webhook destination not set correctly: %+v", p)
+	}
+	if p.Retries != 5 || p.RetryBackoff != time.Second || p.RetryBackoffMax != time.Minute || p.QueueSize != 1000 || p.Timeout != 10*time.Second {
+		t.Errorf("incidents webhook destination defaults not set correctly: %+v", p)
+	}
+
+	for _, bad := range []webhookParams{
+		{URL: "ftp://example.com/", Timeout: time.Second, BatchSize: 1, BatchTimeout: time.Second, RetryBackoff: time.Second, RetryBackoffMax: time.Second, QueueSize: 1},
+		{URL: "http://example.com/", Timeout: time.Second, BatchSize: 0, BatchTimeout: time.Second, RetryBackoff: time.Second, RetryBackoffMax: time.Second, QueueSize: 1},
+		{URL: "http://example.com/", Timeout: time.Second, BatchSize: 1, BatchTimeout: time.Second, RetryBackoff: time.Minute, RetryBackoffMax: time.Second, QueueSize: 1},
+	} {
+		if err := validateWebhookParams(&bad); err == nil {
+			t.Errorf("Should have detected invalid webhook params: %+v", bad)
+		}
+	}
+	if _, err := processFilterLine([]string{"*", "*", "*", "*", "*", "*", "webhook", "nosuchdest"}, &testConfig, 0); err == nil {
+		t.Errorf("Should have detected an unknown webhook destination")
+	}
+}
+
+func TestWebhookBatching(t *testing.T) {
+	s := newCaptureServer(t)
+	before := webhookCounts("batching")
+	a := testWebhook(t, "batching", webhookParams{
+		URL: s.URL, Headers: map[string]string{"X-Api-Key": "secret"}, Timeout: time.Second, BatchSize: 3, BatchTimeout: 100 * time.Millisecond,
+		Retries: 1, RetryBackoff: 10 * time.Millisecond, RetryBackoffMax: 10 * time.Millisecond, QueueSize: 10,
+	})
+	for i := 1; i <= 4; i++ {
+		a.processTrap(testTrap(g.Version1, i, sysNameVar("router1")))
+	}
+	// The first 3 fill a batch, and the last one goes after batch_timeout.
+	s.waitPosts(t, 2)
+	a.close()
+
+	batches := webhookBatches(s)
+	if len(batches) != 2 || len(batches[0]) != 3 || len(batches[1]) != 1 {
+		t.Fatalf("traps not batched correctly: %v", batches)
+	}
+	if batches[0][2].SpecificTrap != 3 || batches[1][0].SpecificTrap != 4 || batches[0][0].Varbinds[0].Value != "router1" {
+		t.Errorf("batched traps not set correctly: %v", batches)
+	}
+	if h := s.accepted()[0].header; h.Get("X-Api-Key") != "secret" || h.Get("Content-Type") != "application/json" {
+		t.Errorf("webhook headers not set: %v", h)
+	}
+	if n := webhookCounts("batching")[0] - before[0]; n != 4 {
+		t.Errorf("webhook sent counter should be 4: %v", n)
+	}
+}
+
+func TestWebhookRetries(t *testing.T) {
+	s := newCaptureServer(t, http.StatusServiceUnavailable, http.StatusTooManyRequests, http.StatusOK, http.StatusBadRequest)
+	before := webhookCounts("retries")
+	a := testWebhook(t, "retries", webhookParams{
+		URL: s.URL, Timeout: time.Second, BatchSize: 1, BatchTimeout: time.Second,
+		Retries: 3, RetryBackoff: 10 * time.Millisecond, RetryBackoffMax: 20 * time.Millisecond, QueueSize: 10,
+	})
+	a.processTrap(testTrap(g.Version1, 1, sysNameVar("router1")))
+	s.waitPosts(t, 3)
+	// 400 is not retried.
+	a.processTrap(testTrap(g.Version1, 2, sysNameVar("router1")))
+	s.waitPosts(t, 1)
+	a.close()
+
+	batches := webhookBatches(s)
+	if len(batches) != 1 || batches[0][0].SpecificTrap != 1 {
+		t.Errorf("trap not posted after retries: %v", batches)
+	}
+	if n := webhookCounts("retries")[3] - before[3]; n != 2 {
+		t.Errorf("webhook retries counter should be 2: %v", n)
+	}
+	if n := webhookCounts("retries")[0] - before[0]; n != 1 {
+		t.Errorf("webhook sent counter should be 1: %v", n)
+	}
+	if n := webhookCounts("retries")[1] - before[1]; n != 1 {
+		t.Errorf("webhook failed counter should be 1: %v", n)
+	}
+}
+
+func TestWebhookQueueFull(t *testing.T) {
+	release := make(chan struct{})
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer s.Close()
+	before := webhookCounts("queue_full")
+	a := testWebhook(t, "queue_full", webhookParams{
+		URL: s.URL, Timeout: 5 * time.Second, BatchSize: 1, BatchTimeout: time.Second,
+		Retries: 0, RetryBackoff: 10 * time.Millisecond, RetryBackoffMax: 10 * time.Millisecond, QueueSize: 2,
+	})
+	// The first trap is taken by the worker (which then waits on the
+	// server), two fill the queue, and the rest are dropped.
+	a.processTrap(testTrap(g.Version1, 1, sysNameVar("router1")))
+	time.Sleep(100 * time.Millisecond)
+	for i := 2; i <= 5; i++ {
+		a.processTrap(testTrap(g.Version1, i, sysNameVar("router1")))
+	}
+	close(release)
+	a.close()
+	if n := webhookCounts("queue_full")[2] - before[2]; n != 2 {
+		t.Errorf("webhook dropped counter should be 2: %v", n)
+	}
+	if n := webhookCounts("queue_full")[0] - before[0]; n != 3 {
+		t.Errorf("webhook sent counter should be 3: %v", n)
+	}
+	// Traps after close are ignored.
+	a.processTrap(testTrap(g.Version1, 6, sysNameVar("router1")))
+}
@@ -0,0 +1,23 @@
+//go:build !windows
+// +build !windows
+
+// Copyright (c) 2021 Damien Stuart. All rights reserved.
+//
+// Use of this source code is governed by the MIT License that can be found
+// in the LICENSE file.
+//
+package main
+
+import (
+	"syscall"
+)
+
+// The access(2) mode for write permission
+const accessWriteOK = 0x2
+
+// isWritable checks whether trapex has write permission for a file or
+// directory.
+//
+func isWritable(path string) bool {
+	return syscall.Access(path, accessWriteOK) == nil
+}
@@ -0,0 +1,18 @@
+// Copyright (c) 2021 Damien Stuart. All rights reserved.
+//
+// Use of this source code is governed by the MIT License that can be found
+// in the LICENSE file.
+//
+package main
+
+import (
+	"os"
+)
+
+// isWritable checks whether a file or directory is writable. Windows only
+// has the read-only attribute to go by.
+//
+func isWritable(path string) bool {
+	fi, err := os.Stat(path)
+	return err == nil && fi.Mode().Perm()&0200 != 0
+}